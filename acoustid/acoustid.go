@@ -1,21 +1,26 @@
-// Package acoustid is not production ready.
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Package acoustid is a client of the AcoustID web service: it looks up
+// fingerprints and submits new ones. See https://acoustid.org/webservice.
 package acoustid
 
 // TODO: replace types with MusicBrainz types? Or keep it independent? See how
-// much overlaps. Use a design similar to gomusicbrainz.
+// much overlaps.
 
-import (
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"strconv"
-)
+import "context"
 
 const (
+	// DefaultURL is the root of the API of the official AcoustID server.
+	DefaultURL = "https://api.acoustid.org/v2"
 	// ACOUSTID_URI is the root URI for all the AcoustID requests.
-	ACOUSTID_URI = "http://api.acoustid.org/v2/lookup?client="
+	//
+	// Deprecated: Use Client.
+	ACOUSTID_URI = DefaultURL + "/lookup?client="
 	// ACOUSTID_LOOKUP defines the standard lookup used throughout this package.
 	// Both release and recording IDs are required by MusicBrainz.
+	//
+	// Deprecated: Use DefaultMeta.
 	ACOUSTID_LOOKUP = "&meta=recordings+releases+tracks"
 )
 
@@ -78,21 +83,15 @@ type Result struct {
 type Meta struct {
 	Results []Result
 	Status  string
-	Error   struct{ Message string }
+	Error   struct {
+		Code    int
+		Message string
+	}
 }
 
+// Get queries the official AcoustID server with 'acoustIDKey'.
+//
+// Deprecated: Use Client.Lookup.
 func Get(acoustIDKey string, fingerprint string, duration int) (metadata Meta, err error) {
-	resp, err := http.DefaultClient.Get(ACOUSTID_URI + acoustIDKey + ACOUSTID_LOOKUP + "&duration=" + strconv.Itoa(duration) + "&fingerprint=" + fingerprint)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	buf, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-
-	err = json.Unmarshal(buf, &metadata)
-	return
+	return NewClient(acoustIDKey).Lookup(context.Background(), fingerprint, duration)
 }
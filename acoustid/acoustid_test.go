@@ -0,0 +1,173 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package acoustid
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// standIn is an httptest stand-in of the AcoustID server. It decodes the
+// gzip-compressed form of every request and replies with 'response'.
+type standIn struct {
+	t        *testing.T
+	path     string
+	form     url.Values
+	status   int
+	response string
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Content-Encoding") != "gzip" {
+		s.t.Errorf("Got %v request with encoding %q, want gzip POST", r.Method, r.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.path = r.URL.Path
+	s.form, err = url.ParseQuery(string(buf))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+	}
+	w.Write([]byte(s.response))
+}
+
+func newStandIn(t *testing.T) (*standIn, *httptest.Server, *Client) {
+	s := &standIn{t: t}
+	server := httptest.NewServer(s)
+	c := &Client{HTTPClient: server.Client(), URL: server.URL + "/v2", Key: "key", UserKey: "user"}
+	return s, server, c
+}
+
+func TestLookup(t *testing.T) {
+	s, server, c := newStandIn(t)
+	defer server.Close()
+
+	s.response = `{"status": "ok", "results": [{"id": "r1", "score": 0.95, "recordings": [{"id": "rec1", "title": "Title",
+		"duration": 200, "releases": [{"id": "rel1", "title": "Album", "date": {"year": 2000},
+		"mediums": [{"position": 1, "track_count": 10, "tracks": [{"position": 3}]}]}]}]}]}`
+
+	// The fingerprint characters must be escaped.
+	meta, err := c.Lookup(context.Background(), "AQAA+/=", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"client":      {"key"},
+		"meta":        {"recordings releases tracks"},
+		"duration":    {"200"},
+		"fingerprint": {"AQAA+/="},
+		"format":      {"json"},
+	}
+	if s.path != "/v2/lookup" || !reflect.DeepEqual(s.form, want) {
+		t.Errorf("Got request %q %v, want %q %v", s.path, s.form, "/v2/lookup", want)
+	}
+
+	if len(meta.Results) != 1 || meta.Results[0].Score != 0.95 {
+		t.Fatalf("Got results %+v", meta.Results)
+	}
+	release := meta.Results[0].Recordings[0].Releases[0]
+	if release.ID != "rel1" || release.Date.Year != 2000 || release.Mediums[0].Track_count != 10 || release.Mediums[0].Tracks[0].Position != 3 {
+		t.Errorf("Got release %+v", release)
+	}
+
+	c.Meta = []string{"recordingids"}
+	_, err = c.Lookup(context.Background(), "AQAA", 200)
+	if err != nil || s.form.Get("meta") != "recordingids" {
+		t.Errorf("Got meta %q (%v), want %q", s.form.Get("meta"), err, "recordingids")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	s, server, c := newStandIn(t)
+	defer server.Close()
+
+	want := []struct {
+		status   int
+		response string
+		err      APIError
+	}{
+		{http.StatusBadRequest, `{"status": "error", "error": {"code": 4, "message": "invalid API key"}}`,
+			APIError{Code: 4, Message: "invalid API key", StatusCode: http.StatusBadRequest}},
+		{http.StatusOK, `{"status": "error", "error": {"code": 3, "message": "invalid fingerprint"}}`,
+			APIError{Code: 3, Message: "invalid fingerprint", StatusCode: http.StatusOK}},
+		{http.StatusServiceUnavailable, `<html>Service Unavailable</html>`,
+			APIError{Message: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}},
+	}
+
+	for _, v := range want {
+		s.status = v.status
+		s.response = v.response
+		_, err := c.Lookup(context.Background(), "AQAA", 200)
+		apiErr, ok := err.(*APIError)
+		if !ok || *apiErr != v.err {
+			t.Errorf("Got error %#v, want %#v", err, v.err)
+		}
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	s, server, c := newStandIn(t)
+	defer server.Close()
+
+	s.response = `{"status": "ok", "submissions": [{"index": "0", "id": 12, "status": "pending"}, {"index": 1, "id": 13, "status": "imported"}]}`
+
+	statuses, err := c.Submit(context.Background(), []Submission{
+		{Fingerprint: "AQAA", Duration: 200, Track: "Title", Artist: "Artist", Year: 2000, TrackNumber: 3},
+		{Fingerprint: "AQAB", Duration: 100, MBID: "rec1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := url.Values{
+		"client":        {"key"},
+		"user":          {"user"},
+		"format":        {"json"},
+		"fingerprint.0": {"AQAA"},
+		"duration.0":    {"200"},
+		"track.0":       {"Title"},
+		"artist.0":      {"Artist"},
+		"year.0":        {"2000"},
+		"trackno.0":     {"3"},
+		"fingerprint.1": {"AQAB"},
+		"duration.1":    {"100"},
+		"mbid.1":        {"rec1"},
+	}
+	if s.path != "/v2/submit" || !reflect.DeepEqual(s.form, want) {
+		t.Errorf("Got request %q %v, want %q %v", s.path, s.form, "/v2/submit", want)
+	}
+
+	wantStatuses := []SubmissionStatus{{Index: 0, ID: 12, Status: "pending"}, {Index: 1, ID: 13, Status: "imported"}}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("Got statuses %+v, want %+v", statuses, wantStatuses)
+	}
+}
+
+func TestLookupContext(t *testing.T) {
+	_, server, c := newStandIn(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Lookup(ctx, "AQAA", 200)
+	if err == nil {
+		t.Error("Got no error with canceled context")
+	}
+}
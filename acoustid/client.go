@@ -0,0 +1,233 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package acoustid
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultMeta is the metadata returned by lookups by default. Both release and
+// recording IDs are required by MusicBrainz.
+var DefaultMeta = []string{"recordings", "releases", "tracks"}
+
+// Client queries an AcoustID server.
+//
+// Requests are sent with POST and a gzip-compressed body, as recommended for
+// the long fingerprints.
+type Client struct {
+	// HTTP client used for the requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Root of the API, e.g. DefaultURL.
+	URL string
+	// API key of the application.
+	Key string
+	// API key of the user, only required for submissions.
+	UserKey string
+	// Metadata returned by lookups. If nil, DefaultMeta is used.
+	Meta []string
+	// If not empty, the User-Agent header of the requests.
+	UserAgent string
+}
+
+// NewClient returns a client of the official server for application 'key'.
+func NewClient(key string) *Client {
+	return &Client{URL: DefaultURL, Key: key}
+}
+
+// APIError is an error response of the AcoustID server.
+// See https://acoustid.org/webservice for the error codes.
+type APIError struct {
+	Code    int
+	Message string
+	// HTTP status code of the response.
+	StatusCode int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("AcoustID: %s (code %d)", e.Message, e.Code)
+}
+
+// Submission is a fingerprint to submit, with the metadata of the track. All
+// metadata is optional.
+type Submission struct {
+	Fingerprint string
+	// In seconds.
+	Duration int
+
+	// MusicBrainz recording ID. When set, the other metadata is ignored by the
+	// server.
+	MBID string
+
+	Track       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Year        int
+	TrackNumber int
+	DiscNumber  int
+
+	// E.g. "FLAC" or "MP3".
+	FileFormat string
+	// In kbit/s.
+	Bitrate int
+}
+
+// SubmissionStatus is the status of a submission.
+type SubmissionStatus struct {
+	// Index of the submission in the request.
+	Index int
+	// Identifier of the submission on the server.
+	ID int
+	// "pending" or "imported".
+	Status string
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. The index is sent as
+// a string.
+func (s *SubmissionStatus) UnmarshalJSON(buf []byte) error {
+	var v struct {
+		Index  json.RawMessage
+		ID     int
+		Status string
+	}
+	err := json.Unmarshal(buf, &v)
+	if err != nil {
+		return err
+	}
+	s.Index, err = strconv.Atoi(strings.Trim(string(v.Index), `"`))
+	if err != nil {
+		return fmt.Errorf("AcoustID: invalid submission index %s", v.Index)
+	}
+	s.ID = v.ID
+	s.Status = v.Status
+	return nil
+}
+
+// Lookup returns the metadata of the track of 'duration' seconds fingerprinted
+// as 'fingerprint'.
+func (c *Client) Lookup(ctx context.Context, fingerprint string, duration int) (Meta, error) {
+	meta := c.Meta
+	if meta == nil {
+		meta = DefaultMeta
+	}
+	params := url.Values{}
+	params.Set("client", c.Key)
+	params.Set("meta", strings.Join(meta, " "))
+	params.Set("duration", strconv.Itoa(duration))
+	params.Set("fingerprint", fingerprint)
+
+	var result Meta
+	err := c.post(ctx, "/lookup", params, &result)
+	return result, err
+}
+
+// Submit submits 'submissions' with the user key. The statuses are returned in
+// the order of the server.
+func (c *Client) Submit(ctx context.Context, submissions []Submission) ([]SubmissionStatus, error) {
+	params := url.Values{}
+	params.Set("client", c.Key)
+	params.Set("user", c.UserKey)
+	for i, s := range submissions {
+		suffix := "." + strconv.Itoa(i)
+		set := func(key, value string) {
+			if value != "" {
+				params.Set(key+suffix, value)
+			}
+		}
+		setInt := func(key string, value int) {
+			if value > 0 {
+				params.Set(key+suffix, strconv.Itoa(value))
+			}
+		}
+		set("fingerprint", s.Fingerprint)
+		setInt("duration", s.Duration)
+		set("mbid", s.MBID)
+		set("track", s.Track)
+		set("artist", s.Artist)
+		set("album", s.Album)
+		set("albumartist", s.AlbumArtist)
+		setInt("year", s.Year)
+		setInt("trackno", s.TrackNumber)
+		setInt("discno", s.DiscNumber)
+		set("fileformat", s.FileFormat)
+		setInt("bitrate", s.Bitrate)
+	}
+
+	var result struct {
+		Submissions []SubmissionStatus
+	}
+	err := c.post(ctx, "/submit", params, &result)
+	return result.Submissions, err
+}
+
+// post sends 'params' gzip-compressed to 'endpoint' and decodes the JSON
+// response into 'v'. Error responses are returned as *APIError.
+func (c *Client) post(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	params.Set("format", "json")
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte(params.Encode()))
+	// Writing to a bytes.Buffer cannot fail.
+	zw.Close()
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+endpoint, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Encoding", "gzip")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Error responses have a JSON body as well.
+	var status struct {
+		Status string
+		Error  struct {
+			Code    int
+			Message string
+		}
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	if err != nil {
+		return err
+	}
+	if json.Unmarshal(buf.Bytes(), &status) != nil && resp.StatusCode != http.StatusOK {
+		return &APIError{Message: resp.Status, StatusCode: resp.StatusCode}
+	}
+	if status.Status == "error" || resp.StatusCode != http.StatusOK {
+		message := status.Error.Message
+		if message == "" {
+			message = resp.Status
+		}
+		return &APIError{Code: status.Error.Code, Message: message, StatusCode: resp.StatusCode}
+	}
+
+	err = json.Unmarshal(buf.Bytes(), v)
+	if err != nil {
+		return fmt.Errorf("AcoustID: %v", err)
+	}
+	return nil
+}
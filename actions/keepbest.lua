@@ -0,0 +1,26 @@
+-- Keep the best copy among duplicates: lossless first, then the highest
+-- bitrate, then the most recent file.
+local lossless = {alac=true, ape=true, flac=true, tta=true, wavpack=true}
+
+local function is_lossless(d)
+	local stream = d.streams[d.audioindex+1]
+	local codec = stream and stream.codec_name or ''
+	return lossless[codec] or codec:match('^pcm_') ~= nil
+end
+
+local function better(a, b)
+	if is_lossless(a) ~= is_lossless(b) then
+		return is_lossless(a)
+	end
+	if a.bitrate ~= b.bitrate then
+		return a.bitrate > b.bitrate
+	end
+	return a.time.sec > b.time.sec
+end
+
+keep = 1
+for i, d in ipairs(duplicates) do
+	if better(d, duplicates[keep]) then
+		keep = i
+	end
+end
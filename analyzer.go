@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
@@ -27,6 +28,7 @@ import (
 
 	"github.com/aarzilli/golua/lua"
 	"github.com/ambrevar/demlo/cuesheet"
+	"github.com/ambrevar/demlo/tagwriter"
 	"github.com/mgutz/ansi"
 	"github.com/yookoala/realpath"
 )
@@ -40,12 +42,36 @@ var (
 
 // analyzer loads file metadata into the file record, run the scripts and preview the result.
 // If required, it will fetch additional input metadata online.
-// This stage does not split elegantly:
-// - defaultTags need to be passed to the running script.
-// - The preview depends on prepareTrackTags.
+// When records are grouped, the metadata is loaded beforehand by the preparer.
 type analyzer struct {
 	L         *lua.State
 	scriptLog *log.Logger
+	grouped   bool
+}
+
+// preparer loads file metadata into the file record. It is the first half of
+// the analyzer, run as a separate stage when the records must be grouped before
+// running the scripts.
+type preparer struct {
+	// Only set to run the filter.
+	L *lua.State
+}
+
+func (p *preparer) Init() {
+	if options.Filter != "" {
+		p.L = MakeSandbox(nil)
+		SandboxCompileAction(p.L, actionFilter, cache.actions[actionFilter])
+	}
+}
+
+func (p *preparer) Close() {
+	if p.L != nil {
+		p.L.Close()
+	}
+}
+
+func (p *preparer) Run(ctx context.Context, fr *FileRecord) error {
+	return prepare(p.L, fr)
 }
 
 func (a *analyzer) Init() {
@@ -75,53 +101,27 @@ func (a *analyzer) Close() {
 	a.L.Close()
 }
 
-func (a *analyzer) Run(fr *FileRecord) error {
-	fr.section.Println(fr.input.path)
-
-	// Should be run before setting the covers.
-	err := prepareInput(fr, &fr.input)
-	if err != nil {
-		return err
+func (a *analyzer) Run(ctx context.Context, fr *FileRecord) error {
+	if !a.grouped {
+		err := prepare(a.L, fr)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Shorthand.
 	input := &fr.input
 
-	err = getExternalCover(fr)
-	if err != nil {
-		fr.warning.Print(err)
-		return err
-	}
-
-	getEmbeddedCover(fr)
-	var defaultTags map[string]string
-
-	// We retrieve tags online only for single-track files. TODO: Add support for multi-track files.
-	if input.trackCount == 1 {
-		var releaseID ReleaseID
-		prepareTrackTags(input, 1)
-		if options.Gettags {
-			releaseID, defaultTags, err = GetOnlineTags(fr)
-			if err != nil {
-				fr.warning.Print("Online tags query error: ", err)
-			}
-		}
-		if options.Getcover {
-			fr.onlineCoverCache, input.onlineCover, err = GetOnlineCover(fr, releaseID)
-			if err != nil {
-				fr.warning.Print("Online cover query error: ", err)
-			}
-		}
-	}
-
 	fr.output = make([]outputInfo, input.trackCount)
 	fr.status = make([]outputStatus, input.trackCount)
 	for track := 0; track < input.trackCount; track++ {
-		err := a.RunAllScripts(fr, track, defaultTags)
+		err := a.RunAllScripts(fr, track)
 		if err != nil {
 			fr.status[track] = statusFail
+			emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventScriptsFailed, Track: track + 1, Status: fr.status[track].String()}, err)
 			continue
 		}
+		emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventAnalyzed, Track: track + 1, Status: fr.status[track].String(), Output: fr.output[track].Path}, nil)
 	}
 
 	// Preview changes.
@@ -154,12 +154,17 @@ func (a *analyzer) Run(fr *FileRecord) error {
 	return nil
 }
 
-func (a *analyzer) RunAllScripts(fr *FileRecord, track int, defaultTags map[string]string) error {
+func (a *analyzer) RunAllScripts(fr *FileRecord, track int) error {
 	input := &fr.input
 	output := &fr.output[track]
 
 	prepareTrackTags(input, track)
 
+	album := fr.album
+	if album == nil {
+		album = []inputInfo{*input}
+	}
+
 	if o, ok := cache.index[input.path]; ok && len(o) > track {
 		*output = cache.index[input.path][track]
 		options.Gettags = false
@@ -170,8 +175,10 @@ func (a *analyzer) RunAllScripts(fr *FileRecord, track int, defaultTags map[stri
 		for k, v := range input.tags {
 			output.Tags[k] = v
 		}
-		for k, v := range defaultTags {
-			output.Tags[k] = v
+		if track < len(fr.defaultTags) {
+			for k, v := range fr.defaultTags[track] {
+				output.Tags[k] = v
+			}
 		}
 
 		// Default codec options.
@@ -181,7 +188,7 @@ func (a *analyzer) RunAllScripts(fr *FileRecord, track int, defaultTags map[stri
 	// Create a Lua sandbox containing input and output, then run scripts.
 	a.scriptLog.SetOutput(&fr.logBuf)
 	for _, script := range cache.scripts {
-		err := RunScript(a.L, script.name, input, output)
+		err := RunScript(a.L, script.name, input, output, album)
 		if err != nil {
 			fr.error.Printf("Script %s: %s", script.name, err)
 			return err
@@ -308,6 +315,89 @@ func (a *analyzer) RunAllScripts(fr *FileRecord, track int, defaultTags map[stri
 	return nil
 }
 
+// prepare loads the input metadata, the covers and, if required, the loudness,
+// the online metadata and the lyrics. Files excluded by the filter, evaluated
+// in 'L', are dropped once probed.
+func prepare(L *lua.State, fr *FileRecord) error {
+	fr.section.Println(fr.input.path)
+
+	// Should be run before setting the covers.
+	err := prepareInput(fr, &fr.input)
+	if err != nil {
+		emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventFailed}, err)
+		return err
+	}
+	emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventProbed}, nil)
+
+	if options.Filter != "" {
+		err = filterInput(L, fr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Shorthand.
+	input := &fr.input
+
+	err = getExternalCover(fr)
+	if err != nil {
+		fr.warning.Print(err)
+		emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventFailed}, err)
+		return err
+	}
+
+	getEmbeddedCover(fr)
+
+	// We analyze loudness only for single-track files.
+	// TODO: Add support for multi-track files.
+	if input.trackCount == 1 {
+		var releaseID ReleaseID
+		var tags map[string]string
+		prepareTrackTags(input, 1)
+		if options.Loudness {
+			getLoudness(fr)
+		}
+		if options.Gettags {
+			releaseID, tags, err = GetOnlineTags(fr)
+			if err != nil {
+				fr.warning.Print("Online tags query error: ", err)
+			}
+			fr.unidentified = err == errUnidentAlbum
+			fr.defaultTags = []map[string]string{tags}
+		}
+		if options.Lyrics {
+			getLyrics(fr)
+		}
+		if options.Getcover {
+			fr.onlineCoverCache, input.onlineCover, err = GetOnlineCover(fr, releaseID)
+			if err != nil {
+				fr.warning.Print("Online cover query error: ", err)
+			}
+		}
+	} else if options.Gettags || options.Getcover {
+		// Multi-track files are identified as a whole.
+		releaseID, disc, err := identifyDisc(fr)
+		if err != nil {
+			fr.warning.Print("Online disc query error: ", err)
+		} else {
+			if options.Gettags {
+				fr.defaultTags, err = GetOnlineDiscTags(fr, releaseID, disc)
+				if err != nil {
+					fr.warning.Print("Online tags query error: ", err)
+				}
+			}
+			if options.Getcover {
+				fr.onlineCoverCache, input.onlineCover, err = GetOnlineCover(fr, releaseID)
+				if err != nil {
+					fr.warning.Print("Online cover query error: ", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // prepareInput sets the details of 'info' as returned by ffprobe.
 // As a special case, if 'info' is 'fr.input', then 'fr.Format' and
 // 'fr.Streams': those values will be needed later in the pipeline.
@@ -315,6 +405,7 @@ func prepareInput(fr *FileRecord, info *inputInfo) error {
 	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", info.path)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
+	detachProcess(cmd)
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -378,6 +469,9 @@ func prepareInput(fr *FileRecord, info *inputInfo) error {
 			info.filetags[key] = v
 		}
 	}
+	// Files tagged by Picard have the MusicBrainz identifiers under their
+	// descriptions, e.g. "musicbrainz album id".
+	info.filetags = tagwriter.CanonicalTags(info.filetags)
 
 	var ErrCuesheet error
 	info.cuesheet, ErrCuesheet = cuesheet.New([]byte(info.filetags["cuesheet"]))
@@ -429,6 +523,9 @@ func prepareInput(fr *FileRecord, info *inputInfo) error {
 				info.filetags[strings.ToLower(k)] = v
 			}
 		}
+		if info.cuesheet.Catalog != "" {
+			info.filetags["catalog"] = info.cuesheet.Catalog
+		}
 
 		// A cuesheet might have several FILE entries, or even none (non-standard).
 		// In case of none, tracks are stored at file "" (the empty string) in the
@@ -476,6 +573,7 @@ func getEmbeddedCover(fr *FileRecord) {
 		cmd := exec.Command("ffmpeg", "-nostdin", "-v", "error", "-y", "-i", input.path, "-an", "-sn", "-c:v", "copy", "-f", "image2", "-map", "0:"+strconv.Itoa(i), "-")
 		var stderr bytes.Buffer
 		cmd.Stderr = &stderr
+		detachProcess(cmd)
 
 		cover, err := cmd.Output()
 		if err != nil {
@@ -570,9 +668,13 @@ func prepareTrackTags(input *inputInfo, track int) {
 		// track-related as opposed to album-related. Cuesheets make a distinction
 		// between the two. Some tags may appear both in an album field and a track
 		// field. Thus track tags must have higher priority.
-		for k, v := range input.cuesheet.Files[input.cuesheetFile][track].Tags {
+		cueTrack := input.cuesheet.Files[input.cuesheetFile][track]
+		for k, v := range cueTrack.Tags {
 			input.tags[strings.ToLower(k)] = v
 		}
+		if cueTrack.ISRC != "" {
+			input.tags["isrc"] = cueTrack.ISRC
+		}
 	}
 }
 
@@ -711,6 +813,13 @@ func preview(fr *FileRecord, track int) {
 	prettyPrint(fr, "path", input.path, output.Path, attrMaxlen, valueMaxlen)
 	prettyPrint(fr, "format", fr.Format.FormatName, output.Format, attrMaxlen, valueMaxlen)
 	prettyPrint(fr, "parameters", "bitrate="+strconv.Itoa(input.bitrate), fmt.Sprintf("%v", output.Parameters), attrMaxlen, valueMaxlen)
+	if output.LRC != "" {
+		in := ""
+		if input.lyrics != nil {
+			in = input.lyrics.Source
+		}
+		prettyPrint(fr, "lyrics", in, StripExt(output.Path)+".lrc", attrMaxlen, valueMaxlen)
+	}
 
 	fr.plain.Printf("%*v === "+ansi.Color("%-*v", colorTitle)+" ===\n",
 		valueMaxlen, "",
@@ -744,6 +853,21 @@ func preview(fr *FileRecord, track int) {
 		out := fmt.Sprintf("<%v> %q '%v'", output.OnlineCover.Format, output.OnlineCover.Parameters, output.OnlineCover.Path)
 		prettyPrint(fr, "online", in, out, attrMaxlen, valueMaxlen)
 	}
+	for _, cover := range output.EmbedCovers {
+		in := cover.Source
+		switch cover.Source {
+		case "external":
+			in += fmt.Sprintf(" '%v'", cover.Name)
+		case "embedded":
+			in += fmt.Sprintf(" 'stream %v'", cover.Index)
+		}
+		coverType := cover.Type
+		if coverType == "" {
+			coverType = "front"
+		}
+		out := fmt.Sprintf("<%v> %q %v", cover.Format, cover.Parameters, coverType)
+		prettyPrint(fr, "embed", in, out, attrMaxlen, valueMaxlen)
+	}
 
 	fr.plain.Println()
 }
@@ -0,0 +1,126 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Record the input files that were completely processed so that an interrupted
+// run can be resumed.
+//
+// The checkpoint is a sequence of JSON strings, the input paths, one per line,
+// appended as the files are processed. It is removed when the run completes.
+// By default, it is named after the input of the run so that unrelated runs do
+// not share it.
+
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var checkpoint Checkpoint
+
+// Checkpoint lists the completely processed files: Done looks up the paths
+// loaded on resume, Record appends those of the current run. Without '-p' no
+// checkpoint is opened, and no file is done.
+type Checkpoint struct {
+	f    *os.File
+	enc  *json.Encoder
+	done map[string]bool
+	sync.Mutex
+}
+
+// OpenCheckpoint opens 'path'. If 'resume' is true, the paths it records are
+// loaded and new paths are appended. Otherwise it is truncated.
+func OpenCheckpoint(path string, resume bool) (Checkpoint, error) {
+	done := map[string]bool{}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+		f, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return Checkpoint{}, err
+		}
+		if err == nil {
+			s := bufio.NewScanner(f)
+			s.Buffer(nil, indexMaxsize)
+			for line := 1; s.Scan(); line++ {
+				var p string
+				err := json.Unmarshal(s.Bytes(), &p)
+				if err != nil {
+					// The last line may be truncated if the run was killed.
+					warning.Printf("%v:%v: %v", path, line, err)
+					continue
+				}
+				done[p] = true
+			}
+			err = s.Err()
+			f.Close()
+			if err != nil {
+				return Checkpoint{}, fmt.Errorf("%v: %v", path, err)
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return Checkpoint{f: f, enc: json.NewEncoder(f), done: done}, nil
+}
+
+// checkpointName returns a name identifying the set of 'inputs', whatever
+// their order.
+func checkpointName(inputs []string) string {
+	paths := make([]string, len(inputs))
+	for i, input := range inputs {
+		path, err := filepath.Abs(input)
+		if err != nil {
+			path = input
+		}
+		paths[i] = path
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(paths, "\x00"))))
+}
+
+// Done reports whether the input file at 'path' was processed by the resumed
+// run.
+func (c *Checkpoint) Done(path string) bool {
+	return c.done[path]
+}
+
+// Record appends the input path of 'fr' to the checkpoint.
+func (c *Checkpoint) Record(fr *FileRecord) {
+	if c.f == nil {
+		return
+	}
+	c.Lock()
+	err := c.enc.Encode(fr.input.path)
+	c.Unlock()
+	if err != nil {
+		fr.warning.Print("checkpoint: ", err)
+	}
+}
+
+// Close the checkpoint file.
+func (c *Checkpoint) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// Remove the checkpoint file once the run has completed.
+func (c *Checkpoint) Remove() error {
+	if c.f == nil {
+		return nil
+	}
+	c.Close()
+	return os.Remove(c.f.Name())
+}
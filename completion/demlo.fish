@@ -31,23 +31,69 @@ for i in $XDG_DATA_DIRS/demlo/actions
 	end
 end
 
+complete -c demlo -o acoustid-key -x -d "AcoustID API key"
+complete -c demlo -o acoustid-submit -d "Submit unidentified fingerprints"
+complete -c demlo -o acoustid-submit=false -d "Do not submit fingerprints"
+complete -c demlo -o acoustid-url -x -d "AcoustID API URL"
 complete -c demlo -o c -d "Fetch cover"
 complete -c demlo -o c=false -d "Do not fetch cover"
+complete -c demlo -o cache-clear -d "Clear online cache"
+complete -c demlo -o cache-ttl -x -d "Days to keep online cache"
+complete -c demlo -o checkpoint -r -d "Checkpoint file"
 complete -c demlo -o color -d "Enable color output"
 complete -c demlo -o color=false -d "Disable color output"
 complete -c demlo -o cores -x -d "Number of cores" -a '(seq 0 (getconf _NPROCESSORS_ONLN))\tcores'
+complete -c demlo -o coverartarchive-url -x -d "Cover Art Archive URL"
 complete -c demlo -o debug -d "Enable debug output"
 complete -c demlo -o debug=false -d "Disable debug output"
+complete -c demlo -o dedupe -d "Report duplicates"
+complete -c demlo -o dedupe-action -x -d "Action choosing the duplicate to keep" -a "$system_action_cmd $user_action_cmd"
+complete -c demlo -o dedupe-threshold -x -d "Minimum similarity of duplicates"
+complete -c demlo -o discogs-url -x -d "Discogs API URL"
+complete -c demlo -o events -x -d "Print events to stdout" -a "json"
+complete -c demlo -o exclude -x -d "Skip paths matching pattern"
 complete -c demlo -o exist -x -d "Add exist action" -a "$system_action_cmd $user_action_cmd"
 complete -c demlo -o ext -x -d "Add search extension"
+complete -c demlo -o files-from -r -d "Read input paths from file, or stdin with -"
+complete -c demlo -o filter -x -d "Lua expression selecting files"
+complete -c demlo -o gaps -x -d "Pregap handling when splitting" -a "append prepend discard"
+complete -c demlo -o group -x -d "Group files before running the scripts" -a "none folder album"
 complete -c demlo -o h -x -d "Show script help" -a "$system_script_cmd $user_script_cmd"
 complete -c demlo -o i -r -d "Index"
+complete -c demlo -o include -x -d "Only process paths matching pattern"
+complete -c demlo -o interactive -d "Choose online releases"
+complete -c demlo -o interactive=false -d "Use best online releases"
+complete -c demlo -o journal -r -d "Journal file"
+complete -c demlo -o loudness -d "Analyze loudness"
+complete -c demlo -o loudness=false -d "Do not analyze loudness"
+complete -c demlo -o lrclib-url -x -d "LRCLIB URL"
+complete -c demlo -o lyrics -d "Fetch lyrics"
+complete -c demlo -o lyrics=false -d "Do not fetch lyrics"
+complete -c demlo -o lyrics-dir -r -d "Folder of local lyrics"
+complete -c demlo -o match-threshold -x -d "Minimum score of online matches"
+complete -c demlo -o match-tolerance -x -d "Reuse of online releases" -a "acoustid full artist album any"
+complete -c demlo -o max-size -x -d "Maximum file size"
+complete -c demlo -o min-size -x -d "Minimum file size"
+complete -c demlo -o musicbrainz-url -x -d "MusicBrainz URL"
+complete -c demlo -o newer -x -d "Only process files modified after time"
+complete -c demlo -o older -x -d "Only process files modified before time"
+complete -c demlo -o online-max-delay -x -d "Maximum delay before retrying online queries"
+complete -c demlo -o online-retries -x -d "Retries of online queries"
+complete -c demlo -o online-timeout -x -d "Timeout of online queries in seconds"
 complete -c demlo -o p -d "Process"
 complete -c demlo -o p=false -d "Do not process"
+complete -c demlo -o progress -d "Display progress"
+complete -c demlo -o progress=false -d "Do not display progress"
+complete -c demlo -o progress-interval -x -d "Seconds between progress lines"
 complete -c demlo -o post -x -d "Postscript"
 complete -c demlo -o pre -x -d "Prescript"
 complete -c demlo -o r -x -d "Remove scripts" -a "$system_script_cmd $user_script_cmd"
+complete -c demlo -o resume -d "Skip files processed by the interrupted run"
 complete -c demlo -o s -x -d "Add script" -a "$system_script_cmd $user_script_cmd"
 complete -c demlo -o t -d "Fetch tags"
 complete -c demlo -o t=false -d "Do not fetch tags"
+complete -c demlo -o trash -r -d "Folder where removed files are moved"
+complete -c demlo -o undo -r -d "Revert changes from journal"
+complete -c demlo -o watch -d "Watch folders for new files"
+complete -c demlo -o watch-delay -x -d "Seconds before processing new files"
 complete -c demlo -o v -d "Print version"
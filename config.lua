@@ -3,12 +3,51 @@ All the commandline options can get a default value from here.
 Commandline values take precedence.
 --]]
 
+-- API key and root URL of the AcoustID API. Change them to use a replica of
+-- the official server.
+AcoustIDKey = 'iOiEFv7y'
+AcoustIDURL = 'https://api.acoustid.org/v2'
+
+-- Submit the fingerprints of the processed files that could not be identified
+-- online, with their output tags. Submissions require the API key of your
+-- AcoustID account, see https://acoustid.org/api-key.
+AcoustIDSubmit = false
+AcoustIDUserKey = ''
+
+-- Number of days the results of online queries are kept on disk, in
+-- $XDG_CACHE_HOME/demlo. Set to 0 to only cache them for the duration of a run.
+CacheTTL = 30
+
+-- Maximum size of the cache of online queries in MiB (0 for unlimited). The
+-- oldest entries are removed first.
+CacheSize = 100
+
 -- Colors may not work on all terminals.
 Color = true
 
 -- Number of cores to use (0 for all).
 Cores = 0
 
+-- Root URL of the Cover Art Archive server.
+CoverArtArchiveURL = 'http://coverartarchive.org'
+
+-- Action choosing the copy to keep among duplicates with '-dedupe'. If empty,
+-- duplicates are only reported.
+DedupeAction = ''
+
+-- Minimum similarity (from 0 to 1) of the fingerprints of duplicates.
+DedupeThreshold = 0.85
+
+-- Personal access token of the Discogs provider, see
+-- https://www.discogs.com/settings/developers.
+DiscogsToken = ''
+
+-- Root URL of the Discogs API.
+DiscogsURL = 'https://api.discogs.com'
+
+-- Skip the files whose path matches one of the patterns. See 'Include'.
+Exclude = {}
+
 --[[ When the destination exit, the "exist" action is taken.
 An action is a Lua script which sets the variable 'output.write' to the following possible values:
 - "overwrite": overwrite.
@@ -27,6 +66,20 @@ for _, v in ipairs(ext) do
 	Extensions[v]=true
 end
 
+-- Only process the files for which this Lua expression is true, e.g.
+-- "i.genre ~= 'Podcast'". It is evaluated once the file has been probed, with
+-- 'input' and its tags 'i'.
+Filter = ''
+
+-- When splitting multi-track files, where the pregap of a track goes, i.e. the
+-- audio between its INDEX 00 and INDEX 01 in the cuesheet:
+-- - 'append': to the end of the previous track, like CD players do.
+-- - 'prepend': to the beginning of the track.
+-- - 'discard': nowhere.
+-- The pregap of the first track, e.g. a hidden track, is always kept unless
+-- discarded.
+Gaps = 'prepend'
+
 -- Whther to fetch cover from an online database.
 -- Since Internet queries slow down the process, it's recommended to only turn
 -- it on from the commandline when needed.
@@ -37,6 +90,111 @@ Getcover = false
 -- it on from the commandline when needed.
 Gettags = false
 
+-- Group the files before running the scripts so that the inputs of the group
+-- are available in the 'album' table. Possible values:
+-- - 'none': each file is its own group.
+-- - 'folder': files of the same folder.
+-- - 'album': files with the same album, album artist and date. The scripts are
+--   only run once all the files have been analyzed.
+Group = 'none'
+
+-- Only process the files whose path matches one of the patterns, if any. A
+-- pattern is a glob matching consecutive components of the path, e.g.
+-- 'Podcasts' or '*.flac', or a regexp matching a part of the path if prefixed
+-- with 're:'.
+Include = {}
+
+-- When fetching tags or covers online, prompt on the terminal to choose the
+-- release of every album among the best candidates, to skip the album or to
+-- enter a MusicBrainz release ID.
+Interactive = false
+
+-- Root URL of the LRCLIB lyrics server.
+LRCLIBURL = 'https://lrclib.net'
+
+-- Analyze the loudness of the tracks and of their albums. Since the analysis
+-- decodes the whole audio stream, it's recommended to only turn it on from the
+-- commandline when needed.
+Loudness = false
+
+-- Fetch the lyrics of the tracks. It's recommended to only turn it on from the
+-- commandline when needed.
+Lyrics = false
+
+-- Folder of local lyrics, named after the artist and the title, e.g.
+-- 'Artist - Title.lrc' or 'Artist/Title.lrc'.
+LyricsDir = ''
+
+-- Lyrics providers, tried in order until one of them has lyrics:
+-- - 'local': the '.lrc' file next to the input file, then 'LyricsDir'.
+-- - 'lrclib': the LRCLIB database.
+LyricsProviders = {'local', 'lrclib'}
+
+-- Online matches scoring below this threshold (from 0 to 1) are reported as
+-- unidentified and their tags are left untouched.
+MatchThreshold = 0
+
+-- How a file can reuse the online release of a previous file of a similar
+-- album, from the strictest to the loosest:
+-- - 'acoustid': never, every file is fingerprinted.
+-- - 'full': similar album, album artist and date.
+-- - 'artist': similar album and album artist.
+-- - 'album': similar album.
+-- - 'any': any previous release.
+MatchTolerance = 'full'
+
+-- Minimum relation (from 0 to 1) for two album fields to be similar.
+MatchRelation = 0.7
+
+-- Weights of the fields when scoring the online candidates. The score is
+-- normalized by the sum of the weights. Missing fields get the default weight.
+MatchWeights = {
+	title = 26,
+	artist = 25,
+	albumartist = 13,
+	album = 13,
+	position = 9,
+	year = 7,
+	duration = 7,
+}
+
+-- Skip the files bigger or smaller than these sizes in bytes, with an optional
+-- unit, e.g. '500K', '1.5M' or '2G'. Empty for no limit.
+MaxSize = ''
+MinSize = ''
+
+-- Root URL of the MusicBrainz server, e.g. a local mirror. The web service is
+-- expected under '/ws/2'.
+MusicBrainzURL = 'https://musicbrainz.org'
+
+-- Only process the files modified after and before these times, either dates
+-- ('2006-01-02', '2006-01-02 15:04' or RFC 3339) or durations before now, e.g.
+-- '36h', '7d' or '2w'. Empty for no limit.
+Newer = ''
+Older = ''
+
+-- Maximum delay in seconds before retrying an online query, even if the server
+-- requests more (0 for no limit).
+OnlineMaxDelay = 60
+
+-- Maximum number of requests per second to every online service (0 for
+-- unlimited). The defaults follow the policies of the official servers and
+-- can be raised for mirrors.
+OnlineRates = {
+	acoustid = 3,
+	coverartarchive = 0,
+	discogs = 1,
+	lrclib = 0,
+	musicbrainz = 1,
+}
+
+-- Number of retries of failed or throttled online queries. The delay between
+-- retries doubles every time, unless the server specifies it.
+OnlineRetries = 3
+
+-- Abort online queries after this many seconds (0 for never).
+OnlineTimeout = 30
+
 -- Lua code to run before and after the other scripts, respectively.
 Prescript = ''
 Postscript = ''
@@ -44,6 +202,20 @@ Postscript = ''
 -- If false, show preview and exit before processing.
 Process = false
 
+-- Display the progress of the run: the number of processed files, the
+-- throughput and the estimated remaining time.
+Progress = false
+
+-- When stderr is not a terminal, print the progress every this many seconds.
+ProgressInterval = 60
+
+-- Online providers, tried in order until one of them returns a match scoring
+-- at least 'MatchThreshold':
+-- - 'musicbrainz': fingerprint lookup with AcoustID, tags from MusicBrainz and
+--   covers from the Cover Art Archive.
+-- - 'discogs': search by album and album artist. Requires 'DiscogsToken'.
+Providers = {'musicbrainz'}
+
 -- Scripts to run by default.
 -- Scripts can later be added or removed via the commandline.
 -- Demlo runs them in lexicographic order.
@@ -51,3 +223,8 @@ Process = false
 -- made by 'tag', so we name the scripts with a prefix number so that 'tag' is
 -- run before 'path'.
 Scripts = {'10-tag-normalize', '15-tag-disc_from_path', '20-tag-replace', '30-tag-case', '40-tag-punctuation', '50-encoding', '60-path', '70-cover'}
+
+-- In watch mode ('-watch'), files are processed once they have not been
+-- modified for this number of seconds. This avoids processing partially written
+-- files.
+WatchDelay = 5
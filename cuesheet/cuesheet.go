@@ -22,15 +22,33 @@ import (
 	"errors"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var (
-	reFile    = regexp.MustCompile(`^\s*FILE\s+"?([^"]+)"?`)
-	reIndex   = regexp.MustCompile(`^\s*INDEX\s*\d+\s+(\d\d):(\d\d):(\d\d)`)
-	rePostgap = regexp.MustCompile(`^\s*POSTGAP\s+(\d\d):(\d\d):(\d\d)`)
-	rePregap  = regexp.MustCompile(`^\s*PREGAP\s+(\d\d):(\d\d):(\d\d)`)
-	reTag     = regexp.MustCompile(`^\s*(?:REM\b)?\s*(\S+)\s+"?([^"]+)"?`)
-	reTrack   = regexp.MustCompile(`^\s*TRACK\s+(\d+)`)
+	reCatalog    = regexp.MustCompile(`^\s*CATALOG\s+"?(\d+)"?`)
+	reCDTextFile = regexp.MustCompile(`^\s*CDTEXTFILE\s+"?([^"]+)"?`)
+	reFile       = regexp.MustCompile(`^\s*FILE\s+"?([^"]+)"?`)
+	reFlags      = regexp.MustCompile(`^\s*FLAGS\s+(.*)`)
+	reIndex      = regexp.MustCompile(`^\s*INDEX\s*(\d+)\s+(\d+):(\d\d):(\d\d)`)
+	reISRC       = regexp.MustCompile(`^\s*ISRC\s+"?(\w+)"?`)
+	rePostgap    = regexp.MustCompile(`^\s*POSTGAP\s+(\d+):(\d\d):(\d\d)`)
+	rePregap     = regexp.MustCompile(`^\s*PREGAP\s+(\d+):(\d\d):(\d\d)`)
+	reTag        = regexp.MustCompile(`^\s*(?:REM\b)?\s*(\S+)\s+"?([^"]+)"?`)
+	reTrack      = regexp.MustCompile(`^\s*TRACK\s+(\d+)(?:\s+(\S+))?`)
+)
+
+// Track data types.
+const (
+	Audio = "AUDIO"
+)
+
+// Track flags.
+const (
+	FlagDCP  = "DCP"  // Digital copy permitted.
+	Flag4CH  = "4CH"  // Four channel audio.
+	FlagPRE  = "PRE"  // Pre-emphasis enabled.
+	FlagSCMS = "SCMS" // Serial copy management system.
 )
 
 type Time struct {
@@ -39,16 +57,77 @@ type Time struct {
 	Msec int
 }
 
+// Index is an INDEX entry of a track. Index 0 marks the beginning of the pregap
+// included in the file, index 1 the beginning of the track. Higher numbers are
+// subindices within the track.
+type Index struct {
+	Number int
+	Time
+}
+
 type Track struct {
-	Tags    map[string]string
-	Indices []Time
-	Pregap  Time
-	Postgap Time
+	Tags map[string]string
+	// AUDIO or one of the data types, e.g. MODE1/2352.
+	DataType string
+	Flags    []string
+	ISRC     string
+	Indices  []Index
+	Pregap   Time
+	Postgap  Time
+	// File of the indices before index 1 when it differs from the file of the
+	// track. In the non-compliant multi-file layout of EAC, the pregap of a
+	// track ends the previous file.
+	PregapFile string
 }
 
 type Cuesheet struct {
-	Header map[string]string
-	Files  map[string][]Track
+	Header     map[string]string
+	Catalog    string
+	CDTextFile string
+	Files      map[string][]Track
+}
+
+// parseTime converts the 'mm', 'ss' and 'ff' strings to a Time.
+func parseTime(mm, ss, ff string) Time {
+	min, _ := strconv.Atoi(mm)
+	sec, _ := strconv.Atoi(ss)
+	frames, _ := strconv.Atoi(ff)
+	return Time{Min: min, Sec: sec, Msec: int(1000 * float64(frames) / 75)}
+}
+
+// Msecs returns the time in milliseconds.
+func (t Time) Msecs() int {
+	return 1000*(60*t.Min+t.Sec) + t.Msec
+}
+
+// Index returns the index numbered 'number' in the file of the track.
+func (t Track) Index(number int) (Time, bool) {
+	for _, index := range t.Indices {
+		if index.Number < 1 && t.PregapFile != "" {
+			continue
+		}
+		if index.Number == number {
+			return index.Time, true
+		}
+	}
+	return Time{}, false
+}
+
+// Start returns the time of index 1, or of the first index if there is no
+// index 1.
+func (t Track) Start() Time {
+	if start, ok := t.Index(1); ok {
+		return start
+	}
+	if len(t.Indices) > 0 {
+		return t.Indices[0].Time
+	}
+	return Time{}
+}
+
+// IsAudio reports whether the track holds audio data.
+func (t Track) IsAudio() bool {
+	return t.DataType == "" || t.DataType == Audio
 }
 
 // New initializes a cuesheet from a string.
@@ -66,16 +145,35 @@ func New(cuesheet []byte) (Cuesheet, error) {
 
 	header := true
 	file := ""
+	// File of the current track. It differs from 'file' when a FILE line
+	// follows the track in the non-compliant layout of EAC.
+	trackFile := ""
 
 	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+
 		match := reFile.FindStringSubmatch(s.Text())
 		if len(match) != 0 {
-			header = true
+			// Only the FILE lines before the first TRACK belong to the header.
+			header = len(sheet.Files) == 0
 			file = match[1]
 			continue
 		}
 
 		if header {
+			match = reCatalog.FindStringSubmatch(s.Text())
+			if len(match) != 0 {
+				sheet.Catalog = match[1]
+				continue
+			}
+			match = reCDTextFile.FindStringSubmatch(s.Text())
+			if len(match) != 0 {
+				sheet.CDTextFile = match[1]
+				continue
+			}
+
 			match = reTrack.FindStringSubmatch(s.Text())
 			if len(match) != 0 {
 				header = false
@@ -102,45 +200,60 @@ func New(cuesheet []byte) (Cuesheet, error) {
 			if sheet.Files == nil {
 				sheet.Files = make(map[string][]Track)
 			}
-			spec := Track{}
+			spec := Track{DataType: match[2]}
 			if spec.Tags == nil {
 				spec.Tags = make(map[string]string)
 			}
 			spec.Tags["TRACK"] = match[1]
 			sheet.Files[file] = append(sheet.Files[file], spec)
+			trackFile = file
 			continue
 		}
 
-		// From here we can safely assume that sheet.Files[file] is initialized.
-		trackPos := len(sheet.Files[file]) - 1
+		// From here we can safely assume that sheet.Files[trackFile] is initialized.
+		trackPos := len(sheet.Files[trackFile]) - 1
 
 		match = reIndex.FindStringSubmatch(s.Text())
 		if len(match) != 0 {
-			min, _ := strconv.Atoi(match[1])
-			sec, _ := strconv.Atoi(match[2])
-			frames, _ := strconv.Atoi(match[3])
-			msec := int(1000 * float64(frames) / 75)
-			sheet.Files[file][trackPos].Indices = append(sheet.Files[file][trackPos].Indices, Time{Min: min, Sec: sec, Msec: msec})
+			number, _ := strconv.Atoi(match[1])
+			index := Index{Number: number, Time: parseTime(match[2], match[3], match[4])}
+			if number == 1 && file != trackFile {
+				// The track starts in the new file: move it there.
+				track := sheet.Files[trackFile][trackPos]
+				track.PregapFile = trackFile
+				sheet.Files[trackFile] = sheet.Files[trackFile][:trackPos]
+				if len(sheet.Files[trackFile]) == 0 {
+					delete(sheet.Files, trackFile)
+				}
+				sheet.Files[file] = append(sheet.Files[file], track)
+				trackFile = file
+				trackPos = len(sheet.Files[file]) - 1
+			}
+			sheet.Files[trackFile][trackPos].Indices = append(sheet.Files[trackFile][trackPos].Indices, index)
 			continue
 		}
 
 		match = rePregap.FindStringSubmatch(s.Text())
 		if len(match) != 0 {
-			min, _ := strconv.Atoi(match[1])
-			sec, _ := strconv.Atoi(match[2])
-			frames, _ := strconv.Atoi(match[3])
-			msec := int(1000 * float64(frames) / 75)
-			sheet.Files[file][trackPos].Pregap = Time{Min: min, Sec: sec, Msec: msec}
+			sheet.Files[trackFile][trackPos].Pregap = parseTime(match[1], match[2], match[3])
 			continue
 		}
 
 		match = rePostgap.FindStringSubmatch(s.Text())
 		if len(match) != 0 {
-			min, _ := strconv.Atoi(match[1])
-			sec, _ := strconv.Atoi(match[2])
-			frames, _ := strconv.Atoi(match[3])
-			msec := int(1000 * float64(frames) / 75)
-			sheet.Files[file][trackPos].Postgap = Time{Min: min, Sec: sec, Msec: msec}
+			sheet.Files[trackFile][trackPos].Postgap = parseTime(match[1], match[2], match[3])
+			continue
+		}
+
+		match = reFlags.FindStringSubmatch(s.Text())
+		if len(match) != 0 {
+			sheet.Files[trackFile][trackPos].Flags = strings.Fields(match[1])
+			continue
+		}
+
+		match = reISRC.FindStringSubmatch(s.Text())
+		if len(match) != 0 {
+			sheet.Files[trackFile][trackPos].ISRC = match[1]
 			continue
 		}
 
@@ -148,12 +261,12 @@ func New(cuesheet []byte) (Cuesheet, error) {
 		match = reTag.FindStringSubmatch(s.Text())
 		if len(match) != 0 {
 			if len(match[2]) > 0 {
-				sheet.Files[file][trackPos].Tags[match[1]] = match[2]
+				sheet.Files[trackFile][trackPos].Tags[match[1]] = match[2]
 			}
 			continue
 		}
 
-		return Cuesheet{nil, nil}, errors.New("cannot parse " + s.Text())
+		return Cuesheet{}, errors.New("cannot parse " + s.Text())
 	}
 
 	return sheet, nil
@@ -4,7 +4,10 @@
 package cuesheet
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -49,7 +52,7 @@ func TestNew(t *testing.T) {
 			"Faithless - Live in Berlin (CD1).mp3": []Track{
 
 				Track{
-					Indices: []Time{{0, 0, 0}},
+					Indices: []Index{{1, Time{0, 0, 0}}},
 					Tags: map[string]string{
 						"TRACK":     "01",
 						"TITLE":     "Reverence",
@@ -58,7 +61,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{6, 40, 360}, {6, 42, 360}},
+					Indices: []Index{{0, Time{6, 40, 360}}, {1, Time{6, 42, 360}}},
 					Tags: map[string]string{
 						"TRACK":     "02",
 						"TITLE":     "She's My Baby",
@@ -67,7 +70,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{10, 54, 00}},
+					Indices: []Index{{1, Time{10, 54, 00}}},
 					Pregap:  Time{0, 2, 0},
 					Tags: map[string]string{
 						"TRACK":     "03",
@@ -77,7 +80,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{17, 04, 00}},
+					Indices: []Index{{1, Time{17, 04, 00}}},
 					Tags: map[string]string{
 						"TRACK":     "04",
 						"TITLE":     "Insomnia",
@@ -89,7 +92,7 @@ func TestNew(t *testing.T) {
 			"Faithless - Live in Berlin (CD2).mp3": []Track{
 
 				Track{
-					Indices: []Time{{25, 44, 00}},
+					Indices: []Index{{1, Time{25, 44, 00}}},
 					Tags: map[string]string{
 						"TRACK":     "05",
 						"TITLE":     "Bring the Family Back",
@@ -98,7 +101,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{30, 50, 00}},
+					Indices: []Index{{1, Time{30, 50, 00}}},
 					Tags: map[string]string{
 						"TRACK":     "06",
 						"TITLE":     "Salva Mea",
@@ -107,7 +110,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{38, 24, 00}},
+					Indices: []Index{{1, Time{38, 24, 00}}},
 					Tags: map[string]string{
 						"TRACK":     "07",
 						"TITLE":     "Dirty Old Man",
@@ -116,7 +119,7 @@ func TestNew(t *testing.T) {
 				},
 
 				Track{
-					Indices: []Time{{42, 35, 00}},
+					Indices: []Index{{1, Time{42, 35, 00}}},
 					Tags: map[string]string{
 						"TRACK":     "08",
 						"TITLE":     "God Is a DJ",
@@ -162,3 +165,154 @@ func TestNew(t *testing.T) {
 		}
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	buf, err := ioutil.ReadFile(SAMPLE_CUESHEET)
+	if err != nil {
+		panic(err)
+	}
+	sheet, err := New(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	out := sheet.Marshal()
+	for _, line := range []string{
+		`REM DATE 1998`,
+		`PERFORMER "Faithless (Album artist)"`,
+		`FILE "Faithless - Live in Berlin (CD2).mp3" MP3`,
+		`INDEX 00 06:40:27`,
+		`PREGAP 00:02:00`,
+	} {
+		if !bytes.Contains(out, []byte(line)) {
+			t.Errorf("Missing %q in:\n%s", line, out)
+		}
+	}
+	if i, j := bytes.Index(out, []byte("(CD1)")), bytes.Index(out, []byte("(CD2)")); i > j {
+		t.Error("Files are not sorted by track number")
+	}
+
+	got, err := New(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sheet) {
+		t.Errorf("Got %v, want %v", got, sheet)
+	}
+}
+
+func TestTimeString(t *testing.T) {
+	for frames := 0; frames < 75; frames++ {
+		time := Time{Min: 61, Sec: 2, Msec: int(1000 * float64(frames) / 75)}
+		want := fmt.Sprintf("61:02:%02d", frames)
+		if time.String() != want {
+			t.Errorf("Got %v, want %v", time, want)
+		}
+	}
+}
+
+func TestFullSpec(t *testing.T) {
+	in := `CATALOG 0724384260926
+CDTEXTFILE "album.cdt"
+TITLE "Album"
+
+FILE "album.wav" WAVE
+  TRACK 01 AUDIO
+    FLAGS DCP PRE
+    ISRC USRC17607839
+    SONGWRITER "Composer"
+    INDEX 00 00:00:00
+    INDEX 01 03:12:00
+    INDEX 02 04:00:10
+  TRACK 02 MODE1/2352
+    INDEX 01 10:00:00
+`
+	sheet, err := New([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sheet.Catalog != "0724384260926" || sheet.CDTextFile != "album.cdt" {
+		t.Errorf("Got catalog %q and CD-TEXT file %q", sheet.Catalog, sheet.CDTextFile)
+	}
+	if _, ok := sheet.Header["CATALOG"]; ok {
+		t.Error("CATALOG stored in header tags")
+	}
+
+	tracks := sheet.Files["album.wav"]
+	if len(tracks) != 2 {
+		t.Fatalf("Got %v tracks, want 2", len(tracks))
+	}
+	first := tracks[0]
+	if !reflect.DeepEqual(first.Flags, []string{FlagDCP, FlagPRE}) || first.ISRC != "USRC17607839" || first.Tags["SONGWRITER"] != "Composer" {
+		t.Errorf("Got flags %q, ISRC %q and tags %q", first.Flags, first.ISRC, first.Tags)
+	}
+	if start, ok := first.Index(0); !ok || start != (Time{}) {
+		t.Errorf("Got index 0 %v, want 00:00:00", start)
+	}
+	if first.Start() != (Time{3, 12, 0}) {
+		t.Errorf("Got start %v, want 03:12:00", first.Start())
+	}
+	if len(first.Indices) != 3 || first.Indices[2].Number != 2 {
+		t.Errorf("Got indices %+v", first.Indices)
+	}
+	if !first.IsAudio() || tracks[1].IsAudio() || tracks[1].DataType != "MODE1/2352" {
+		t.Errorf("Got data types %q and %q", first.DataType, tracks[1].DataType)
+	}
+
+	got, err := New(sheet.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sheet) {
+		t.Errorf("Got %+v, want %+v", got, sheet)
+	}
+}
+
+func TestNonCompliantLayout(t *testing.T) {
+	// The pregap of track 2 ends the file of track 1.
+	in := `TITLE "Album"
+FILE "01.wav" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second"
+    INDEX 00 04:10:00
+FILE "02.wav" WAVE
+    INDEX 01 00:00:00
+  TRACK 03 AUDIO
+    INDEX 00 03:00:00
+    INDEX 01 03:02:00
+`
+	sheet, err := New([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sheet.Header) != 1 || sheet.Header["TITLE"] != "Album" {
+		t.Errorf("Got header %q", sheet.Header)
+	}
+	if first := sheet.Files["01.wav"]; len(first) != 1 || first[0].Tags["TRACK"] != "01" {
+		t.Errorf("Got tracks %+v in the first file, want track 1", first)
+	}
+	tracks := sheet.Files["02.wav"]
+	if len(tracks) != 2 {
+		t.Fatalf("Got %v tracks in the second file, want 2", len(tracks))
+	}
+	second := tracks[0]
+	want := []Index{{Number: 0, Time: Time{4, 10, 0}}, {Number: 1}}
+	if second.Tags["TITLE"] != "Second" || second.PregapFile != "01.wav" || !reflect.DeepEqual(second.Indices, want) {
+		t.Errorf("Got track %+v, want indices %+v", second, want)
+	}
+	if _, ok := second.Index(0); ok {
+		t.Error("Got index 0 of the previous file")
+	}
+
+	got, err := New(sheet.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sheet) {
+		t.Errorf("Got %+v, want %+v", got, sheet)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package cuesheet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CD-TEXT tags are commands. The other tags are written as REM comments.
+var cdTextCommands = []string{"PERFORMER", "SONGWRITER", "TITLE"}
+
+// Marshal returns the cuesheet in the cue file format. See Write.
+func (sheet Cuesheet) Marshal() []byte {
+	var buf bytes.Buffer
+	// Writing to a bytes.Buffer cannot fail.
+	_ = sheet.Write(&buf)
+	return buf.Bytes()
+}
+
+// Write writes the cuesheet in the cue file format to 'w'. The result can be
+// read back with New.
+//
+// Files are sorted by the number of their first track. Tracks without a "TRACK"
+// tag are numbered after the previous track. Tracks without data type are
+// written as AUDIO. Times are rounded to the nearest frame.
+//
+// The cue format cannot escape double quotes: they are replaced by single
+// quotes.
+//
+// Tracks with a PregapFile are written in the non-compliant layout of EAC: the
+// FILE entry of the track comes after its pregap indices.
+func (sheet Cuesheet) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	writeTags(bw, "", sheet.Header)
+	if sheet.Catalog != "" {
+		fmt.Fprintf(bw, "CATALOG %s\n", sheet.Catalog)
+	}
+	if sheet.CDTextFile != "" {
+		fmt.Fprintf(bw, "CDTEXTFILE %s\n", quote(sheet.CDTextFile))
+	}
+
+	files := make([]string, 0, len(sheet.Files))
+	for file := range sheet.Files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := firstTrack(sheet.Files[files[i]]), firstTrack(sheet.Files[files[j]])
+		if a != b {
+			return a < b
+		}
+		return files[i] < files[j]
+	})
+
+	number := 0
+	for _, file := range files {
+		writeFile := func() {
+			// Tracks of the empty file have no FILE entry (non-standard).
+			if file != "" {
+				fmt.Fprintf(bw, "FILE %s %s\n", quote(file), fileType(file))
+			}
+		}
+		// The pregap of the first track may end the previous file.
+		pending := len(sheet.Files[file]) > 0 && sheet.Files[file][0].PregapFile != ""
+		if !pending {
+			writeFile()
+		}
+
+		for _, track := range sheet.Files[file] {
+			if n, err := strconv.Atoi(track.Tags["TRACK"]); err == nil {
+				number = n
+			} else {
+				number++
+			}
+			dataType := track.DataType
+			if dataType == "" {
+				dataType = Audio
+			}
+			fmt.Fprintf(bw, "  TRACK %02d %s\n", number, dataType)
+			if len(track.Flags) > 0 {
+				fmt.Fprintf(bw, "    FLAGS %s\n", strings.Join(track.Flags, " "))
+			}
+			if track.ISRC != "" {
+				fmt.Fprintf(bw, "    ISRC %s\n", track.ISRC)
+			}
+
+			tags := make(map[string]string, len(track.Tags))
+			for k, v := range track.Tags {
+				if k != "TRACK" {
+					tags[k] = v
+				}
+			}
+			writeTags(bw, "    ", tags)
+
+			if track.Pregap != (Time{}) {
+				fmt.Fprintf(bw, "    PREGAP %s\n", track.Pregap)
+			}
+			for _, index := range track.Indices {
+				if pending && index.Number >= 1 {
+					writeFile()
+					pending = false
+				}
+				fmt.Fprintf(bw, "    INDEX %02d %s\n", index.Number, index.Time)
+			}
+			if pending {
+				writeFile()
+				pending = false
+			}
+			if track.Postgap != (Time{}) {
+				fmt.Fprintf(bw, "    POSTGAP %s\n", track.Postgap)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// String returns the time in the 'mm:ss:ff' format.
+func (t Time) String() string {
+	frames := ((t.Min*60+t.Sec)*1000+t.Msec)*75 + 500
+	frames /= 1000
+	return fmt.Sprintf("%02d:%02d:%02d", frames/(75*60), frames/75%60, frames%75)
+}
+
+// writeTags writes the REM comments first, then the CD-TEXT commands.
+func writeTags(w io.Writer, indent string, tags map[string]string) {
+	isCommand := make(map[string]bool, len(cdTextCommands))
+	for _, k := range cdTextCommands {
+		isCommand[k] = true
+	}
+
+	rems := make([]string, 0, len(tags))
+	for k := range tags {
+		if !isCommand[k] {
+			rems = append(rems, k)
+		}
+	}
+	sort.Strings(rems)
+
+	for _, k := range rems {
+		if tags[k] == "" {
+			continue
+		}
+		value := tags[k]
+		if strings.ContainsAny(value, " \t\"") {
+			value = quote(value)
+		}
+		fmt.Fprintf(w, "%sREM %s %s\n", indent, k, value)
+	}
+
+	for _, k := range cdTextCommands {
+		value := tags[k]
+		if value == "" {
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", indent, k, quote(value))
+	}
+}
+
+func quote(s string) string {
+	return `"` + strings.Replace(s, `"`, `'`, -1) + `"`
+}
+
+// firstTrack returns the number of the first track, or 0 if unknown.
+func firstTrack(tracks []Track) int {
+	if len(tracks) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(tracks[0].Tags["TRACK"])
+	return n
+}
+
+// fileType guesses the type of the FILE entry from the file extension. WAVE is
+// the usual value for any audio that is neither MP3 nor AIFF.
+func fileType(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp3":
+		return "MP3"
+	case ".aif", ".aiff":
+		return "AIFF"
+	}
+	return "WAVE"
+}
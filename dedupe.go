@@ -0,0 +1,304 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Duplicate audio detection.
+//
+// All the input files are fingerprinted. Files of similar durations are
+// compared by the bit error rate of their fingerprints, so that the same
+// recording is found across encodings. Similar files are clustered and
+// reported. The 'dedupe' action, if any, chooses the copy to keep in every
+// cluster; the other copies that are similar to the kept copy are moved to the
+// trash folder when processing.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	actionDedupe = "dedupe"
+
+	stageDedupe    = "dedupe"
+	eventDuplicate = "duplicate"
+
+	// Files whose durations differ by more than this many seconds are not
+	// compared.
+	dedupeMaxDurationDiff = 5
+	// Maximum shift between two fingerprints, in fingerprint items (about 0.12
+	// second each), to compensate for encoder delays and leading silences.
+	dedupeMaxOffset = 16
+)
+
+// dedupeFile is a fingerprinted input file.
+type dedupeFile struct {
+	input       inputInfo
+	format      string
+	fingerprint []uint32
+	// In seconds.
+	duration int
+}
+
+// fingerprintSimilarity returns the ratio of identical bits of the
+// fingerprints 'a' and 'b' at their best alignment, from 0 to 1. Shifts
+// leaving less than half of the shortest fingerprint overlapping are ignored.
+func fingerprintSimilarity(a, b []uint32) float64 {
+	minOverlap := len(a)
+	if len(b) < minOverlap {
+		minOverlap = len(b)
+	}
+	minOverlap = (minOverlap + 1) / 2
+
+	best := 0.0
+	for offset := -dedupeMaxOffset; offset <= dedupeMaxOffset; offset++ {
+		// 'a[i]' is compared to 'b[i+offset]'.
+		start, end := 0, len(a)
+		if offset < 0 {
+			start = -offset
+		}
+		if len(b)-offset < end {
+			end = len(b) - offset
+		}
+		if end-start <= 0 || end-start < minOverlap {
+			continue
+		}
+
+		diff := 0
+		for i := start; i < end; i++ {
+			diff += bits.OnesCount32(a[i] ^ b[i+offset])
+		}
+		similarity := 1 - float64(diff)/float64(32*(end-start))
+		if similarity > best {
+			best = similarity
+		}
+	}
+	return best
+}
+
+// clusterDuplicates returns the clusters of 'files' whose fingerprints are
+// similar by at least 'threshold', directly or through other files. Clusters
+// of a single file are left out. Files are sorted by path in every cluster.
+func clusterDuplicates(files []*dedupeFile, threshold float64) [][]*dedupeFile {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].duration < files[j].duration
+	})
+
+	// Union-find.
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range files {
+		for j := i + 1; j < len(files) && files[j].duration-files[i].duration <= dedupeMaxDurationDiff; j++ {
+			if find(i) == find(j) {
+				continue
+			}
+			if fingerprintSimilarity(files[i].fingerprint, files[j].fingerprint) >= threshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	groups := map[int][]*dedupeFile{}
+	for i, f := range files {
+		groups[find(i)] = append(groups[find(i)], f)
+	}
+	var clusters [][]*dedupeFile
+	for _, cluster := range groups {
+		if len(cluster) < 2 {
+			continue
+		}
+		sort.Slice(cluster, func(i, j int) bool {
+			return cluster[i].input.path < cluster[j].input.path
+		})
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0].input.path < clusters[j][0].input.path
+	})
+	return clusters
+}
+
+// fingerprintFiles probes and fingerprints the files of 'roots' in parallel.
+// Multi-track files are skipped.
+func fingerprintFiles(roots []string) []*dedupeFile {
+	var paths []string
+	visited := map[string]bool{}
+	for _, root := range roots {
+		// 'visit' always keeps going, so no error.
+		_ = RealPathWalk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || visited[path] {
+				return nil
+			}
+			if options.Extensions[strings.ToLower(Ext(path))] && selection.Selected(path, info) {
+				visited[path] = true
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+
+	files := make([]*dedupeFile, len(paths))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < options.Cores; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fr := newFileRecord(paths[i])
+				err := prepareInput(fr, &fr.input)
+				if err != nil {
+					warning.Printf("%v: %v", paths[i], err)
+					continue
+				}
+				if fr.input.trackCount > 1 {
+					warning.Printf("%v: multi-track files are not supported, skipping", paths[i])
+					continue
+				}
+				prepareTrackTags(&fr.input, 0)
+
+				fingerprint, duration, err := fingerprintRaw(paths[i])
+				if err != nil {
+					warning.Printf("%v: %v", paths[i], err)
+					continue
+				}
+				files[i] = &dedupeFile{
+					input:       fr.input,
+					format:      fr.Format.FormatName,
+					fingerprint: fingerprint,
+					duration:    duration,
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	result := files[:0]
+	for _, f := range files {
+		if f != nil {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// Dedupe reports the duplicates found in 'roots'. When the 'dedupe' action
+// chooses the copy to keep, the other copies are moved to the trash folder if
+// 'apply' is true.
+func Dedupe(roots []string, apply bool) {
+	files := fingerprintFiles(roots)
+	log.Printf("Fingerprinted %v files", len(files))
+	clusters := clusterDuplicates(files, options.DedupeThreshold)
+
+	L := MakeSandbox(nil)
+	defer L.Close()
+	if code, ok := cache.actions[actionDedupe]; ok {
+		SandboxCompileAction(L, actionDedupe, code)
+	}
+
+	removed := 0
+	for _, cluster := range clusters {
+		keep := 0
+		if _, ok := cache.actions[actionDedupe]; ok {
+			inputs := make([]inputInfo, len(cluster))
+			for i, f := range cluster {
+				inputs[i] = f.input
+			}
+			var err error
+			keep, err = RunDedupeAction(L, actionDedupe, inputs)
+			if err != nil {
+				warning.Printf("Action %s: %s", actionDedupe, err)
+				keep = 0
+			}
+		}
+
+		reportDuplicates(cluster, keep)
+		if keep == 0 {
+			continue
+		}
+
+		kept := cluster[keep-1]
+		for i, f := range cluster {
+			if i+1 == keep {
+				continue
+			}
+			// Clusters are transitive: a copy may only be similar to the kept
+			// copy through other copies.
+			if fingerprintSimilarity(kept.fingerprint, f.fingerprint) < options.DedupeThreshold {
+				log.Printf("Keep %q: not similar enough to %q", f.input.path, kept.input.path)
+				continue
+			}
+			fr := newFileRecord(f.input.path)
+			if !apply {
+				log.Printf("Would move %q to the trash", f.input.path)
+				continue
+			}
+			trashed, err := trashFile(f.input.path, options.Trash)
+			if err != nil {
+				warning.Print(err)
+				emitEvent(fr, Event{Stage: stageDedupe, Type: eventFailed}, err)
+				continue
+			}
+			log.Printf("Move %q to %q", f.input.path, trashed)
+			removed++
+			journal.Record(fr, JournalEntry{Action: journalMove, Src: f.input.path, Dst: trashed})
+			emitEvent(fr, Event{Stage: stageDedupe, Type: eventSourceRemoved, Output: trashed}, nil)
+		}
+	}
+
+	log.Printf("Found %v duplicate clusters, moved %v files to the trash", len(clusters), removed)
+}
+
+// reportDuplicates prints 'cluster' to stdout, or emits one event per file if
+// events are enabled. 'keep' is the index of the kept copy, starting from 1, or
+// 0 if none.
+func reportDuplicates(cluster []*dedupeFile, keep int) {
+	if options.Events == eventsJSON {
+		for i, f := range cluster {
+			e := Event{Stage: stageDedupe, Type: eventDuplicate, Output: cluster[0].input.path}
+			if keep > 0 {
+				e.Output = cluster[keep-1].input.path
+			}
+			if i+1 == keep {
+				e.Status = "keep"
+			}
+			emitEvent(newFileRecord(f.input.path), e, nil)
+		}
+		return
+	}
+
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	fmt.Printf("=== %v copies\n", len(cluster))
+	for i, f := range cluster {
+		mark := "    "
+		if i+1 == keep {
+			mark = "keep"
+		}
+		similarity := 1.0
+		if i > 0 {
+			similarity = fingerprintSimilarity(cluster[0].fingerprint, f.fingerprint)
+		}
+		fmt.Printf("%v %-6v %4v kbps %4vs %.3f %v\n", mark, f.format, f.input.bitrate/1000, f.duration, similarity, f.input.path)
+	}
+	fmt.Println()
+}
@@ -1,21 +1,13 @@
 // Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
 // Use of this file is governed by the license that can be found in LICENSE.
 
-// TODO: Allow for embedding covers. Have a look at:
-// * mp4art (libmp4v2): mp4art --add cover.jpg track.m4a
-// * vorbiscomment (vorbis-tools)
-// * beets
-// * http://superuser.com/questions/169151/embed-album-art-in-ogg-through-command-line-in-linux
-// * ffmpeg -i in.mp3 -i in.jpg -map 0 -map 1 -c copy -metadata:s:v title="Album cover" -metadata:s:v comment="Cover (Front)" out.mp3
-// TODO: Allow for fetching lyrics?
 // TODO: GUI for manual tag editing?
-// TODO: Duplicate audio detection? This might be overkill.
-// TODO: Discogs support?
 
 package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -23,11 +15,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ambrevar/demlo/cuesheet"
 	"github.com/mgutz/ansi"
@@ -79,7 +74,9 @@ const (
 )
 
 var (
+	XDG_CACHE_HOME  = os.Getenv("XDG_CACHE_HOME")
 	XDG_CONFIG_HOME = os.Getenv("XDG_CONFIG_HOME")
+	XDG_DATA_HOME   = os.Getenv("XDG_DATA_HOME")
 	XDG_DATA_DIRS   = os.Getenv("XDG_DATA_DIRS")
 
 	config string
@@ -104,20 +101,65 @@ var (
 )
 
 type Options struct {
-	Color       bool
-	Cores       int
-	Debug       bool
-	Exist       string
-	Extensions  stringSetFlag
-	Getcover    bool
-	Gettags     bool
-	Index       string
-	IndexOutput string
-	PrintIndex  bool
-	Postscript  string
-	Prescript   string
-	Process     bool
-	Scripts     []string
+	AcoustIDKey        string
+	AcoustIDSubmit     bool
+	AcoustIDURL        string
+	AcoustIDUserKey    string
+	CacheSize          int
+	CacheTTL           int
+	Checkpoint         string
+	Color              bool
+	Cores              int
+	CoverArtArchiveURL string
+	Debug              bool
+	Dedupe             bool
+	DedupeAction       string
+	DedupeThreshold    float64
+	DiscogsToken       string
+	DiscogsURL         string
+	Events             string
+	Exclude            []string
+	Exist              string
+	Extensions         stringSetFlag
+	Filter             string
+	Gaps               string
+	Getcover           bool
+	Gettags            bool
+	Group              string
+	Index              string
+	IndexOutput        string
+	Include            []string
+	Interactive        bool
+	Journal            string
+	LRCLIBURL          string
+	Loudness           bool
+	Lyrics             bool
+	LyricsDir          string
+	LyricsProviders    []string
+	MatchRelation      float64
+	MatchThreshold     float64
+	MatchTolerance     string
+	MatchWeights       map[string]float64
+	MaxSize            string
+	MinSize            string
+	MusicBrainzURL     string
+	Newer              string
+	Older              string
+	OnlineMaxDelay     int
+	OnlineRates        map[string]float64
+	OnlineRetries      int
+	OnlineTimeout      int
+	PrintIndex         bool
+	Postscript         string
+	Prescript          string
+	Process            bool
+	Progress           bool
+	ProgressInterval   int
+	Providers          []string
+	Scripts            []string
+	Trash              string
+	Watch              bool
+	WatchDelay         int
 }
 
 // Identify visited cover files with {path,checksum} as map key.
@@ -217,6 +259,21 @@ func (s scriptRemoveFlag) Set(arg string) error {
 	return nil
 }
 
+// Append the arguments to a list.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, " ")
+}
+
+func (s *stringListFlag) Set(arg string) error {
+	*s = append(*s, arg)
+	return nil
+}
+
 type stringSetFlag map[string]bool // TODO: Factor this with the other flags?  Or rename?
 
 func (s *stringSetFlag) String() string {
@@ -251,6 +308,20 @@ type outputCover struct {
 	Parameters []string `lua:"parameters"`
 }
 
+// embedCover describes a picture to embed in the output file.
+// 'Source' is one of "external", "online" or "embedded". 'Name' is the basename
+// of the external cover. 'Index' is the index of the embedded cover as in Lua,
+// i.e. starting from 1.
+// 'Type' is "front" (default) or "back".
+type embedCover struct {
+	Source     string   `lua:"source"`
+	Name       string   `lua:"name"`
+	Index      int      `lua:"index"`
+	Type       string   `lua:"type"`
+	Format     string   `lua:"format"`
+	Parameters []string `lua:"parameters"`
+}
+
 // inputInfo is contains all the file's metadata passed to the scripts.
 // Format and Streams are set from FFprobe respective sections.
 // We do not export other fields: if FFprobe output changes, it could lead to
@@ -269,6 +340,11 @@ type inputInfo struct {
 	externalCovers map[string]inputCover `lua:"externalcovers"`
 	onlineCover    inputCover            `lua:"onlinecover"`
 
+	// Set if loudness analysis is enabled.
+	loudness *loudnessInfo `lua:"loudness"`
+	// Set if lyrics fetching is enabled and lyrics were found.
+	lyrics *lyricsInfo `lua:"lyrics"`
+
 	// Index of the first audio stream.
 	audioIndex int
 
@@ -294,8 +370,11 @@ type outputInfo struct {
 	EmbeddedCovers []outputCover          `lua:"embeddedcovers"`
 	ExternalCovers map[string]outputCover `lua:"externalcovers"`
 	OnlineCover    outputCover            `lua:"onlinecover"`
+	EmbedCovers    []embedCover           `lua:"embedcovers"`
 	Write          string                 `lua:"write"`
 	Removesource   bool                   `lua:"removesource"`
+	// Content of the sidecar LRC file written next to 'Path', if not empty.
+	LRC string `lua:"lrc"`
 }
 
 type outputStatus int
@@ -341,6 +420,17 @@ type FileRecord struct {
 	embeddedCoverCache [][]byte
 	onlineCoverCache   []byte
 
+	// Tags retrieved online for each track, used as default output tags.
+	defaultTags []map[string]string
+	// Set when the file could not be identified online.
+	unidentified bool
+
+	// Set by the producer when grouping by folder, and reset once the group is
+	// complete.
+	group *fileGroup
+	// Inputs of the group, exposed to the scripts as 'album'.
+	album []inputInfo
+
 	debug   *log.Logger
 	info    *log.Logger
 	plain   *log.Logger
@@ -537,10 +627,18 @@ func init() {
 	log.SetFlags(0)
 	log.SetPrefix(":: ")
 
+	if XDG_CACHE_HOME == "" {
+		XDG_CACHE_HOME = filepath.Join(os.Getenv("HOME"), ".cache")
+	}
+
 	if XDG_CONFIG_HOME == "" {
 		XDG_CONFIG_HOME = filepath.Join(os.Getenv("HOME"), ".config")
 	}
 
+	if XDG_DATA_HOME == "" {
+		XDG_DATA_HOME = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+
 	if XDG_DATA_DIRS == "" {
 		XDG_DATA_DIRS = "/usr/local/share/:/usr/share"
 	}
@@ -592,6 +690,73 @@ func main() {
 		}
 	}
 
+	if options.WatchDelay <= 0 {
+		options.WatchDelay = 5
+	}
+
+	if options.ProgressInterval <= 0 {
+		options.ProgressInterval = 60
+	}
+
+	if options.Gaps == "" {
+		options.Gaps = gapsPrepend
+	}
+
+	if options.Group == "" {
+		options.Group = groupNone
+	}
+
+	if options.DedupeThreshold <= 0 {
+		options.DedupeThreshold = 0.85
+	}
+	if options.MatchRelation <= 0 {
+		options.MatchRelation = 0.7
+	}
+	if options.MatchTolerance == "" {
+		options.MatchTolerance = toleranceFull
+	}
+	if options.MatchWeights == nil {
+		options.MatchWeights = map[string]float64{}
+	}
+	if options.OnlineRates == nil {
+		options.OnlineRates = map[string]float64{}
+	}
+	for k, v := range defaultOnlineRates {
+		if _, ok := options.OnlineRates[k]; !ok {
+			options.OnlineRates[k] = v
+		}
+	}
+	if len(options.Providers) == 0 {
+		options.Providers = []string{providerMusicBrainz}
+	}
+	if len(options.LyricsProviders) == 0 {
+		options.LyricsProviders = []string{lyricsProviderLocal, lyricsProviderLRCLIB}
+	}
+
+	if options.AcoustIDKey == "" {
+		options.AcoustIDKey = defaultAcoustIDKey
+	}
+	if options.AcoustIDURL == "" {
+		options.AcoustIDURL = defaultAcoustIDURL
+	}
+	if options.CoverArtArchiveURL == "" {
+		options.CoverArtArchiveURL = defaultCoverArtArchiveURL
+	}
+	if options.DiscogsURL == "" {
+		options.DiscogsURL = defaultDiscogsURL
+	}
+	if options.LRCLIBURL == "" {
+		options.LRCLIBURL = defaultLRCLIBURL
+	}
+	if options.MusicBrainzURL == "" {
+		options.MusicBrainzURL = defaultMusicBrainzURL
+	}
+	for k, v := range defaultMatchWeights {
+		if _, ok := options.MatchWeights[k]; !ok {
+			options.MatchWeights[k] = v
+		}
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %v [OPTIONS] FILES|FOLDERS\n\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, usage)
@@ -605,15 +770,52 @@ func main() {
 		onlineMessage = "\n    	(Not available since program 'fpcalc' is not installed.)"
 	}
 
+	flag.StringVar(&options.AcoustIDKey, "acoustid-key", options.AcoustIDKey, "API key of the AcoustID client.")
+	flag.BoolVar(&options.AcoustIDSubmit, "acoustid-submit", options.AcoustIDSubmit, `Submit the fingerprints of the processed files that could not be
+    	identified online to AcoustID, with their output tags.
+    	Requires 'AcoustIDUserKey' in the configuration.`)
+	flag.StringVar(&options.AcoustIDURL, "acoustid-url", options.AcoustIDURL, "Root URL of the AcoustID API.")
+	var cacheClear bool
+	flag.BoolVar(&cacheClear, "cache-clear", false, "Clear the cache of online queries before running.")
+	flag.IntVar(&options.CacheTTL, "cache-ttl", options.CacheTTL, `Keep the results of online queries on disk for N days.
+    	If 0, the results are only cached for the duration of the run.`)
+	flag.StringVar(&options.Checkpoint, "checkpoint", options.Checkpoint, `Record the processed files in the specified file so that an interrupted
+    	run can be resumed with '-resume'.
+    	Default: a file named after the input in $XDG_DATA_HOME/demlo/checkpoint.`)
 	flag.BoolVar(&options.Color, "color", options.Color, "Color output.")
 	flag.IntVar(&options.Cores, "cores", options.Cores, "Run N processes in parallel. If 0, use all online cores.")
+	flag.StringVar(&options.CoverArtArchiveURL, "coverartarchive-url", options.CoverArtArchiveURL, "Root URL of the Cover Art Archive server.")
 	flag.BoolVar(&options.Debug, "debug", false, "Enable debug messages.")
+	flag.BoolVar(&options.Dedupe, "dedupe", options.Dedupe, `Fingerprint all input files and report the copies of the same recordings,
+    	then exit. With '-dedupe-action' and '-p', move the copies that are not
+    	kept to the trash folder.`)
+	flag.StringVar(&options.DedupeAction, "dedupe-action", options.DedupeAction, `Specify action to choose the copy to keep among duplicates.`)
+	flag.Float64Var(&options.DedupeThreshold, "dedupe-threshold", options.DedupeThreshold, `Minimum similarity (from 0 to 1) of the fingerprints of duplicates.`)
+	flag.StringVar(&options.DiscogsURL, "discogs-url", options.DiscogsURL, "Root URL of the Discogs API.")
 	flag.Var(&options.Extensions, "ext", `Additional extensions to look for when a folder is browsed.
     	`)
+	flag.StringVar(&options.Events, "events", options.Events, `Print machine-readable events to stdout.
+    	Supported format: 'json' (one JSON object per line).
+    	The index is not printed to stdout then, use '-o' instead.`)
+	flag.Var((*stringListFlag)(&options.Exclude), "exclude", `Skip the files whose path matches the pattern. This option can be
+    	specified several times. See '-include' for the pattern syntax.`)
 	flag.StringVar(&options.Exist, "exist", options.Exist, `Specify action to run when the destination exists.
     	Warning: overwriting may result in undesired behaviour if destination is part of the input.`)
+	flag.StringVar(&options.Filter, "filter", options.Filter, `Only process the files for which the Lua expression is true. It is
+    	evaluated once the file has been probed, with 'input' and its tags 'i'.`)
+	var filesFrom string
+	flag.StringVar(&filesFrom, "files-from", "", `Read the input files and folders from the specified file, one per line
+    	or NUL-separated as printed by 'find -print0'. Use '-' for stdin.`)
+	flag.StringVar(&options.Gaps, "gaps", options.Gaps, `When splitting multi-track files, append the pregap of a track to the
+    	previous track, prepend it to the track or discard it.
+    	Supported values: 'append', 'prepend' and 'discard'.`)
 	flag.BoolVar(&options.Getcover, "c", options.Getcover, "Fetch cover from the Internet."+onlineMessage)
 	flag.BoolVar(&options.Gettags, "t", options.Gettags, "Fetch tags from the Internet."+onlineMessage)
+	flag.StringVar(&options.Group, "group", options.Group, `Group the files before running the scripts and expose the inputs of the
+    	group to the scripts in 'album'.
+    	Supported values: 'none', 'folder' (files of the same folder) and 'album'
+    	(files with the same album, album artist and date, across all folders).
+    	With 'album', the scripts are only run once all files have been analyzed.`)
 	var hFlag string = ""
 	flag.StringVar(&hFlag, "h", hFlag, `Show help for the specified script.`)
 	var printHelp bool
@@ -621,9 +823,48 @@ func main() {
 	flag.StringVar(&options.Index, "i", options.Index, `Use index file to set input and output metadata.
     	The index can be built using the non-formatted preview output.`)
 	flag.StringVar(&options.IndexOutput, "o", options.IndexOutput, `Write index to specified output file.  Append to file if it exists.`)
+	flag.Var((*stringListFlag)(&options.Include), "include", `Only process the files whose path matches the pattern. This option can be
+    	specified several times. A pattern is a glob matching consecutive
+    	components of the path, e.g. 'Podcasts' or '*.flac', or a regexp
+    	matching a part of the path if prefixed with 're:'.`)
+	flag.BoolVar(&options.Interactive, "interactive", options.Interactive, `When fetching tags or covers online, let the user choose the release of
+    	every album among the best candidates.`)
+	flag.StringVar(&options.Journal, "journal", options.Journal, `Record the changes made to the file system in the specified file.
+    	Default: a new file in $XDG_DATA_HOME/demlo/journal.`)
+	flag.BoolVar(&options.Loudness, "loudness", options.Loudness, `Analyze the loudness of the tracks and their albums (EBU R128).
+    	The result is available to scripts in 'input.loudness'.`)
+	flag.StringVar(&options.LRCLIBURL, "lrclib-url", options.LRCLIBURL, "Root URL of the LRCLIB server.")
+	flag.BoolVar(&options.Lyrics, "lyrics", options.Lyrics, `Fetch the lyrics of the tracks from the 'LyricsProviders'.
+    	The result is available to scripts in 'input.lyrics'.`)
+	flag.StringVar(&options.LyricsDir, "lyrics-dir", options.LyricsDir, `Folder of local lyrics, named after the artist and the title, e.g.
+    	'Artist - Title.lrc'.`)
+	flag.Float64Var(&options.MatchThreshold, "match-threshold", options.MatchThreshold, `Minimum score (from 0 to 1) of an online match. Albums scoring below are
+    	reported as unidentified and their tags are left untouched.`)
+	flag.StringVar(&options.MatchTolerance, "match-tolerance", options.MatchTolerance, `How a file can reuse the online release of a previous file of a similar
+    	album. From the strictest to the loosest: 'acoustid' (never, always
+    	fingerprint), 'full' (similar album, album artist and date), 'artist'
+    	(similar album and album artist), 'album' (similar album) and 'any'
+    	(any previous release).`)
+	flag.StringVar(&options.MaxSize, "max-size", options.MaxSize, `Skip the files bigger than the size, e.g. '500K', '1.5M' or '2G'.`)
+	flag.StringVar(&options.MinSize, "min-size", options.MinSize, `Skip the files smaller than the size.`)
+	flag.StringVar(&options.MusicBrainzURL, "musicbrainz-url", options.MusicBrainzURL, `Root URL of the MusicBrainz server. The web service is expected under
+    	'/ws/2'.`)
+	flag.StringVar(&options.Newer, "newer", options.Newer, `Only process the files modified after the date ('2006-01-02',
+    	'2006-01-02 15:04' or RFC 3339) or the duration before now, e.g. '36h',
+    	'7d' or '2w'.`)
+	flag.StringVar(&options.Older, "older", options.Older, `Only process the files modified before the date or the duration before
+    	now. See '-newer'.`)
+	flag.IntVar(&options.OnlineMaxDelay, "online-max-delay", options.OnlineMaxDelay, `Wait at most N seconds before retrying an online query, even if the
+    	server requests more. If 0, no limit.`)
+	flag.IntVar(&options.OnlineRetries, "online-retries", options.OnlineRetries, `Retry failed and throttled online queries N times, with an exponential
+    	backoff.`)
+	flag.IntVar(&options.OnlineTimeout, "online-timeout", options.OnlineTimeout, `Abort online queries after N seconds. If 0, never abort.`)
 	flag.StringVar(&options.Postscript, "post", options.Postscript, "Run Lua code after the other scripts.")
 	flag.StringVar(&options.Prescript, "pre", options.Prescript, "Run Lua code before the other scripts.")
 	flag.BoolVar(&options.Process, "p", options.Process, "Apply changes: set tags and format, move/copy result to destination file.")
+	flag.BoolVar(&options.Progress, "progress", options.Progress, `Display the number of processed files, the throughput and the estimated
+    	remaining time. On a terminal, a status line is refreshed every second.`)
+	flag.IntVar(&options.ProgressInterval, "progress-interval", options.ProgressInterval, `When stderr is not a terminal, print the progress every N seconds.`)
 
 	flag.Var(&scriptFiles, "s", `Add scripts to the chain. This option can be specified several times.
     	Scripts are run in lexicographical order.
@@ -635,6 +876,23 @@ func main() {
 	flag.Var(&rFlag, "r", `Remove scripts where the regex matches a part of the basename.
     	The empty string '' removes all scripts.`)
 
+	var resume bool
+	flag.BoolVar(&resume, "resume", false, `Skip the files processed by the interrupted run recorded in the
+    	checkpoint. Requires '-p'.`)
+
+	flag.StringVar(&options.Trash, "trash", options.Trash, `Folder where the removed sources, the overwritten files and the duplicates
+    	are moved. They can be restored with '-undo'.
+    	Default: $XDG_DATA_HOME/demlo/trash.`)
+
+	var undoFlag string
+	flag.StringVar(&undoFlag, "undo", "", `Revert the changes recorded in the specified journal, then exit.
+    	Only preview the changes unless '-p' is used.`)
+
+	flag.BoolVar(&options.Watch, "watch", options.Watch, `Keep running and process the files that are added to the folders
+    	passed as argument.`)
+	flag.IntVar(&options.WatchDelay, "watch-delay", options.WatchDelay, `In watch mode, wait until files have not been modified for N seconds
+    	before processing them.`)
+
 	var flagVersion = flag.Bool("v", false, "Print version and exit.")
 
 	flag.Parse()
@@ -669,7 +927,45 @@ func main() {
 		return
 	}
 
-	if flag.Arg(0) == "" {
+	if options.Trash == "" {
+		options.Trash = filepath.Join(XDG_DATA_HOME, application, "trash")
+	}
+
+	if undoFlag != "" {
+		err := Undo(undoFlag, options.Process)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !options.Process {
+			log.Printf("Preview mode, no change was reverted.  Use commandline option '-p' to revert the changes.")
+		}
+		return
+	}
+
+	inputs := flag.Args()
+	if filesFrom != "" {
+		f := os.Stdin
+		if filesFrom != "-" {
+			f, err = os.Open(filesFrom)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		paths, err := ReadFileList(f)
+		if err != nil {
+			log.Fatalf("%v: %v", filesFrom, err)
+		}
+		if f != os.Stdin {
+			f.Close()
+		}
+		inputs = append(inputs, paths...)
+	}
+
+	if len(inputs) == 0 {
+		if filesFrom != "" {
+			log.Printf("No input in %v", filesFrom)
+			return
+		}
 		flag.Usage()
 		return
 	}
@@ -691,9 +987,61 @@ func main() {
 		}
 	}
 
-	// Enable index output if stdout is redirected.
+	// Enable index output if stdout is redirected, unless it is used for events.
+	if options.Events != "" && options.Events != eventsJSON {
+		log.Fatalf("Unsupported events format: %q", options.Events)
+	}
+	selection, err = makeFileSelection(&options, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch options.Gaps {
+	case gapsAppend, gapsPrepend, gapsDiscard:
+	default:
+		log.Fatalf("Unsupported gap mode: %q", options.Gaps)
+	}
+	switch options.MatchTolerance {
+	case toleranceAcoustID, toleranceFull, toleranceArtist, toleranceAlbum, toleranceAny:
+	default:
+		log.Fatalf("Unsupported match tolerance: %q", options.MatchTolerance)
+	}
+	weightSum := 0.0
+	for k := range defaultMatchWeights {
+		weightSum += options.MatchWeights[k]
+	}
+	if weightSum <= 0 {
+		log.Fatal("The sum of the match weights must be positive")
+	}
+	for _, u := range []*string{&options.AcoustIDURL, &options.CoverArtArchiveURL, &options.DiscogsURL, &options.LRCLIBURL, &options.MusicBrainzURL} {
+		*u = strings.TrimSuffix(*u, "/")
+	}
+	if options.AcoustIDSubmit && options.AcoustIDUserKey == "" {
+		log.Fatal("AcoustID submissions require a user API key, see 'AcoustIDUserKey' in the configuration")
+	}
+	for _, name := range options.Providers {
+		if _, ok := providers[name]; !ok {
+			log.Fatalf("Unsupported provider: %q", name)
+		}
+		if name == providerDiscogs && options.DiscogsToken == "" {
+			log.Fatal("Discogs requires a personal access token, see 'DiscogsToken' in the configuration")
+		}
+	}
+	for _, name := range options.LyricsProviders {
+		if _, ok := lyricsProviders[name]; !ok {
+			log.Fatalf("Unsupported lyrics provider: %q", name)
+		}
+	}
+	switch options.Group {
+	case groupNone, groupFolder:
+	case groupAlbum:
+		if options.Watch {
+			log.Fatal("Grouping by album is not supported in watch mode")
+		}
+	default:
+		log.Fatalf("Unsupported grouping: %q", options.Group)
+	}
 	st, _ = os.Stdout.Stat()
-	if (st.Mode() & os.ModeCharDevice) == 0 {
+	if (st.Mode()&os.ModeCharDevice) == 0 && options.Events == "" {
 		previewOptions.printIndex = true
 	}
 	// Disable diff preview if stderr does not have a 'TerminalSize'.
@@ -731,39 +1079,157 @@ func main() {
 			cacheAction(actionExist, paths[0])
 		}
 	}
+	if options.Filter != "" {
+		// The filter is an expression.
+		cache.actions[actionFilter] = "return " + options.Filter
+	}
 	cacheIndex()
 
+	onlineDiskCache = NewDiskCache(filepath.Join(XDG_CACHE_HOME, application),
+		time.Duration(options.CacheTTL)*24*time.Hour,
+		int64(options.CacheSize)*1024*1024)
+	if cacheClear {
+		log.Printf("Clear cache: %v", filepath.Join(XDG_CACHE_HOME, application))
+		err := onlineDiskCache.Clear()
+		if err != nil {
+			warning.Print("cannot clear cache: ", err)
+		}
+	}
+
+	initOnlineClients()
+
 	// Limit number of cores to online cores.
 	if options.Cores > runtime.NumCPU() || options.Cores <= 0 {
 		options.Cores = runtime.NumCPU()
 	}
 
+	if options.Dedupe {
+		if fpcalcNotFound != nil {
+			log.Fatal("Program 'fpcalc' not installed, cannot detect duplicates")
+		}
+		if options.DedupeAction != "" {
+			paths, err := actionFiles.Select(options.DedupeAction)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(paths) != 1 {
+				log.Fatalf("Pattern %#v matches too many %#v actions: %v", options.DedupeAction, actionDedupe, paths)
+			}
+			cacheAction(actionDedupe, paths[0])
+		}
+		if options.Process {
+			openJournal()
+		}
+		Dedupe(inputs, options.Process)
+		journal.Close()
+		if !options.Process && options.DedupeAction != "" {
+			log.Printf("Preview mode, no file was moved.  Use commandline option '-p' to move the duplicates to the trash.")
+		}
+		return
+	}
+
 	// Pipeline.
 	// The log queue should be able to hold all routines at once.
-	p := NewPipeline(1, 1+options.Cores+options.Cores)
+	ctx, abort := context.WithCancel(context.Background())
+	defer abort()
+	p := NewPipeline(ctx, 1, 1+options.Cores+options.Cores)
+	handleInterrupts(p, abort)
 
 	p.Add(func() Stage { return &walker{} }, 1)
-	p.Add(func() Stage { return &analyzer{} }, options.Cores)
+	switch options.Group {
+	case groupFolder:
+		p.Add(func() Stage { return &preparer{} }, options.Cores)
+		p.AddGroup(setAlbum, false)
+		p.Add(func() Stage { return &analyzer{grouped: true} }, options.Cores)
+	case groupAlbum:
+		p.Add(func() Stage { return &preparer{} }, options.Cores)
+		p.AddGroup(groupByAlbum, true)
+		p.Add(func() Stage { return &analyzer{grouped: true} }, options.Cores)
+	default:
+		p.Add(func() Stage { return &analyzer{} }, options.Cores)
+	}
 
 	if options.Process {
+		openJournal()
+		openCheckpoint(inputs, resume)
 		p.Add(func() Stage { return &transformer{} }, options.Cores)
+	} else if resume {
+		warning.Print("'-resume' requires '-p', ignored")
+	}
+
+	if options.Progress && options.Interactive {
+		warning.Print("The progress cannot be displayed in interactive mode")
+	} else if options.Progress {
+		// The input is not known in advance in watch mode.
+		roots := inputs
+		if options.Watch {
+			roots = nil
+		}
+		progress.Start(os.Stderr, time.Duration(options.ProgressInterval)*time.Second, roots)
+		log.SetOutput(&progress)
+		warning.SetOutput(&progress)
+		logOutput = &progress
 	}
 
 	// Produce pipeline input. This should be run in parallel to pipeline
 	// consumption.
 	go func() {
-		for _, file := range flag.Args() {
+		feedGroup := func(paths []string) {
+			g := &fileGroup{size: len(paths)}
+			for _, path := range paths {
+				fr := newFileRecord(path)
+				fr.group = g
+				p.Feed(fr)
+			}
+		}
+		// Consecutive input files of the same folder, e.g. listed with
+		// '-files-from', are grouped together.
+		var files []string
+		for _, file := range inputs {
+			if p.Stopped() {
+				break
+			}
+			if options.Group == groupFolder {
+				st, err := os.Stat(file)
+				regular := err == nil && st.Mode().IsRegular()
+				if len(files) > 0 && (!regular || filepath.Dir(files[0]) != filepath.Dir(file)) {
+					feedGroup(files)
+					files = nil
+				}
+				if regular {
+					files = append(files, file)
+					continue
+				}
+				walkGroups(file, feedGroup)
+				continue
+			}
 			visit := func(path string, info os.FileInfo, err error) error {
 				if err != nil || !info.Mode().IsRegular() {
 					return nil
 				}
-				p.input <- newFileRecord(path)
+				if !p.Feed(newFileRecord(path)) {
+					return errStopped
+				}
 				return nil
 			}
-			// 'visit' always keeps going, so no error.
+			// 'visit' keeps going until the pipeline is stopped.
 			_ = RealPathWalk(file, visit)
 		}
-		close(p.input)
+		if len(files) > 0 && !p.Stopped() {
+			feedGroup(files)
+		}
+		if options.Watch && !p.Stopped() {
+			log.Printf("Watch: %v", strings.Join(inputs, " "))
+			err := Watch(inputs, time.Duration(options.WatchDelay)*time.Second, func(path string) {
+				// Our own output would loop through the pipeline.
+				if wroteFile(path) {
+					return
+				}
+				p.Feed(newFileRecord(path))
+			})
+			warning.Print("watch: ", err)
+		}
+		p.CloseInput()
 	}()
 
 	// Consume pipeline output.
@@ -771,7 +1237,82 @@ func main() {
 		p.log <- fr
 	}
 	p.Close()
+	progress.Stop()
+	journal.Close()
+	if p.Stopped() {
+		checkpoint.Close()
+		if options.Process {
+			log.Printf("Interrupted.  Use commandline option '-resume' to skip the processed files on the next run.")
+		}
+	} else if err := checkpoint.Remove(); err != nil {
+		warning.Print("cannot remove checkpoint: ", err)
+	}
+	if options.Gettags || options.Getcover {
+		err := onlineDiskCache.Prune()
+		if err != nil {
+			warning.Print("cannot prune cache: ", err)
+		}
+	}
 	if !options.Process {
 		log.Printf("Preview mode, no file was processed.  Use commandline option '-p' to apply the changes.")
 	}
+
+	report.Print()
+	if code := report.ExitCode(); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// openJournal opens the journal of the run, by default a new file in the data
+// folder.
+func openJournal() {
+	if options.Journal == "" {
+		options.Journal = filepath.Join(XDG_DATA_HOME, application, "journal", time.Now().Format("2006-01-02_15-04-05")+".json")
+		err := os.MkdirAll(filepath.Dir(options.Journal), 0777)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var err error
+	journal, err = OpenJournal(options.Journal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Journal: %v", options.Journal)
+}
+
+// openCheckpoint opens the checkpoint of the run, by default in the data folder
+// and named after the 'inputs'. If 'resume' is true, the files processed by the
+// interrupted run are skipped.
+func openCheckpoint(inputs []string, resume bool) {
+	if options.Checkpoint == "" {
+		options.Checkpoint = filepath.Join(XDG_DATA_HOME, application, "checkpoint", checkpointName(inputs))
+		err := os.MkdirAll(filepath.Dir(options.Checkpoint), 0777)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var err error
+	checkpoint, err = OpenCheckpoint(options.Checkpoint, resume)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resume {
+		log.Printf("Resume from checkpoint: %v", options.Checkpoint)
+	}
+}
+
+// handleInterrupts stops 'p' on the first interrupt: the files in progress are
+// processed and the others are skipped. The second interrupt calls 'abort'.
+func handleInterrupts(p *Pipeline, abort context.CancelFunc) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Print("Interrupted, finishing the files in progress.  Interrupt again to abort them.")
+		p.Stop()
+		<-c
+		log.Print("Aborting")
+		abort()
+	}()
 }
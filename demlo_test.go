@@ -4,9 +4,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ambrevar/demlo/acoustid"
 	"github.com/ambrevar/demlo/cuesheet"
 )
 
@@ -43,7 +58,7 @@ func TestFixPunctuation(t *testing.T) {
 	}
 	defer L.Close()
 
-	err = RunScript(L, "punctuation", &input, &output)
+	err = RunScript(L, "punctuation", &input, &output, nil)
 	if err != nil {
 		t.Fatalf("script punctuation: %s", err)
 	}
@@ -93,7 +108,7 @@ func TestTitleCase(t *testing.T) {
 	}
 	defer L.Close()
 
-	err = RunScript(L, "case", &input, &output)
+	err = RunScript(L, "case", &input, &output, nil)
 	if err != nil {
 		t.Fatalf("script case: %s", err)
 	}
@@ -137,7 +152,7 @@ func TestSentenceCase(t *testing.T) {
 	L.PushBoolean(true)
 	L.SetGlobal("scase")
 
-	err = RunScript(L, "case", &input, &output)
+	err = RunScript(L, "case", &input, &output, nil)
 	if err != nil {
 		t.Fatalf("script case: %s", err)
 	}
@@ -205,16 +220,22 @@ func TestFFmpegSplitTimes(t *testing.T) {
 	// We need to make up last track's duration: 3 minutes.
 	totaltime := float64(17*60 + 4 + 3*60)
 
+	// Track 1 has a pregap from 06:40:27 to 06:42:27.
 	want := []struct {
+		gaps     string
 		track    int
 		start    string
 		duration string
 	}{
-		{track: 0, start: "00:00:00.000", duration: "00:06:40.360"},
-		{track: 1, start: "00:06:40.360", duration: "00:04:13.640"},
-		{track: 3, start: "00:17:04.000", duration: "00:03:00.000"},
-		{track: 4, start: "", duration: ""},
-		{track: 8, start: "", duration: ""},
+		{gaps: gapsPrepend, track: 0, start: "00:00:00.000", duration: "00:06:40.360"},
+		{gaps: gapsPrepend, track: 1, start: "00:06:40.360", duration: "00:04:13.640"},
+		{gaps: gapsPrepend, track: 3, start: "00:17:04.000", duration: "00:03:00.000"},
+		{gaps: gapsPrepend, track: 4, start: "", duration: ""},
+		{gaps: gapsPrepend, track: 8, start: "", duration: ""},
+		{gaps: gapsAppend, track: 0, start: "00:00:00.000", duration: "00:06:42.360"},
+		{gaps: gapsAppend, track: 1, start: "00:06:42.360", duration: "00:04:11.640"},
+		{gaps: gapsDiscard, track: 0, start: "00:00:00.000", duration: "00:06:40.360"},
+		{gaps: gapsDiscard, track: 1, start: "00:06:42.360", duration: "00:04:11.640"},
 	}
 
 	buf, err := ioutil.ReadFile(sampleCuesheet)
@@ -227,9 +248,1257 @@ func TestFFmpegSplitTimes(t *testing.T) {
 	}
 
 	for _, v := range want {
-		start, duration := ffmpegSplitTimes(sheet, "Faithless - Live in Berlin (CD1).mp3", v.track, totaltime)
+		start, duration := ffmpegSplitTimes(sheet, "Faithless - Live in Berlin (CD1).mp3", v.track, totaltime, v.gaps)
 		if start != v.start || duration != v.duration {
-			t.Errorf("Got {start: %v, duration: %v}, want {start: %v, duration: %v}", start, duration, v.start, v.duration)
+			t.Errorf("Got {start: %v, duration: %v}, want {start: %v, duration: %v} (%v)", start, duration, v.start, v.duration, v.gaps)
 		}
 	}
 }
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := Tags{
+		album:       "Album",
+		albumartist: "Artist",
+		date:        "2001",
+		recordings: map[RecordingID]Recording{
+			"rec": {artist: "Artist", duration: 180, title: "Title", track: "2", disc: 1, position: 2,
+				trackTotal: 10, mbid: "rec", artistMBID: "art", isrc: "USABC0100001"},
+		},
+		mbid:            "rel",
+		albumartistMBID: "art",
+		barcode:         "0123",
+		catalogNumber:   "CAT-1",
+		country:         "XE",
+		discTotal:       2,
+		genre:           "rock; pop",
+		label:           "Label",
+		originalDate:    "1999",
+	}
+
+	c := NewDiskCache(dir, time.Hour, 0)
+	if err := c.PutJSON(diskCacheTags, "rel", want); err != nil {
+		t.Fatal(err)
+	}
+	var got Tags
+	if !c.GetJSON(diskCacheTags, "rel", &got) {
+		t.Fatal("Cache miss")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	if c.GetJSON(diskCacheTags, "other", &got) {
+		t.Error("Got hit for a missing key")
+	}
+
+	var disabled DiskCache
+	disabled.PutJSON(diskCacheTags, "rel", want)
+	if disabled.GetJSON(diskCacheTags, "rel", &got) {
+		t.Error("Got hit from the disabled cache")
+	}
+}
+
+func TestJournalUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"copied.flac", "copy.flac", "moved.flac", "transcoded.ogg"} {
+		if err := ioutil.WriteFile(path(name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := OpenJournal(path("journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := newFileRecord(path("src.flac"))
+	for _, e := range []JournalEntry{
+		{Action: journalCreate, Src: path("copied.flac"), Dst: path("copy.flac")},
+		{Action: journalMove, Src: path("src.flac"), Dst: path("moved.flac")},
+		// Transcoded, then the source was removed.
+		{Action: journalCreate, Src: path("removed.flac"), Dst: path("transcoded.ogg")},
+		{Action: journalRemove, Src: path("removed.flac")},
+	} {
+		j.Record(fr, e)
+	}
+	j.Close()
+
+	if err := Undo(path("journal"), false); err == nil {
+		t.Error("Removed source reported as restored")
+	}
+	if _, err := os.Stat(path("copy.flac")); err != nil {
+		t.Errorf("Preview changed the files: %v", err)
+	}
+
+	Undo(path("journal"), true)
+	for name, exists := range map[string]bool{
+		"copied.flac":    true,
+		"copy.flac":      false,
+		"moved.flac":     false,
+		"src.flac":       true,
+		"transcoded.ogg": true,
+	} {
+		if _, err := os.Stat(path(name)); (err == nil) != exists {
+			t.Errorf("%v: got exists %v, want %v", name, err == nil, exists)
+		}
+	}
+}
+
+func TestParseLoudnessSummary(t *testing.T) {
+	out := `[Parsed_ebur128_0 @ 0x55d0c2a0] t: 0.4  TARGET:-23 LUFS    M: -30.1 S:-120.7     I: -30.1 LUFS       LRA:   0.0 LU  FTPK: -9.8 dBFS  TPK: -9.8 dBFS
+[Parsed_ebur128_0 @ 0x55d0c2a0] Summary:
+
+  Integrated loudness:
+    I:         -16.4 LUFS
+    Threshold: -26.7 LUFS
+
+  Loudness range:
+    LRA:         6.3 LU
+    Threshold:  -36.7 LUFS
+    LRA low:    -21.2 LUFS
+    LRA high:   -14.9 LUFS
+
+  True peak:
+    Peak:        0.0 dBFS
+`
+	l, err := parseLoudnessSummary(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.integrated != -16.4 || l.lra != 6.3 || l.peak != 1 {
+		t.Errorf("Got %+v, want {integrated: -16.4, lra: 6.3, peak: 1}", l)
+	}
+
+	_, err = parseLoudnessSummary("Summary:\n  Integrated loudness:\n")
+	if err == nil {
+		t.Error("Got no error for truncated summary")
+	}
+}
+
+func TestWalkGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a/1.flac", "a/b/1.flac", "a/b/2.flac", "a/2.flac", "c/1.flac"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got [][]string
+	walkGroups(dir, func(paths []string) {
+		var group []string
+		for _, path := range paths {
+			rel, _ := filepath.Rel(dir, path)
+			group = append(group, filepath.ToSlash(rel))
+		}
+		got = append(got, group)
+	})
+	want := [][]string{{"a/b/1.flac", "a/b/2.flac"}, {"a/1.flac", "a/2.flac"}, {"c/1.flac"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestFileGroup(t *testing.T) {
+	g := &fileGroup{size: 3}
+	a, b := &FileRecord{}, &FileRecord{}
+	if g.add(a) != nil || g.add(nil) != nil {
+		t.Fatal("Group released before completion")
+	}
+	if got := g.add(b); !reflect.DeepEqual(got, []*FileRecord{a, b}) {
+		t.Errorf("Got %v, want the 2 remaining records", got)
+	}
+}
+
+func TestMatchDisc(t *testing.T) {
+	// Segment i+1 is found at position i+1 of disc 2 of release "a", and on a
+	// compilation "b" at another position.
+	segment := func(position int) acoustid.Meta {
+		return acoustid.Meta{Results: []acoustid.Result{{Score: 0.9, Recordings: []acoustid.Recording{{
+			Releases: []acoustid.Release{
+				{ID: "a", Mediums: []acoustid.Medium{{Position: 2, Track_count: 3, Tracks: []acoustid.Track{{Position: position}}}}},
+				{ID: "b", Mediums: []acoustid.Medium{{Position: 1, Track_count: 20, Tracks: []acoustid.Track{{Position: position + 10}}}}},
+			},
+		}}}}}
+	}
+
+	got, err := matchDisc([]acoustid.Meta{segment(1), segment(2), segment(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].releaseID != "a" || got[0].disc != 2 || got[0].score != 0.9 {
+		t.Errorf("Got %+v, want disc 2 of release a with score 0.9", got)
+	}
+
+	_, err = matchDisc([]acoustid.Meta{segment(1), {}, {}, {}})
+	if err != errUnidentAlbum {
+		t.Errorf("Got error %v, want %v", err, errUnidentAlbum)
+	}
+}
+
+func TestSegmentDurations(t *testing.T) {
+	sheet, err := cuesheet.New([]byte(`FILE "a.bin" BINARY
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 MODE1/2352
+    INDEX 01 01:00:00
+  TRACK 03 AUDIO
+    INDEX 01 02:00:00
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &FileRecord{}
+	fr.input = inputInfo{cuesheet: sheet, cuesheetFile: "a.bin", trackCount: 3}
+	fr.Format.Duration = "150"
+
+	if got, want := audioTracks(&fr.input), []int{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got audio tracks %v, want %v", got, want)
+	}
+	if got, want := segmentDurations(fr), []int{60000, 30000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got durations %v, want %v", got, want)
+	}
+}
+
+func TestMatchMedium(t *testing.T) {
+	tags := &Tags{recordings: map[RecordingID]Recording{
+		"1-1": {title: "A", disc: 1, position: 1, duration: 200000},
+		"1-2": {title: "B", disc: 1, position: 2, duration: 300000},
+		"2-1": {title: "C", disc: 2, position: 1, duration: 100000},
+		"2-2": {title: "D", disc: 2, position: 2, duration: 0},
+		"3-1": {title: "E", disc: 3, position: 1, duration: 100000},
+	}}
+
+	recordings, err := matchMedium(tags, []int{101000, 250000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 2 || recordings[0].title != "C" || recordings[1].title != "D" {
+		t.Errorf("Got %v, want disc 2", recordings)
+	}
+
+	_, err = matchMedium(tags, []int{150000, 250000}, 1)
+	if err != errDiscMismatch {
+		t.Errorf("Got error %v, want %v", err, errDiscMismatch)
+	}
+}
+
+func TestPromptRelease(t *testing.T) {
+	input := &inputInfo{path: "a.flac", tags: map[string]string{"album": "Album"}}
+	candidates := []releaseCandidate{
+		{releaseID: "r1", recordingID: "t1", details: "Title 1"},
+		{releaseID: "r2", recordingID: "t2"},
+	}
+
+	want := []struct {
+		answer      string
+		releaseID   ReleaseID
+		recordingID RecordingID
+		err         error
+	}{
+		{answer: "\n", releaseID: "r1", recordingID: "t1"},
+		{answer: "", releaseID: "r1", recordingID: "t1"},
+		{answer: "3\n2\n", releaseID: "r2", recordingID: "t2"},
+		{answer: "s\n", err: errReleaseSkipped},
+		{answer: "https://musicbrainz.org/release/76df3287-6cda-33eb-8e9a-044b5e15ffdd\n", releaseID: "76df3287-6cda-33eb-8e9a-044b5e15ffdd"},
+		{answer: "76DF3287-6CDA-33EB-8E9A-044B5E15FFDD\n", releaseID: "76df3287-6cda-33eb-8e9a-044b5e15ffdd"},
+	}
+
+	for _, v := range want {
+		var out bytes.Buffer
+		releaseID, recordingID, err := promptRelease(strings.NewReader(v.answer), &out, input, candidates)
+		if releaseID != v.releaseID || recordingID != v.recordingID || err != v.err {
+			t.Errorf("Got (%q, %q, %v), want (%q, %q, %v) for answer %q", releaseID, recordingID, err, v.releaseID, v.recordingID, v.err, v.answer)
+		}
+	}
+
+	_, _, err := promptRelease(strings.NewReader(""), ioutil.Discard, input, nil)
+	if err != errReleaseSkipped {
+		t.Errorf("Got %v, want %v without candidates", err, errReleaseSkipped)
+	}
+}
+
+func TestBestRelease(t *testing.T) {
+	defer func(o Options) { options = o }(options)
+	candidates := []releaseCandidate{{releaseID: "a", recordingID: "r", score: 0.6}, {releaseID: "b", score: 0.5}}
+
+	options.MatchThreshold = 0.5
+	if releaseID, recordingID, err := bestRelease(candidates); err != nil || releaseID != "a" || recordingID != "r" {
+		t.Errorf("Got %q, %q (%v), want release %q", releaseID, recordingID, err, "a")
+	}
+	options.MatchThreshold = 0.7
+	if _, _, err := bestRelease(candidates); err != errUnidentAlbum {
+		t.Errorf("Got error %v, want %v", err, errUnidentAlbum)
+	}
+	options.MatchThreshold = 0
+	if _, _, err := bestRelease(nil); err != errUnidentAlbum {
+		t.Errorf("Got error %v, want %v", err, errUnidentAlbum)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	defer func(o Options) { options = o }(options)
+	options.MatchRelation = 0.7
+
+	cached := AlbumKey{album: "the album", albumartist: "the artist", date: "2000"}
+	c := ReleaseIDCache{v: map[AlbumKey]*releaseIDEntry{cached: {releaseID: "r1"}}}
+
+	want := []struct {
+		tolerance string
+		key       AlbumKey
+		match     bool
+	}{
+		{toleranceFull, AlbumKey{album: "the album", albumartist: "the artist", date: "1990"}, false},
+		{toleranceFull, AlbumKey{album: "the albums", albumartist: "the artist", date: "2000"}, true},
+		{toleranceArtist, AlbumKey{album: "the album", albumartist: "the artist", date: "1990"}, true},
+		{toleranceArtist, AlbumKey{album: "the album", albumartist: "someone else", date: "2000"}, false},
+		{toleranceAlbum, AlbumKey{album: "the album", albumartist: "someone else", date: "1990"}, true},
+		{toleranceAlbum, AlbumKey{album: "another record"}, false},
+		{toleranceAny, AlbumKey{album: "another record"}, true},
+	}
+
+	for _, v := range want {
+		options.MatchTolerance = v.tolerance
+		e, _ := c.fuzzyMatch(v.key)
+		if (e != nil) != v.match {
+			t.Errorf("Got match %v, want %v for %+v with tolerance %q", e != nil, v.match, v.key, v.tolerance)
+		}
+	}
+}
+
+func TestProviderOf(t *testing.T) {
+	want := []struct {
+		releaseID ReleaseID
+		provider  string
+		id        string
+	}{
+		{"76df3287-6cda-33eb-8e9a-044b5e15ffdd", providerMusicBrainz, "76df3287-6cda-33eb-8e9a-044b5e15ffdd"},
+		{makeReleaseID(providerDiscogs, "1234"), providerDiscogs, "1234"},
+	}
+	for _, v := range want {
+		p, id, err := providerOf(v.releaseID)
+		if err != nil || p.Name() != v.provider || id != v.id {
+			t.Errorf("Got (%v, %q, %v), want (%v, %q) for %q", p, id, err, v.provider, v.id, v.releaseID)
+		}
+	}
+
+	if _, _, err := providerOf("foo:1234"); err == nil {
+		t.Error("Got no error for unknown provider")
+	}
+}
+
+func TestMakeDiscogsTags(t *testing.T) {
+	const release = `{
+	"title": "Album",
+	"year": 1999,
+	"artists": [{"name": "Artist (2)", "anv": ""}],
+	"tracklist": [
+		{"position": "", "type_": "heading", "title": "Side A"},
+		{"position": "A1", "type_": "track", "title": "One", "duration": "4:05"},
+		{"position": "A2", "type_": "track", "title": "Two", "duration": "",
+			"artists": [{"name": "Guest", "anv": "The Guest"}]},
+		{"position": "2-1", "type_": "track", "title": "Three", "duration": "1:02:03"}
+	]
+}`
+
+	var r discogsRelease
+	if err := json.Unmarshal([]byte(release), &r); err != nil {
+		t.Fatal(err)
+	}
+	tags := makeDiscogsTags(r)
+
+	if tags.album != "Album" || tags.albumartist != "Artist" || tags.date != "1999" {
+		t.Errorf("Got album (%q, %q, %q), want (%q, %q, %q)", tags.album, tags.albumartist, tags.date, "Album", "Artist", "1999")
+	}
+	want := map[RecordingID]Recording{
+		"1": {artist: "Artist", duration: 245000, title: "One", track: "1", disc: 1, position: 1, trackTotal: 2},
+		"2": {artist: "The Guest", title: "Two", track: "2", disc: 1, position: 2, trackTotal: 2},
+		"3": {artist: "Artist", duration: 3723000, title: "Three", track: "1", disc: 2, position: 1, trackTotal: 1},
+	}
+	if !reflect.DeepEqual(tags.recordings, want) {
+		t.Errorf("Got %+v, want %+v", tags.recordings, want)
+	}
+	if tags.discTotal != 2 {
+		t.Errorf("Got %v discs, want 2", tags.discTotal)
+	}
+}
+
+// TestOnlineServices queries stub servers through the endpoint options.
+func TestOnlineServices(t *testing.T) {
+	defer func(o Options) { options = o }(options)
+
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 2, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/acoustid/lookup", func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(zr)
+		form, _ := url.ParseQuery(string(buf))
+		if form.Get("client") != "key" || form.Get("fingerprint") != "AQAA" || form.Get("duration") != "200" {
+			t.Errorf("Unexpected AcoustID query %q", buf)
+		}
+		w.Write([]byte(`{"status": "ok", "results": [{"score": 0.9, "id": "a1", "recordings": [{
+			"id": "rec1", "title": "Title", "duration": 200, "artists": [{"name": "Artist"}],
+			"releases": [{"id": "rel1", "title": "Album", "artists": [{"name": "Artist"}], "date": {"year": 2000}}]}]}]}`))
+	})
+	mux.HandleFunc("/mb/ws/2/release/rel1", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("fmt") != "json" || r.Header.Get("User-Agent") != userAgent {
+			t.Errorf("Unexpected MusicBrainz query %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"id": "rel1", "title": "Album", "date": "2000-05-01", "country": "GB", "barcode": "0123",
+			"artist-credit": [{"artist": {"id": "art1", "name": "Artist"}}],
+			"label-info": [{"catalog-number": "CAT 1", "label": {"name": "Label"}}],
+			"release-group": {"first-release-date": "1999-12", "genres": [{"name": "rock", "count": 1}, {"name": "pop", "count": 3}]},
+			"media": [{"position": 1, "track-count": 1, "tracks": [{"number": "1", "position": 1, "length": 201000,
+				"recording": {"id": "rec1", "title": "Title", "isrcs": ["GBAAA0000001"], "artist-credit": [{"artist": {"id": "art2", "name": "Artist"}}]}}]}]}`))
+	})
+	mux.HandleFunc("/caa/release/rel1/front", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(picture.Bytes())
+	})
+	mux.HandleFunc("/discogs/database/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Discogs token=token" || r.FormValue("release_title") != "Album" {
+			t.Errorf("Unexpected Discogs search %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"results": [{"id": 7, "title": "Other - Record", "year": "1990"}, {"id": 42, "title": "Artist - Album", "year": "2000"}]}`))
+	})
+	mux.HandleFunc("/discogs/releases/42", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"title": "Album", "year": 2000, "artists": [{"name": "Artist"}], "tracklist": [{"position": "1", "title": "Title"}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	options.AcoustIDKey = "key"
+	options.AcoustIDURL = server.URL + "/acoustid"
+	options.CoverArtArchiveURL = server.URL + "/caa"
+	options.DiscogsToken = "token"
+	options.DiscogsURL = server.URL + "/discogs"
+	options.MusicBrainzURL = server.URL + "/mb"
+	options.MatchWeights = defaultMatchWeights
+
+	fr := newFileRecord("track.flac")
+	fr.input.tags = map[string]string{"album": "Album", "album_artist": "Artist", "date": "2000", "title": "Title", "artist": "Artist"}
+
+	candidates, err := musicBrainzProvider{}.LookupFingerprint(fr, &trackFingerprint{value: "AQAA", duration: 200, done: true})
+	if err != nil || len(candidates) != 1 || candidates[0].releaseID != "rel1" || candidates[0].recordingID != "rec1" {
+		t.Errorf("Got AcoustID candidates %+v (%v), want release %q", candidates, err, "rel1")
+	}
+
+	tags, err := musicBrainzProvider{}.Release("rel1")
+	want := Recording{artist: "Artist", duration: 201000, title: "Title", track: "1", disc: 1, position: 1,
+		trackTotal: 1, mbid: "rec1", artistMBID: "art2", isrc: "GBAAA0000001"}
+	if err != nil || tags.album != "Album" || tags.albumartist != "Artist" || tags.date != "2000" || tags.recordings["rec1"] != want {
+		t.Errorf("Got MusicBrainz tags %+v (%v), want recording %+v", tags, err, want)
+	}
+	wantTags := map[string]string{
+		"album":                     "Album",
+		"album_artist":              "Artist",
+		"artist":                    "Artist",
+		"barcode":                   "0123",
+		"catalognumber":             "CAT 1",
+		"date":                      "2000",
+		"disc":                      "1",
+		"disctotal":                 "1",
+		"genre":                     "pop; rock",
+		"isrc":                      "GBAAA0000001",
+		"label":                     "Label",
+		"musicbrainz_albumartistid": "art1",
+		"musicbrainz_albumid":       "rel1",
+		"musicbrainz_artistid":      "art2",
+		"musicbrainz_trackid":       "rec1",
+		"originaldate":              "1999-12",
+		"releasecountry":            "GB",
+		"title":                     "Title",
+		"track":                     "1",
+		"tracktotal":                "1",
+	}
+	if got := trackTags(&tags, tags.recordings["rec1"]); !reflect.DeepEqual(got, wantTags) {
+		t.Errorf("Got track tags %v, want %v", got, wantTags)
+	}
+
+	cover, err := musicBrainzProvider{}.Cover("rel1")
+	if err != nil || cover.desc.format != "png" || cover.desc.width != 2 || cover.desc.height != 1 {
+		t.Errorf("Got cover %+v (%v), want 2x1 png", cover.desc, err)
+	}
+
+	candidates, err = discogsProvider{}.Search(fr)
+	if err != nil || len(candidates) != 2 || candidates[0].releaseID != makeReleaseID(providerDiscogs, "42") {
+		t.Fatalf("Got Discogs candidates %+v (%v), want release %q first", candidates, err, "42")
+	}
+	tags, err = discogsProvider{}.Release("42")
+	if err != nil || tags.album != "Album" || len(tags.recordings) != 1 {
+		t.Errorf("Got Discogs tags %+v (%v), want album %q with 1 recording", tags, err, "Album")
+	}
+}
+
+func TestLimitedTransport(t *testing.T) {
+	failures := 0
+	delay := "0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.Header().Set("Retry-After", delay)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	want := []struct {
+		failures int
+		retries  int
+		status   int
+	}{
+		{0, 0, http.StatusOK},
+		{2, 2, http.StatusOK},
+		{2, 1, http.StatusServiceUnavailable},
+	}
+	for _, v := range want {
+		failures = v.failures
+		client := &http.Client{Transport: newLimitedTransport("test", http.DefaultTransport, 0, v.retries, time.Second)}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != v.status {
+			t.Errorf("Got status %v, want %v with %v failures and %v retries", resp.StatusCode, v.status, v.failures, v.retries)
+		}
+	}
+
+	// 3 requests at 20 requests per second take at least 100ms.
+	client := &http.Client{Transport: newLimitedTransport("test", http.DefaultTransport, 20, 0, 0)}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Got 3 requests in %v, want at least 100ms", elapsed)
+	}
+
+	// The delay requested by the server is capped.
+	failures, delay = 1, "86400"
+	transport := newLimitedTransport("test", http.DefaultTransport, 0, 1, time.Second)
+	transport.maxDelay = 10 * time.Millisecond
+	start = time.Now()
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed > 5*time.Second {
+		t.Errorf("Got status %v in %v, want %v within the maximum delay", resp.StatusCode, elapsed, http.StatusOK)
+	}
+
+	// Canceled requests do not wait for the rate limit.
+	transport = newLimitedTransport("test", http.DefaultTransport, 0.001, 0, 0)
+	transport.next = time.Now().Add(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := transport.RoundTrip(req.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	want := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, v := range want {
+		delay, ok := retryAfter(v.value)
+		if delay != v.delay || ok != v.ok {
+			t.Errorf("Got (%v, %v), want (%v, %v) for %q", delay, ok, v.delay, v.ok, v.value)
+		}
+	}
+}
+
+func TestLRCPlain(t *testing.T) {
+	lrc := "[ar:Artist]\n[ti:Title]\n[00:01.00]First line\n[00:05.50][01:05.50]Chorus\n\n[00:09:00] Last line "
+	want := "First line\nChorus\n\nLast line"
+	if got := lrcPlain(lrc); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	lyrics := makeLyrics("First line\r\nSecond line")
+	if lyrics.Plain != "First line\nSecond line" || lyrics.Synced != "" {
+		t.Errorf("Got %+v for plain lyrics", lyrics)
+	}
+}
+
+func TestWriteLyrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lrc := filepath.Join(dir, "track.lrc")
+	if err := ioutil.WriteFile(lrc, []byte("edited"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { journal = Journal{} }()
+	journal, err = OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := newFileRecord(filepath.Join(dir, "input.flac"))
+	fr.output = []outputInfo{{Path: filepath.Join(dir, "track.ogg"), LRC: "new", Write: existWriteSuffix}}
+	read := func() string {
+		buf, _ := ioutil.ReadFile(lrc)
+		return string(buf)
+	}
+
+	if err := writeLyrics(fr, 0); err != nil || read() != "edited" {
+		t.Errorf("Got %q (%v), want the existing lyrics to be kept", read(), err)
+	}
+
+	fr.output[0].Write = existWriteOver
+	if err := writeLyrics(fr, 0); err != nil || read() != "new" {
+		t.Errorf("Got %q (%v), want the lyrics to be overwritten", read(), err)
+	}
+	journal.Close()
+	Undo(filepath.Join(dir, "journal"), true)
+	if read() != "edited" {
+		t.Errorf("Got %q after undo, want the former lyrics", read())
+	}
+}
+
+func TestLyricsProviders(t *testing.T) {
+	defer func(o Options) { options = o }(options)
+
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"album/track.lrc":          "[00:01.00]Sidecar",
+		"lyrics/Artist - Song.lrc": "[00:01.00]From folder",
+		"lyrics/Other/Title.txt":   "Plain text",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options.LyricsDir = filepath.Join(dir, "lyrics")
+
+	local := &localLyricsProvider{}
+	want := []struct {
+		q     lyricsQuery
+		plain string
+		err   error
+	}{
+		{lyricsQuery{artist: "Artist", title: "Song", path: filepath.Join(dir, "album/track.flac")}, "Sidecar", nil},
+		{lyricsQuery{artist: "artist", title: "song!", path: filepath.Join(dir, "album/other.flac")}, "From folder", nil},
+		{lyricsQuery{artist: "Other", title: "Title", path: filepath.Join(dir, "album/other.flac")}, "Plain text", nil},
+		{lyricsQuery{artist: "Artist", title: "Unknown", path: filepath.Join(dir, "album/other.flac")}, "", errNoLyrics},
+	}
+	for _, v := range want {
+		lyrics, err := local.Lyrics(v.q)
+		if lyrics.Plain != v.plain || err != v.err {
+			t.Errorf("Got %q (%v), want %q (%v) for %+v", lyrics.Plain, err, v.plain, v.err, v.q)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/get" || r.FormValue("duration") != "200" {
+			t.Errorf("Unexpected LRCLIB query %q", r.URL)
+		}
+		if r.FormValue("track_name") != "Title" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"instrumental": false, "plainLyrics": "", "syncedLyrics": "[00:01.00]Line"}`))
+	}))
+	defer server.Close()
+	options.LRCLIBURL = server.URL
+
+	lyrics, err := lrclibProvider{}.Lyrics(lyricsQuery{artist: "Artist", title: "Title", duration: 200})
+	if err != nil || lyrics.Plain != "Line" || lyrics.Synced != "[00:01.00]Line" {
+		t.Errorf("Got LRCLIB lyrics %+v (%v)", lyrics, err)
+	}
+	_, err = lrclibProvider{}.Lyrics(lyricsQuery{artist: "Artist", title: "Unknown", duration: 200})
+	if err != errNoLyrics {
+		t.Errorf("Got error %v, want %v", err, errNoLyrics)
+	}
+}
+
+func TestFingerprintSimilarity(t *testing.T) {
+	a := make([]uint32, 100)
+	for i := range a {
+		a[i] = uint32(i) * 2654435761
+	}
+	// 'b' is 'a' delayed by 3 items with 1 bit out of 32 flipped.
+	b := append([]uint32{1, 2, 3}, a...)
+	for i := range b {
+		b[i] ^= 1
+	}
+
+	if got := fingerprintSimilarity(a, a); got != 1 {
+		t.Errorf("Got %v for identical fingerprints, want 1", got)
+	}
+	if got, want := fingerprintSimilarity(a, b), 1-1.0/32; got != want {
+		t.Errorf("Got %v for shifted fingerprints, want %v", got, want)
+	}
+
+	c := make([]uint32, len(a))
+	for i := range c {
+		c[i] = ^a[i]
+	}
+	if got := fingerprintSimilarity(a, c); got >= 0.85 {
+		t.Errorf("Got %v for unrelated fingerprints, want less than 0.85", got)
+	}
+	files := []*dedupeFile{
+		{input: inputInfo{path: "c.mp3"}, fingerprint: c, duration: 100},
+		{input: inputInfo{path: "b.mp3"}, fingerprint: b, duration: 101},
+		{input: inputInfo{path: "a.flac"}, fingerprint: a, duration: 100},
+		{input: inputInfo{path: "d.flac"}, fingerprint: a, duration: 200},
+	}
+	clusters := clusterDuplicates(files, 0.85)
+	if len(clusters) != 1 || len(clusters[0]) != 2 || clusters[0][0].input.path != "a.flac" || clusters[0][1].input.path != "b.mp3" {
+		t.Errorf("Got clusters %+v, want a.flac and b.mp3", clusters)
+	}
+}
+
+func TestTrashFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trash := filepath.Join(dir, "trash")
+	var trashed []string
+	for _, name := range []string{"a/copy.mp3", "b/copy.mp3"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := trashFile(path, trash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := ioutil.ReadFile(dst); err != nil || string(buf) != name {
+			t.Errorf("%v: got %q (%v) in the trash", name, buf, err)
+		}
+		trashed = append(trashed, dst)
+	}
+	if trashed[0] == trashed[1] {
+		t.Errorf("Got the same trash path %q twice", trashed[0])
+	}
+}
+
+func TestWroteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "output.ogg")
+	if err := ioutil.WriteFile(path, []byte("output"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(watch bool) { options.Watch = watch }(options.Watch)
+	options.Watch = true
+	if wroteFile(path) {
+		t.Error("Got written file before recording it")
+	}
+	recordWritten(path)
+	if !wroteFile(path) {
+		t.Error("Written file not recorded")
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if wroteFile(path) {
+		t.Error("Modified file reported as written")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	c, err := OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Record(newFileRecord("a.flac"))
+	c.Record(newFileRecord("b\n.flac"))
+	c.Close()
+
+	c, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Record(newFileRecord("c.flac"))
+	c.Close()
+	c, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a.flac", "b\n.flac", "c.flac"} {
+		if !c.Done(p) {
+			t.Errorf("%q not done after resume", p)
+		}
+	}
+	c.Close()
+
+	// Without resume, the checkpoint starts over.
+	c, err = OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Done("a.flac") {
+		t.Error("Got done file without resume")
+	}
+	if err := c.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Checkpoint not removed: %v", err)
+	}
+
+	if checkpointName([]string{"a", "b"}) != checkpointName([]string{"b", "a"}) {
+		t.Error("Checkpoint name depends on the input order")
+	}
+	if checkpointName([]string{"a", "b"}) == checkpointName([]string{"a"}) {
+		t.Error("Got the same checkpoint name for different inputs")
+	}
+
+	// A file whose script failed must be processed again on resume.
+	defer func() { checkpoint = Checkpoint{} }()
+	checkpoint, err = OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := newFileRecord("d.flac")
+	fr.input.trackCount = 1
+	fr.status = []outputStatus{statusFail}
+	fr.output = []outputInfo{{}}
+	var tr transformer
+	tr.Run(context.Background(), fr)
+	checkpoint.Close()
+	c, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Done("d.flac") {
+		t.Error("Got done file after a script failure")
+	}
+	c.Close()
+}
+
+// blockingStage runs until released or aborted.
+type blockingStage struct {
+	started chan *FileRecord
+	release chan struct{}
+}
+
+func (s *blockingStage) Init()  {}
+func (s *blockingStage) Close() {}
+
+func (s *blockingStage) Run(ctx context.Context, fr *FileRecord) error {
+	s.started <- fr
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	run := func(interrupt func(p *Pipeline, s *blockingStage, abort context.CancelFunc)) []*FileRecord {
+		ctx, abort := context.WithCancel(context.Background())
+		defer abort()
+		p := NewPipeline(ctx, 1, 1)
+		s := &blockingStage{started: make(chan *FileRecord), release: make(chan struct{})}
+		p.Add(func() Stage { return s }, 1)
+
+		a, b := newFileRecord("a.flac"), newFileRecord("b.flac")
+		p.Feed(a)
+		if <-s.started != a {
+			t.Fatal("First record not started")
+		}
+		// 'b' waits in the input queue.
+		p.Feed(b)
+		interrupt(p, s, abort)
+		if p.Feed(newFileRecord("c.flac")) {
+			t.Error("Stopped pipeline accepted input")
+		}
+
+		var got []*FileRecord
+		for fr := range p.output {
+			got = append(got, fr)
+		}
+		p.Close()
+		return got
+	}
+
+	// Stop: the record in progress completes, the waiting one is discarded.
+	got := run(func(p *Pipeline, s *blockingStage, abort context.CancelFunc) {
+		p.Stop()
+		close(s.release)
+	})
+	if len(got) != 1 || got[0].input.path != "a.flac" {
+		t.Errorf("Got %v records after stop, want a.flac only", len(got))
+	}
+
+	// Abort: the record in progress fails.
+	got = run(func(p *Pipeline, s *blockingStage, abort context.CancelFunc) {
+		p.Stop()
+		abort()
+	})
+	if len(got) != 0 {
+		t.Errorf("Got %v records after abort, want none", len(got))
+	}
+
+	// Stop unblocks a producer waiting on the full input queue.
+	got = run(func(p *Pipeline, s *blockingStage, abort context.CancelFunc) {
+		fed := make(chan bool)
+		go func() { fed <- p.Feed(newFileRecord("d.flac")) }()
+		// Let the producer block.
+		time.Sleep(10 * time.Millisecond)
+		p.Stop()
+		if <-fed {
+			t.Error("Stopped pipeline accepted blocked input")
+		}
+		close(s.release)
+	})
+	if len(got) != 1 || got[0].input.path != "a.flac" {
+		t.Errorf("Got %v records after stop, want a.flac only", len(got))
+	}
+}
+
+func TestTransformerKeepsMovedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src.flac"), filepath.Join(dir, "dst.flac")
+	// Corrupt metadata: the source is renamed, then the tags cannot be written.
+	data := []byte("fLaC\x00\xff\xff\xffaudio")
+	if err := ioutil.WriteFile(src, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := newFileRecord(src)
+	fr.input.trackCount = 1
+	fr.input.tags = map[string]string{"title": "a"}
+	fr.Format.FormatName = "flac"
+	fr.status = []outputStatus{statusOK}
+	fr.output = []outputInfo{{
+		Path:         dst,
+		Format:       "flac",
+		Parameters:   []string{"-c:a", "copy"},
+		Tags:         map[string]string{"title": "b"},
+		Removesource: true,
+	}}
+
+	var tr transformer
+	tr.Run(context.Background(), fr)
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("Source was not moved: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("Moved source was removed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %q, want %q", got, data)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	f, err := ioutil.TempFile("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var p Progress
+	p.Start(f, time.Hour, nil)
+	a, b := newFileRecord("a.flac"), newFileRecord("b.flac")
+	p.Event(a, Event{Stage: stageWalker, Type: eventDiscovered})
+	p.Event(b, Event{Stage: stageWalker, Type: eventDiscovered})
+	p.Event(a, Event{Stage: stageAnalyzer, Type: eventAnalyzed, Track: 1})
+	p.Event(b, Event{Stage: stageAnalyzer, Type: eventScriptsFailed, Track: 1})
+	p.Finish(a)
+	p.Finish(b)
+	p.Lock()
+	p.total = 4
+	p.Unlock()
+	p.Stop()
+
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"2/4 files (50%)", "1 analyzed, 0 written, 0 skipped, 1 failed", "ETA "} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("Got progress %q, want %q", buf, want)
+		}
+	}
+
+	for n, want := range map[int64]string{512: "512 B", 1536: "1.5 KiB", 3 << 30: "3.0 GiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("Got %q for %v bytes, want %q", got, n, want)
+		}
+	}
+	for d, want := range map[time.Duration]string{42 * time.Second: "42s", 61 * time.Second: "1m01s", 3723 * time.Second: "1h02m03s"} {
+		if got := formatDuration(d); got != want {
+			t.Errorf("Got %q for %v, want %q", got, d, want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	var r Report
+	if r.ExitCode() != 0 {
+		t.Errorf("Got exit code %v for empty run, want 0", r.ExitCode())
+	}
+
+	ok, cover, failed, skipped, other := newFileRecord("ok.flac"), newFileRecord("cover.flac"), newFileRecord("failed.flac"), newFileRecord("skipped.flac"), newFileRecord("cover.jpg")
+	ok.status = []outputStatus{statusExist}
+	ok.output = []outputInfo{{Path: "ok_1.flac", Write: existWriteSuffix}}
+	for _, fr := range []*FileRecord{ok, cover, failed} {
+		r.Event(fr, Event{Stage: stageWalker, Type: eventDiscovered})
+	}
+	r.Event(ok, Event{Stage: stageTransformer, Type: eventTranscoded, Track: 1})
+	r.Event(cover, Event{Stage: stageTransformer, Type: eventFailed})
+	r.Event(failed, Event{Stage: stageAnalyzer, Type: eventScriptsFailed, Track: 1})
+	r.Event(failed, Event{Stage: stageAnalyzer, Type: eventScriptsFailed, Track: 2})
+	r.Event(skipped, Event{Stage: stageWalker, Type: eventSkipped})
+	for _, fr := range []*FileRecord{ok, cover, failed, skipped, other} {
+		r.Finish(fr)
+	}
+
+	if r.processed != 1 || r.skipped != 1 || r.suffixed != 1 || r.failed != 2 {
+		t.Errorf("Got %v processed, %v skipped, %v suffixed, %v failed, want 1, 1, 1, 2", r.processed, r.skipped, r.suffixed, r.failed)
+	}
+	if want := map[string]int{reasonCover: 1, reasonScripts: 1}; !reflect.DeepEqual(r.reasons, want) {
+		t.Errorf("Got reasons %v, want %v", r.reasons, want)
+	}
+	if r.ExitCode() != exitPartialFailure {
+		t.Errorf("Got exit code %v, want %v", r.ExitCode(), exitPartialFailure)
+	}
+
+	r = Report{}
+	r.Event(failed, Event{Stage: stageWalker, Type: eventFailed})
+	r.Finish(failed)
+	if r.ExitCode() != exitFailure {
+		t.Errorf("Got exit code %v, want %v", r.ExitCode(), exitFailure)
+	}
+}
+
+func TestFileSelection(t *testing.T) {
+	now := time.Date(2018, 6, 15, 12, 0, 0, 0, time.Local)
+	o := Options{
+		Include: []string{"music", "re:other/keep\\."},
+		Exclude: []string{"Podcasts", "*/live/*.mp3"},
+		Newer:   "7d",
+		Older:   "2018-06-15",
+		MinSize: "1K",
+		MaxSize: "1.5KiB",
+	}
+	s, err := makeFileSelection(&o, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []struct {
+		path    string
+		size    int
+		modTime time.Time
+		ok      bool
+	}{
+		{"music/a.flac", 1024, now.Add(-24 * time.Hour), true},
+		// The extension is not checked.
+		{"music/b.ogg", 1024, now.Add(-24 * time.Hour), true},
+		{"other/c.flac", 1024, now.Add(-24 * time.Hour), false},
+		{"other/keep.flac", 1024, now.Add(-24 * time.Hour), true},
+		{"music/Podcasts/d.mp3", 1024, now.Add(-24 * time.Hour), false},
+		{"music/live/e.mp3", 1024, now.Add(-24 * time.Hour), false},
+		{"music/live/f.flac", 1024, now.Add(-24 * time.Hour), true},
+		{"music/g.flac", 1024, now.Add(-8 * 24 * time.Hour), false},
+		{"music/h.flac", 1024, now.Add(time.Hour), false},
+		{"music/i.flac", 1023, now.Add(-24 * time.Hour), false},
+		{"music/j.flac", 2048, now.Add(-24 * time.Hour), false},
+	}
+	for _, v := range want {
+		path := filepath.Join(dir, v.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, v.size), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, v.modTime, v.modTime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Selected(path, info); got != v.ok {
+			t.Errorf("Got %v for %q, want %v", got, v.path, v.ok)
+		}
+	}
+
+	for _, arg := range []string{"1M", "10", "-1K", "K"} {
+		_, err := parseSize(arg)
+		if (err == nil) != (arg == "1M" || arg == "10") {
+			t.Errorf("Got error %v for size %q", err, arg)
+		}
+	}
+	for _, arg := range []string{"2w", "36h", "2018-06-01 10:00", "yesterday"} {
+		_, err := parseTime(arg, now)
+		if (err == nil) != (arg != "yesterday") {
+			t.Errorf("Got error %v for time %q", err, arg)
+		}
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	want := map[string][]string{
+		"a.flac\nb c.mp3\r\n\nd/\n":    {"a.flac", "b c.mp3", "d/"},
+		"a.flac\x00b\nc.mp3\x00d/":     {"a.flac", "b\nc.mp3", "d/"},
+		"a.flac":                       {"a.flac"},
+		"":                             nil,
+		strings.Repeat("a\n", 20000):   nil,
+		strings.Repeat("a\x00", 20000): nil,
+	}
+	for input, paths := range want {
+		got, err := ReadFileList(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths == nil && input != "" {
+			// Long lists: check the count only.
+			if len(got) != 20000 || got[0] != "a" {
+				t.Errorf("Got %v paths, want 20000", len(got))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, paths) {
+			t.Errorf("Got %q, want %q", got, paths)
+		}
+	}
+}
+
+func TestTransformerOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demlo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o Options) { options = o }(options)
+	defer func() { journal = Journal{} }()
+	options.Trash = filepath.Join(dir, "trash")
+
+	src, dst := filepath.Join(dir, "src.flac"), filepath.Join(dir, "dst.flac")
+	// Corrupt metadata: the tags cannot be written.
+	data := []byte("fLaC\x00\xff\xff\xffaudio")
+	run := func(tags map[string]string) {
+		fr := newFileRecord(src)
+		fr.input.trackCount = 1
+		fr.input.tags = map[string]string{"title": "a"}
+		fr.Format.FormatName = "flac"
+		fr.status = []outputStatus{statusExist}
+		fr.output = []outputInfo{{
+			Path:       dst,
+			Format:     "flac",
+			Parameters: []string{"-c:a", "copy"},
+			Tags:       tags,
+			Write:      existWriteOver,
+		}}
+		var tr transformer
+		tr.Run(context.Background(), fr)
+	}
+	for path, content := range map[string][]byte{src: data, dst: []byte("old")} {
+		if err := ioutil.WriteFile(path, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failure: the overwritten file is moved back.
+	run(map[string]string{"title": "b"})
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != "old" {
+		t.Errorf("Got %q (%v) after a failure, want %q", got, err, "old")
+	}
+
+	journal, err = OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(map[string]string{"title": "a"})
+	journal.Close()
+	if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Got %q (%v), want %q", got, err, data)
+	}
+	if err := Undo(filepath.Join(dir, "journal"), true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != "old" {
+		t.Errorf("Got %q (%v) after undo, want %q", got, err, "old")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Source was removed: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Discogs provider.
+//
+// Discogs has no fingerprint lookup: releases are searched by album and album
+// artist. The Discogs API requires a personal access token, see
+// https://www.discogs.com/settings/developers.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultDiscogsURL = "https://api.discogs.com"
+
+var (
+	// Discogs appends a number to the names of homonymous artists.
+	reDiscogsHomonym = regexp.MustCompile(` \(\d+\)$`)
+	// Positions of multi-disc releases, e.g. "2-5" or "CD2-5".
+	reDiscogsDisc = regexp.MustCompile(`^\D*(\d+)[-.]\d+$`)
+)
+
+type discogsProvider struct{}
+
+type discogsArtist struct {
+	Name string `json:"name"`
+	// Artist name variation, as credited on the release.
+	ANV string `json:"anv"`
+}
+
+type discogsRelease struct {
+	Title   string          `json:"title"`
+	Year    int             `json:"year"`
+	Artists []discogsArtist `json:"artists"`
+	Country string          `json:"country"`
+	Genres  []string        `json:"genres"`
+	Styles  []string        `json:"styles"`
+	Labels  []struct {
+		Name  string `json:"name"`
+		CatNo string `json:"catno"`
+	} `json:"labels"`
+	Tracklist []struct {
+		Position string          `json:"position"`
+		Type     string          `json:"type_"`
+		Title    string          `json:"title"`
+		Duration string          `json:"duration"`
+		Artists  []discogsArtist `json:"artists"`
+	} `json:"tracklist"`
+	Images []struct {
+		Type string `json:"type"`
+		URI  string `json:"uri"`
+	} `json:"images"`
+}
+
+type discogsSearchResult struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Year  string `json:"year"`
+}
+
+func (discogsProvider) Name() string {
+	return providerDiscogs
+}
+
+func (discogsProvider) LookupFingerprint(fr *FileRecord, fp *trackFingerprint) ([]releaseCandidate, error) {
+	return nil, errNotSupported
+}
+
+func (discogsProvider) Search(fr *FileRecord) ([]releaseCandidate, error) {
+	tags := fr.input.tags
+	if tags["album"] == "" {
+		return nil, nil
+	}
+	artist := tags["album_artist"]
+	if artist == "" {
+		artist = tags["artist"]
+	}
+
+	query := url.Values{}
+	query.Set("type", "release")
+	query.Set("release_title", tags["album"])
+	if artist != "" {
+		query.Set("artist", artist)
+	}
+	var response struct {
+		Results []discogsSearchResult `json:"results"`
+	}
+	err := discogsGet("/database/search", query, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return discogsCandidates(fr, response.Results), nil
+}
+
+func (discogsProvider) Release(id string) (Tags, error) {
+	var release discogsRelease
+	err := discogsGet("/releases/"+id, nil, &release)
+	if err != nil {
+		return Tags{}, err
+	}
+	return makeDiscogsTags(release), nil
+}
+
+func (discogsProvider) Cover(id string) (Cover, error) {
+	var release discogsRelease
+	err := discogsGet("/releases/"+id, nil, &release)
+	if err != nil {
+		return Cover{}, err
+	}
+	if len(release.Images) == 0 {
+		return Cover{}, errMissingCover
+	}
+	uri := release.Images[0].URI
+	for _, v := range release.Images {
+		if v.Type == "primary" {
+			uri = v.URI
+			break
+		}
+	}
+
+	resp, err := discogsDo(uri)
+	if err != nil {
+		return Cover{}, err
+	}
+	defer resp.Body.Close()
+	picture, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Cover{}, err
+	}
+	return makeCover(picture)
+}
+
+// discogsDo sends an authenticated GET request to 'uri'.
+func discogsDo(uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Discogs rejects requests without a user agent.
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Authorization", "Discogs token="+options.DiscogsToken)
+
+	resp, err := discogsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Discogs: " + resp.Status)
+	}
+	return resp, nil
+}
+
+// discogsGet decodes the JSON response of API endpoint 'path' into 'v'.
+func discogsGet(path string, query url.Values, v interface{}) error {
+	uri := options.DiscogsURL + path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	resp, err := discogsDo(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.New("Discogs: " + err.Error())
+	}
+	return nil
+}
+
+// discogsCandidates scores the search results against the album, the album
+// artist and the date of 'fr', with the 'MatchWeights' option.
+func discogsCandidates(fr *FileRecord, results []discogsSearchResult) []releaseCandidate {
+	tags := fr.input.tags
+	album := stringNorm(tags["album"])
+	albumartist := tags["album_artist"]
+	if albumartist == "" {
+		albumartist = tags["artist"]
+	}
+	albumartist = stringNorm(albumartist)
+	year, err := strconv.Atoi(reYear.FindString(tags["date"]))
+	if err != nil {
+		year = 0
+	}
+
+	w := options.MatchWeights
+	wSum := w["album"] + w["albumartist"] + w["year"]
+
+	candidates := make([]releaseCandidate, 0, len(results))
+	for _, result := range results {
+		// Titles are "Artist - Album".
+		resultArtist, resultAlbum := "", result.Title
+		if i := strings.Index(result.Title, " - "); i >= 0 {
+			resultArtist, resultAlbum = result.Title[:i], result.Title[i+3:]
+		}
+		resultArtist = reDiscogsHomonym.ReplaceAllString(resultArtist, "")
+		resultYear, _ := strconv.Atoi(result.Year)
+
+		relAlbum := stringRel(stringNorm(resultAlbum), album)
+		relAlbumArtist := stringRel(stringNorm(resultArtist), albumartist)
+		relYear := scoreYear(resultYear, year)
+
+		score := 0.0
+		if wSum > 0 {
+			score = (w["album"]*relAlbum + w["albumartist"]*relAlbumArtist + w["year"]*relYear) / wSum
+		}
+		details := fmt.Sprintf(`
+%-12s %-7.4g [%v]
+%-12s %-7.4g [%v]
+%-12s %-7.4g [%v]
+`,
+			"Album", relAlbum, resultAlbum,
+			"AlbumArtist", relAlbumArtist, resultArtist,
+			"Year", relYear, resultYear)
+		fr.debug.Printf("Discogs score: %.4g", score)
+		fr.debug.Print(details)
+
+		candidates = append(candidates, releaseCandidate{
+			releaseID: makeReleaseID(providerDiscogs, strconv.Itoa(result.ID)),
+			score:     score,
+			artist:    resultArtist,
+			album:     resultAlbum,
+			year:      resultYear,
+			details:   details,
+		})
+	}
+
+	// On equal scores, keep the Discogs order.
+	sortCandidates(candidates)
+	return candidates
+}
+
+// makeDiscogsTags converts a Discogs release. Tracks are numbered from 1 on
+// every disc since vinyl positions like "A1" are not track numbers.
+func makeDiscogsTags(release discogsRelease) Tags {
+	tags := Tags{
+		album:       release.Title,
+		albumartist: discogsArtistName(release.Artists),
+		recordings:  map[RecordingID]Recording{},
+		country:     release.Country,
+		// Styles are the Discogs sub-genres.
+		genre: strings.Join(append(append([]string(nil), release.Genres...), release.Styles...), "; "),
+	}
+	if release.Year > 0 {
+		tags.date = strconv.Itoa(release.Year)
+	}
+	if len(release.Labels) > 0 {
+		tags.label = reDiscogsHomonym.ReplaceAllString(release.Labels[0].Name, "")
+		tags.catalogNumber = release.Labels[0].CatNo
+	}
+
+	positions := map[int]int{}
+	for i, v := range release.Tracklist {
+		// Skip headings and indices.
+		if v.Type != "" && v.Type != "track" {
+			continue
+		}
+		disc := 1
+		if m := reDiscogsDisc.FindStringSubmatch(v.Position); m != nil {
+			disc, _ = strconv.Atoi(m[1])
+		}
+		positions[disc]++
+
+		rec := Recording{
+			artist:   discogsArtistName(v.Artists),
+			duration: discogsDuration(v.Duration),
+			title:    v.Title,
+			track:    strconv.Itoa(positions[disc]),
+			disc:     disc,
+			position: positions[disc],
+		}
+		if rec.artist == "" {
+			rec.artist = tags.albumartist
+		}
+		tags.recordings[RecordingID(strconv.Itoa(i))] = rec
+	}
+
+	tags.discTotal = len(positions)
+	for id, rec := range tags.recordings {
+		rec.trackTotal = positions[rec.disc]
+		tags.recordings[id] = rec
+	}
+
+	return tags
+}
+
+// discogsArtistName returns the name of the first artist as credited.
+func discogsArtistName(artists []discogsArtist) string {
+	if len(artists) == 0 {
+		return ""
+	}
+	name := artists[0].ANV
+	if name == "" {
+		name = artists[0].Name
+	}
+	return reDiscogsHomonym.ReplaceAllString(name, "")
+}
+
+// discogsDuration converts durations like "4:05" or "1:02:03" to
+// milliseconds. It returns 0 if the duration is unknown.
+func discogsDuration(s string) int {
+	if s == "" {
+		return 0
+	}
+	duration := 0
+	for _, v := range strings.Split(s, ":") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+		duration = duration*60 + n
+	}
+	return duration * 1000
+}
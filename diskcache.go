@@ -0,0 +1,276 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Persist the online caches across runs.
+//
+// The in-memory caches of online.go only live for one run. Since most online
+// lookups are repeated from one run to the next on the same library, we keep
+// the successful results on disk, under $XDG_CACHE_HOME/demlo. Entries expire
+// after 'options.CacheTTL' days and the store is pruned down to
+// 'options.CacheSize' MiB at the end of the run, oldest entries first.
+//
+// Failed queries are not persisted: they are retried on the next run.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheReleaseIDs = "releaseid"
+	diskCacheDiscs      = "disc"
+	// Bumped when fields are added to Tags so that older entries are not reused.
+	diskCacheTags   = "tags-v2"
+	diskCacheCovers = "cover"
+)
+
+var onlineDiskCache DiskCache
+
+// DiskCache is a key-value store where every entry is a file. The buckets are
+// sub-folders of the root.
+// The zero value is a disabled cache: all lookups miss and all stores are
+// discarded.
+type DiskCache struct {
+	root    string
+	ttl     time.Duration
+	maxSize int64
+	sync.Mutex
+}
+
+// NewDiskCache returns a cache in folder 'root'. Entries older than 'ttl' are
+// ignored. When 'ttl' is 0, the cache is disabled. 'maxSize' is in bytes, 0
+// means unlimited.
+func NewDiskCache(root string, ttl time.Duration, maxSize int64) DiskCache {
+	if ttl <= 0 {
+		return DiskCache{}
+	}
+	return DiskCache{root: root, ttl: ttl, maxSize: maxSize}
+}
+
+func (c *DiskCache) path(bucket, key string) string {
+	return filepath.Join(c.root, bucket, fmt.Sprintf("%x", md5.Sum([]byte(key))))
+}
+
+// Get returns the content of the entry 'key' in 'bucket'. The boolean is false
+// if the entry is missing or expired.
+func (c *DiskCache) Get(bucket, key string) ([]byte, bool) {
+	if c.root == "" {
+		return nil, false
+	}
+	path := c.path(bucket, key)
+	st, err := os.Stat(path)
+	if err != nil || time.Since(st.ModTime()) > c.ttl {
+		return nil, false
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+// Put stores 'value' in the entry 'key' of 'bucket'. The entry is written to a
+// temporary file first so that concurrent runs never read partial entries.
+func (c *DiskCache) Put(bucket, key string, value []byte) error {
+	if c.root == "" {
+		return nil
+	}
+	path := c.path(bucket, key)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := TempFile(filepath.Dir(path), filepath.Base(path)+"_", ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// GetJSON is like Get but decodes the entry into 'v'.
+func (c *DiskCache) GetJSON(bucket, key string, v interface{}) bool {
+	buf, ok := c.Get(bucket, key)
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(buf, v) == nil
+}
+
+// PutJSON is like Put but encodes 'v' first.
+func (c *DiskCache) PutJSON(bucket, key string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Put(bucket, key, buf)
+}
+
+// Clear removes all the entries.
+func (c *DiskCache) Clear() error {
+	if c.root == "" {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return os.RemoveAll(c.root)
+}
+
+// Prune removes the expired entries, then the oldest entries until the cache
+// fits in its maximum size.
+func (c *DiskCache) Prune() error {
+	if c.root == "" {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if time.Since(info.ModTime()) > c.ttl {
+			return os.Remove(path)
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		err := os.Remove(e.path)
+		if err != nil {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+func (k AlbumKey) String() string {
+	return k.album + "\x00" + k.albumartist + "\x00" + k.date
+}
+
+// The fields of Tags and Recording are not exported, thus we need an
+// intermediate representation for JSON.
+type recordingJSON struct {
+	Artist   string `json:"artist"`
+	Duration int    `json:"duration"`
+	Title    string `json:"title"`
+	Track    string `json:"track"`
+	Disc     int    `json:"disc,omitempty"`
+	Position int    `json:"position,omitempty"`
+
+	TrackTotal int    `json:"tracktotal,omitempty"`
+	MBID       string `json:"mbid,omitempty"`
+	ArtistMBID string `json:"artistmbid,omitempty"`
+	ISRC       string `json:"isrc,omitempty"`
+}
+
+type tagsJSON struct {
+	Album       string                        `json:"album"`
+	AlbumArtist string                        `json:"albumartist"`
+	Date        string                        `json:"date"`
+	Recordings  map[RecordingID]recordingJSON `json:"recordings"`
+
+	MBID            string `json:"mbid,omitempty"`
+	AlbumArtistMBID string `json:"albumartistmbid,omitempty"`
+	Barcode         string `json:"barcode,omitempty"`
+	CatalogNumber   string `json:"catalognumber,omitempty"`
+	Country         string `json:"country,omitempty"`
+	DiscTotal       int    `json:"disctotal,omitempty"`
+	Genre           string `json:"genre,omitempty"`
+	Label           string `json:"label,omitempty"`
+	OriginalDate    string `json:"originaldate,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (t Tags) MarshalJSON() ([]byte, error) {
+	v := tagsJSON{
+		Album:       t.album,
+		AlbumArtist: t.albumartist,
+		Date:        t.date,
+		Recordings:  map[RecordingID]recordingJSON{},
+
+		MBID:            t.mbid,
+		AlbumArtistMBID: t.albumartistMBID,
+		Barcode:         t.barcode,
+		CatalogNumber:   t.catalogNumber,
+		Country:         t.country,
+		DiscTotal:       t.discTotal,
+		Genre:           t.genre,
+		Label:           t.label,
+		OriginalDate:    t.originalDate,
+	}
+	for id, r := range t.recordings {
+		v.Recordings[id] = recordingJSON{Artist: r.artist, Duration: r.duration, Title: r.title, Track: r.track, Disc: r.disc, Position: r.position,
+			TrackTotal: r.trackTotal, MBID: r.mbid, ArtistMBID: r.artistMBID, ISRC: r.isrc}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (t *Tags) UnmarshalJSON(buf []byte) error {
+	var v tagsJSON
+	err := json.Unmarshal(buf, &v)
+	if err != nil {
+		return err
+	}
+	t.album = v.Album
+	t.albumartist = v.AlbumArtist
+	t.date = v.Date
+	t.mbid = v.MBID
+	t.albumartistMBID = v.AlbumArtistMBID
+	t.barcode = v.Barcode
+	t.catalogNumber = v.CatalogNumber
+	t.country = v.Country
+	t.discTotal = v.DiscTotal
+	t.genre = v.Genre
+	t.label = v.Label
+	t.originalDate = v.OriginalDate
+	t.recordings = map[RecordingID]Recording{}
+	for id, r := range v.Recordings {
+		t.recordings[id] = Recording{artist: r.Artist, duration: r.Duration, title: r.Title, track: r.Track, disc: r.Disc, position: r.Position,
+			trackTotal: r.TrackTotal, mbid: r.MBID, artistMBID: r.ArtistMBID, isrc: r.ISRC}
+	}
+	return nil
+}
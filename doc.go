@@ -28,6 +28,9 @@ all cuesheet details are appended accordingly. Cuesheet tags override stream
 tags, which override format tags. Finally, still without index, tags can be
 retrieved from Internet if the command-line option is set.
 
+- With '-group', the files wait for the other files of their group to be
+analyzed (see ALBUM section).
+
 - If a 'prescript' has been specified, it gets executed. It makes it possible to
 adjust the input values and global variables before running the other scripts.
 
@@ -48,7 +51,8 @@ path, the encoding parameters, and so on.
 
 - When applying changes, the covers get copied if required and the audio file
 gets processed: tags are modified as specified, the file is re-encoded if
-required, and the output is written to the appropriate folder. When destination
+required, the covers are embedded if required, and the output is written to the
+appropriate folder. When destination
 already exists, the 'exist' action is executed (see EXISTING DESTINATION
 section).
 
@@ -143,6 +147,44 @@ script. You can also define shell aliases or use wrapper scripts as convenience.
 
 
 
+FILE SELECTION
+
+When a folder is browsed, the files with a known extension (see '-ext') are
+selected with the following options:
+
+- '-include' and '-exclude' select the files whose path matches a pattern or
+not. A pattern is a glob matching consecutive components of the path, or a
+regexp matching a part of the path if prefixed with 're:'. Both options can be
+specified several times: a file is selected if it matches one of the include
+patterns, if any, and none of the exclude patterns.
+
+- '-newer' and '-older' select the files by modification time, either a date
+('2006-01-02', '2006-01-02 15:04' or RFC 3339) or a duration before now, e.g.
+'36h', '7d' or '2w'.
+
+- '-min-size' and '-max-size' select the files by size in bytes, with an
+optional unit, e.g. '500K', '1.5M' or '2G'.
+
+For instance, to process the files added since last week except the podcasts:
+
+	demlo -newer 7d -exclude Podcasts ~/music
+
+Finally, '-filter' drops the files for which a Lua expression is false. It is
+evaluated before the scripts, once the file has been probed, with 'input' and
+its tags 'i':
+
+	demlo -filter 'i.genre ~= "Podcast" and input.bitrate >= 192000' ~/music
+
+The filter is not evaluated in duplicate detection.
+
+The input paths can also be read from a file with '-files-from', or from stdin
+with '-files-from -'. The paths are separated by newlines, or by NUL characters
+if the list contains any, so that the output of external tools can be used:
+
+	find ~/music -name '*.flac' -mtime -7 -print0 | demlo -files-from -
+
+
+
 EXISTING DESTINATION
 
 By default, when the destination exists, Demlo will append a suffix to the
@@ -168,6 +210,76 @@ syncing music libraries.
 
 
 
+JOURNAL AND UNDO
+
+When processing, Demlo records every change made to the file system (created,
+moved and removed files, former tags of files modified in place) in a journal.
+By default a new journal is created for every run in
+
+	$XDG_DATA_HOME/demlo/journal (Default: $HOME/.local/share/demlo/journal)
+
+The changes of a run can be reverted with
+
+	demlo -p -undo JOURNAL
+
+Without '-p', the reverting actions are only previewed. Created files are
+removed, moved files are moved back and the former tags are restored. Removed
+sources, overwritten destinations and the originals of files transcoded in place
+are moved to the '-trash' folder, by default
+
+	$XDG_DATA_HOME/demlo/trash (Default: $HOME/.local/share/demlo/trash)
+
+so that they are restored too. Empty it once the changes are checked.
+
+
+
+INTERRUPTION AND RESUME
+
+When processing, the first interrupt (e.g. Ctrl-C) stops the run gracefully:
+the files in progress are finished and the remaining files are skipped. A
+second interrupt aborts the files in progress: FFmpeg is stopped and the
+partial output files are removed.
+
+The files that were completely processed are recorded in a checkpoint, by
+default a file named after the input folders and files in
+
+	$XDG_DATA_HOME/demlo/checkpoint (Default: $HOME/.local/share/demlo/checkpoint)
+
+An interrupted run can be resumed by running the same command with '-resume':
+the files recorded in the checkpoint are skipped. The checkpoint is removed
+when a run completes. Runs on other inputs use other checkpoints. Use
+'-checkpoint' to run several resumable commands on the same input at the same
+time.
+
+
+
+DUPLICATES
+
+With '-dedupe', Demlo fingerprints all the input files and reports the copies
+of the same recordings, e.g. the same track in FLAC and in MP3, then exits:
+
+	demlo -dedupe ~/music
+
+Files of similar durations are compared by their fingerprints. Copies whose
+similarity is at least '-dedupe-threshold' (from 0 to 1, default 0.85) are
+listed together with their format, bitrate, duration, similarity to the first
+copy and path. Multi-track files are skipped.
+
+The copy to keep is chosen by the action specified with '-dedupe-action'. The
+action is called for every set of copies with the 'duplicates' array, which
+holds the 'input' tables of the copies sorted by path. It sets the 'keep'
+variable to the index of the copy to keep, or leaves it to nil to keep all of
+them. The 'keepbest' action keeps the lossless copy with the highest bitrate:
+
+	demlo -dedupe -dedupe-action keepbest ~/music
+
+With '-p', the copies that are not kept are moved to the '-trash' folder and
+recorded in the journal so that
+'-undo' restores them. Since copies are grouped transitively, a copy is only
+moved if its similarity to the kept copy is at least the threshold.
+
+
+
 VARIABLES (INPUT & OUTPUT)
 
 The 'input' table describes the file:
@@ -186,6 +298,8 @@ The 'input' table describes the file:
 	   embeddedcovers = {},
 	   externalcovers = {},
 	   onlinecover = {},
+	   loudness = {},
+	   lyrics = {},
 	}
 
 Bitrate is in bits-per-seconds (bps). That is, for 320 kbps you would specify
@@ -206,12 +320,38 @@ Since there may be more than one stream (covers, other data), the first audio
 stream is assumed to be the music stream. For convenience, the index of the
 music stream is stored in 'audioindex'.
 
+With '-loudness', the EBU R128 loudness of single-track files is analyzed and
+stored in 'loudness'; it is nil otherwise:
+
+	loudness = {
+	   integrated = 0, -- Integrated loudness in LUFS.
+	   range = 0, -- Loudness range in LU.
+	   peak = 0, -- True peak, linear (1.0 is full scale).
+	   trackgain = 0, -- Gain in dB to reach the ReplayGain 2.0 level (-18 LUFS).
+	   albumintegrated = 0,
+	   albumpeak = 0,
+	   albumgain = 0,
+	}
+
+The album values are computed over the files of the same folder that have the
+same album, album artist and date tags, whether they are processed or not. See
+the 'tag-loudness' script to write ReplayGain and R128 tags.
+
+With '-lyrics', the lyrics of single-track files are stored in 'lyrics' when
+found; it is nil otherwise. See the LYRICS section.
+
 The tags returned by FFmpeg are found in streams, format and in the cuesheet.
 To make tag queries easier, all tags are stored in the 'tags' table, with the
 following precedence:
 
 	format tags < stream tags < cuesheet header tags < cuesheet track tags
 
+The cuesheet CATALOG and ISRC entries are stored in the 'catalog' and 'isrc'
+tags respectively. Multi-track files are split at the INDEX 01 of every track.
+The pregap between INDEX 00 and INDEX 01 is handled according to '-gaps'. Data
+tracks are skipped. With the non-compliant multi-file layout of EAC, where the
+pregap of a track ends the previous file, the pregap stays in the previous file.
+
 You can remove a tag by setting it to 'nil' or the empty string.
 
 The 'output' table describes the transformation to apply to the file:
@@ -224,16 +364,18 @@ The 'output' table describes the transformation to apply to the file:
 	   embeddedcovers = {},
 	   externalcovers = {},
 	   onlinecover = {},
+	   embedcovers = {},
 	   write = '',
 	   removesource = false,
+	   lrc = '',
 	}
 
 The 'parameters' array holds the commandline parameters passed to FFmpeg. It can
 be anything supported by FFmpeg, although this variable is supposed to hold
 encoding information. See the EXAMPLES section.
 
-The 'embeddedcovers', 'externalcovers' and 'onlinecover' variables are detailed
-in the 'Covers' section.
+The 'embeddedcovers', 'externalcovers', 'onlinecover' and 'embedcovers'
+variables are detailed in the 'Covers' section.
 
 The 'write' variable is explained in the EXISTING DESTINATION section.
 
@@ -241,6 +383,11 @@ The 'removesource' variable is a boolean: when true, Demlo removes the source fi
 after processing. This can speed up the process when not re-encoding. This
 option is ignored for multi-track files.
 
+When 'lrc' is not empty, it is written to a sidecar file next to the output
+file, with the same name and the '.lrc' extension. An existing sidecar file is
+kept, unless the 'exist' action overwrites the output: the former sidecar file
+is then renamed with the '.lrc.bak' extension.
+
 For convenience, the following shortcuts are provided:
 
 	i = input.tags
@@ -248,6 +395,42 @@ For convenience, the following shortcuts are provided:
 
 
 
+ALBUM
+
+Scripts are run per track. The 'album' table holds the 'input' tables of the
+tracks of the same group, sorted by path, the current track included. It lets
+scripts take decisions over a whole album, e.g. to count the tracks or to detect
+compilations.
+
+The grouping is set with '-group':
+
+- 'none' (default): 'album' only holds the current track.
+
+- 'folder': the files of the same folder are grouped together. The scripts of a
+folder are run once all its files have been analyzed.
+
+- 'album': the files with the same album, album artist and date tags are
+grouped together, wherever they are. The scripts are only run once all the files
+have been analyzed. This mode is not available in watch mode.
+
+Multi-track files provide one entry per track. Files that fail the analysis are
+not part of the group. For instance, the following code sets a compilation
+album artist when more than half of the tracks have a different artist:
+
+	local artists, count = {}, 0
+	for _, track in ipairs(album) do
+	   local artist = track.tags.artist or ''
+	   if not artists[artist] then
+	      artists[artist] = true
+	      count = count + 1
+	   end
+	end
+	if count > #album / 2 then
+	   o.album_artist = 'Various Artists'
+	end
+
+
+
 LUA FUNCTIONS
 
 Demlo provides some non-standard Lua functions to ease scripting.
@@ -282,13 +465,176 @@ the MusicBrainz database. Audio files are fingerprinted for the queries, so even
 with initially wrong file names and tags, the right values should still be
 retrieved. The front album cover can also be retrieved.
 
+Tags and covers are fetched from the providers listed in the 'Providers'
+configuration option, in order. The next provider is only queried when the
+previous one has no match scoring at least the '-match-threshold'. Supported
+providers:
+
+	musicbrainz  Fingerprint lookup with AcoustID, tags from MusicBrainz and
+	             covers from the Cover Art Archive (default).
+	discogs      Search by album and album artist on Discogs. It requires a
+	             personal access token in the 'DiscogsToken' configuration
+	             option.
+
+Multi-track files are only identified with MusicBrainz.
+
+Besides album, album artist, artist, date, title and track, the providers set
+the following tags when known: 'disc', 'disctotal', 'tracktotal', 'label',
+'catalognumber', 'genre' and 'releasecountry'. MusicBrainz also sets
+'musicbrainz_albumid', 'musicbrainz_albumartistid', 'musicbrainz_artistid',
+'musicbrainz_trackid', 'barcode', 'isrc' and 'originaldate'. Genres are
+separated by "; ". Scripts decide which tags to keep. The identifiers written
+by Picard, e.g. 'musicbrainz album id', are read under the same names, and MP3
+and M4A outputs store them under the names used by Picard.
+
+With '-acoustid-submit', the fingerprints of the processed files that could not
+be identified are submitted to AcoustID together with their output tags, so
+that they can be identified in the future. This requires the API key of an
+AcoustID account in the 'AcoustIDUserKey' configuration option.
+
 Proxy parameters will be fetched automatically from the 'http_proxy'
 and 'https_proxy' environment variables.
 
+The online services can be replaced by mirrors, e.g. a local MusicBrainz server
+or an AcoustID replica, with '-acoustid-url', '-acoustid-key',
+'-musicbrainz-url', '-coverartarchive-url' and '-discogs-url'.
+
 As this process requires network access it can be quite slow. Nevertheless,
 Demlo is specifically optimized for albums, such that network queries are
 used for only one track per album, when possible.
 
+The queries to every service are spaced according to the 'OnlineRates'
+configuration option, e.g. 1 request per second for MusicBrainz. Failed and
+throttled queries are retried '-online-retries' times with an exponential
+backoff, or after the delay requested by the server, up to '-online-max-delay'
+seconds. Every query is aborted after '-online-timeout' seconds. When a query still fails, a warning names the
+file and the service, and the file is left with its own tags.
+
+A file reuses the release of a previous file when their albums are similar
+enough. How similar is set with '-match-tolerance', from the strictest to the
+loosest:
+
+	acoustid  never reuse a release, fingerprint every file
+	full      similar album, album artist and date (default)
+	artist    similar album and album artist
+	album     similar album
+	any       reuse any previous release
+
+Two fields are similar when their relation is at least 'MatchRelation' (0.7 by
+default, from 0 to 1) in the configuration.
+
+The candidate releases are scored from their title, artist, album artist,
+album, track position, year and duration against the input tags. The weights
+of the fields can be set with 'MatchWeights' in the configuration. Albums whose
+best candidate scores below '-match-threshold' (from 0 to 1) are reported as
+unidentified and their tags are left untouched.
+
+With '-interactive', the best candidates are listed with their score details for
+every album, and the user can choose one of them, skip the album or enter a
+MusicBrainz release ID. The choice applies to all the files of the album. When
+no terminal is available, e.g. from cron, the best candidate is used only if it
+scores at least '-match-threshold'.
+
+Multi-track files (e.g. an album image with a cuesheet) are identified as a
+whole: every audio track is fingerprinted and the release disc with the same
+number of audio tracks and matching durations is used to tag all the tracks.
+Like for other files, the disc must score at least '-match-threshold', or be
+chosen by the user with '-interactive'. Data tracks are left untagged.
+
+The results of the online queries are cached on disk in
+
+	$XDG_CACHE_HOME/demlo (Default: $HOME/.cache/demlo)
+
+so that subsequent runs over the same files do not need to fingerprint and query
+them again. Entries expire after the number of days specified with '-cache-ttl'
+(or 'CacheTTL' in the configuration). The cache is pruned down to 'CacheSize'
+MiB at the end of the run, oldest entries first. Use '-cache-clear' to start
+afresh.
+
+
+
+LYRICS
+
+With '-lyrics', the lyrics of single-track files are looked up by artist,
+title, album and duration. The tags fetched online with '-t' take precedence
+over the input tags, so that identified recordings get the right lyrics. The
+lyrics providers listed in the 'LyricsProviders' configuration option are tried
+in order until one of them has lyrics:
+
+	local   The '.lrc' file next to the input file, then the '.lrc' and '.txt'
+	        files of the '-lyrics-dir' folder. They are named after the artist
+	        and the title, e.g. 'Artist - Title.lrc' or 'Artist/Title.lrc'.
+	        Case and punctuation are ignored.
+	lrclib  The LRCLIB database. Use '-lrclib-url' for a mirror.
+
+The lyrics are stored in the 'input.lyrics' table:
+
+	lyrics = {
+	   plain = '', -- Plain text.
+	   synced = '', -- LRC format, with a timestamp per line. Empty if unknown.
+	   source = '', -- Name of the provider.
+	}
+
+Scripts choose where the lyrics go: the 'lyrics' tag, or the sidecar LRC file
+with 'output.lrc'. See the 'tag-lyrics' script.
+
+
+
+WATCH MODE
+
+With '-watch', Demlo processes the files passed as argument as usual, then keeps
+running and processes the files that are added later to the folders passed as
+argument, including new subfolders. This is useful to process an incoming
+folder where downloads land, for instance:
+
+	demlo -p -watch -s remove_source ~/incoming
+
+A new file is only processed once it has not been modified for '-watch-delay'
+seconds, so that partially written files are ignored. The online caches are kept
+for the whole run: tracks of an album arriving together are identified with a
+single online query. The files written by Demlo itself, e.g. output files in a
+watched folder or tags changed in place, are not processed again unless they are
+modified afterwards. Watch mode is only supported on Linux.
+
+
+
+PROGRESS
+
+With '-progress', Demlo displays the number of processed files out of the input
+files, the number of analyzed, written, skipped and failed files, the bytes
+written, the throughput and the estimated remaining time:
+
+	demlo -p -progress ~/music
+
+On a terminal, the progress is a status line below the log output, refreshed
+every second. Otherwise, e.g. when stderr is redirected to a file, a progress
+line is printed every '-progress-interval' seconds. The input files are counted
+beforehand to estimate the remaining time, except in watch mode. The progress is
+not displayed in interactive mode.
+
+
+
+EVENTS
+
+With '-events json', Demlo prints to stdout a machine-readable stream of the
+pipeline progress and results, one JSON object per line:
+
+	{"time":"...","stage":"transformer","type":"transcoded","path":"/input/file","track":1,"output":"/output/file"}
+
+The 'stage' is one of 'walker', 'analyzer', 'transformer' or 'dedupe'. The
+'type' is one of 'discovered', 'skipped', 'failed', 'probed', 'scripts_failed',
+'analyzed', 'transcoded', 'tagged', 'cover_written', 'lyrics_written',
+'source_removed' and 'duplicate'. The 'track' starts from 1, it is omitted
+when the event concerns the whole file. Events may also hold a 'status' ('ok',
+'fail' or 'exist'), an 'output' path and an 'error' message.
+
+With '-dedupe', a 'duplicate' event is printed for every copy instead of the
+report. Its 'output' is the kept copy, or the first copy if none is kept. The
+kept copy has the 'keep' status.
+
+The index is not printed to stdout when events are enabled. Use '-o' to write
+it to a file.
+
 
 
 INDEX
@@ -312,6 +658,28 @@ This feature can also be used to interface Demlo with other programs.
 
 
 
+SUMMARY AND EXIT STATUS
+
+At the end of the run, Demlo prints a summary: the number of processed files,
+of skipped files (duplicates and files processed by a resumed run), of files
+suffixed because their destination existed, and of failed files. The failures
+are counted by reason:
+
+- input: the file could not be read.
+- probe: FFprobe or the cover analysis failed.
+- scripts: a script failed.
+- transform: transcoding, copying or tagging failed.
+- cover: a cover could not be transferred.
+
+The failed files are then listed with their reasons. The exit status is
+
+- 0 if no file failed,
+- 1 on fatal errors, e.g. an invalid option,
+- 2 if some files failed,
+- 3 if all files failed.
+
+
+
 EXAMPLES
 
 The following examples will not proceed unless the '-p' command-line option is
@@ -0,0 +1,81 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const (
+	eventsJSON = "json"
+
+	stageWalker      = "walker"
+	stageAnalyzer    = "analyzer"
+	stageTransformer = "transformer"
+
+	eventDiscovered    = "discovered"
+	eventSkipped       = "skipped"
+	eventFailed        = "failed"
+	eventProbed        = "probed"
+	eventScriptsFailed = "scripts_failed"
+	eventAnalyzed      = "analyzed"
+	eventTranscoded    = "transcoded"
+	eventTagged        = "tagged"
+	eventCoverWritten  = "cover_written"
+	eventLyricsWritten = "lyrics_written"
+	eventSourceRemoved = "source_removed"
+)
+
+// Event is a machine-readable record of what happened to a file in a pipeline
+// stage. With '-events json', events are printed to stdout, one JSON object per
+// line.
+// 'Track' starts from 1. It is 0 when the event concerns the whole file.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Type   string    `json:"type"`
+	Path   string    `json:"path"`
+	Track  int       `json:"track,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Output string    `json:"output,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var eventEncoder = json.NewEncoder(os.Stdout)
+
+// emitEvent prints 'e' if events are enabled. The path, if unset, and the time
+// are set from 'fr'. 'err' can be nil.
+func emitEvent(fr *FileRecord, e Event, err error) {
+	progress.Event(fr, e)
+	report.Event(fr, e)
+	if options.Events != eventsJSON {
+		return
+	}
+	e.Time = time.Now()
+	if e.Path == "" {
+		e.Path = fr.input.path
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	stdoutMutex.Lock()
+	// Encoding should never fail.
+	_ = eventEncoder.Encode(e)
+	stdoutMutex.Unlock()
+}
+
+func (s outputStatus) String() string {
+	switch s {
+	case statusOK:
+		return "ok"
+	case statusFail:
+		return "fail"
+	case statusExist:
+		return "exist"
+	}
+	return ""
+}
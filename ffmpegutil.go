@@ -9,6 +9,14 @@ import (
 	"github.com/ambrevar/demlo/cuesheet"
 )
 
+// Gap modes: where the pregap of a track, i.e. the audio between its indices 0
+// and 1, goes when splitting.
+const (
+	gapsAppend  = "append"
+	gapsPrepend = "prepend"
+	gapsDiscard = "discard"
+)
+
 /* ffmpegSplitTimes returns the starting time and duration (in FFmpeg CLI format) of a track in a multi-track file.
 
 Since a cuesheet does not contain the total duration, we cannot infere last
@@ -18,47 +26,58 @@ Total duration is a floating value; second is the unit.
 
 First track is track 0.
 
-TODO: We ignore Indices beyond the first one. As a result, it may include
-silences. But always skipping the first index (if there is a second one) might
-not be he desired result either. Finally, there could be more than 2 indices,
-even thought I have no clue to what use. Rationale needed.
+The pregap of a track is appended to the previous track, prepended to the track
+or discarded depending on 'gaps'. Since the first track has no previous track,
+its pregap (e.g. a hidden track) is prepended in append mode. Subindices are
+part of the track.
 */
-func ffmpegSplitTimes(sheet cuesheet.Cuesheet, file string, track int, totalduration float64) (start, duration string) {
+func ffmpegSplitTimes(sheet cuesheet.Cuesheet, file string, track int, totalduration float64, gaps string) (start, duration string) {
+	startmsec, durationmsec, ok := splitTimes(sheet, file, track, totalduration, gaps)
+	if !ok {
+		return "", ""
+	}
+	return ffmpegTime(startmsec), ffmpegTime(durationmsec)
+}
 
-	var totalmsec int
+// splitTimes is like ffmpegSplitTimes but returns milliseconds. It returns
+// false if the track does not exist.
+func splitTimes(sheet cuesheet.Cuesheet, file string, track int, totalduration float64, gaps string) (start, duration int, ok bool) {
+	tracks := sheet.Files[file]
+	if track >= len(tracks) {
+		return 0, 0, false
+	}
 
-	if sheet.Files[file] == nil {
-		return "", ""
+	// Index 0 if any, index 1 otherwise.
+	pregapStart := func(t cuesheet.Track) int {
+		if index, ok := t.Index(0); ok {
+			return index.Msecs()
+		}
+		return t.Start().Msecs()
 	}
-	if track >= len(sheet.Files[file]) {
-		return "", ""
+
+	if gaps == gapsPrepend || (gaps == gapsAppend && track == 0) {
+		start = pregapStart(tracks[track])
+	} else {
+		start = tracks[track].Start().Msecs()
 	}
-	if track < len(sheet.Files[file])-1 {
+
+	var totalmsec int
+	if track < len(tracks)-1 {
 		// Not last track
-		min := sheet.Files[file][track+1].Indices[0].Min
-		sec := sheet.Files[file][track+1].Indices[0].Sec
-		msec := sheet.Files[file][track+1].Indices[0].Msec
-		totalmsec = (1000*60*min + 1000*sec + msec)
+		next := tracks[track+1]
+		if gaps == gapsAppend {
+			totalmsec = next.Start().Msecs()
+		} else {
+			totalmsec = pregapStart(next)
+		}
 	} else {
 		totalmsec = int(totalduration * 1000)
 	}
 
-	min := sheet.Files[file][track].Indices[0].Min
-	sec := sheet.Files[file][track].Indices[0].Sec
-	msec := sheet.Files[file][track].Indices[0].Msec
-
-	diff := totalmsec - (1000*60*min + 1000*sec + msec)
-
-	dmsec := diff % 1000
-	diff /= 1000
-	dsec := diff % 60
-	diff /= 60
-	dmin := diff % 60
-	dhour := diff / 60
-
-	hour := min / 60
-	min = min % 60
+	return start, totalmsec - start, true
+}
 
-	return fmt.Sprintf("%02d:%02d:%02d.%03d", hour, min, sec, msec),
-		fmt.Sprintf("%02d:%02d:%02d.%03d", dhour, dmin, dsec, dmsec)
+// ffmpegTime returns 'msec' in the 'hh:mm:ss.mmm' format.
+func ffmpegTime(msec int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", msec/(1000*60*60), msec/(1000*60)%60, msec/1000%60, msec%1000)
 }
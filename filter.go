@@ -0,0 +1,233 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Input file selection.
+//
+// When folders are browsed, the files with a known extension are selected by
+// path patterns, modification time and size. The 'filter' Lua predicate is
+// evaluated later, once the files have been probed.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+const (
+	actionFilter = "filter"
+
+	// Prefix of the regexp path patterns.
+	patternRegexp = "re:"
+)
+
+var (
+	errFiltered = errors.New("excluded by the filter")
+
+	selection fileSelection
+)
+
+// pathPattern is a glob or a regexp matched against the paths.
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// makePathPattern parses 'arg', a glob or, if prefixed with "re:", a regexp.
+func makePathPattern(arg string) (pathPattern, error) {
+	if strings.HasPrefix(arg, patternRegexp) {
+		re, err := regexp.Compile(strings.TrimPrefix(arg, patternRegexp))
+		return pathPattern{re: re}, err
+	}
+	// Check the syntax.
+	_, err := path.Match(arg, "")
+	return pathPattern{glob: filepath.ToSlash(arg)}, err
+}
+
+// match reports whether the regexp matches a part of 'p', or whether the glob
+// matches a sequence of consecutive components of 'p'. For instance,
+// "Podcasts" and "*.mp3" both match "music/Podcasts/show.mp3".
+func (pp pathPattern) match(p string) bool {
+	if pp.re != nil {
+		return pp.re.MatchString(p)
+	}
+	components := strings.Split(filepath.ToSlash(p), "/")
+	n := strings.Count(pp.glob, "/") + 1
+	for i := 0; i+n <= len(components); i++ {
+		if ok, _ := path.Match(pp.glob, strings.Join(components[i:i+n], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSelection holds the path, time and size criteria of the input files.
+// The zero value selects all files.
+type fileSelection struct {
+	include []pathPattern
+	exclude []pathPattern
+	// Zero values are unbounded.
+	newer   time.Time
+	older   time.Time
+	minSize int64
+	maxSize int64
+}
+
+// makeFileSelection parses the selection options. Times are relative to
+// 'now'.
+func makeFileSelection(o *Options, now time.Time) (fileSelection, error) {
+	var s fileSelection
+	var err error
+	for _, arg := range o.Include {
+		p, err := makePathPattern(arg)
+		if err != nil {
+			return s, fmt.Errorf("include pattern %q: %v", arg, err)
+		}
+		s.include = append(s.include, p)
+	}
+	for _, arg := range o.Exclude {
+		p, err := makePathPattern(arg)
+		if err != nil {
+			return s, fmt.Errorf("exclude pattern %q: %v", arg, err)
+		}
+		s.exclude = append(s.exclude, p)
+	}
+	if s.newer, err = parseTime(o.Newer, now); err != nil {
+		return s, err
+	}
+	if s.older, err = parseTime(o.Older, now); err != nil {
+		return s, err
+	}
+	if s.minSize, err = parseSize(o.MinSize); err != nil {
+		return s, err
+	}
+	if s.maxSize, err = parseSize(o.MaxSize); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Selected reports whether the file at 'path' is selected. The extension is not
+// checked.
+func (s *fileSelection) Selected(path string, info os.FileInfo) bool {
+	if len(s.include) > 0 {
+		included := false
+		for _, p := range s.include {
+			if p.match(path) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, p := range s.exclude {
+		if p.match(path) {
+			return false
+		}
+	}
+
+	if !s.newer.IsZero() && !info.ModTime().After(s.newer) {
+		return false
+	}
+	if !s.older.IsZero() && !info.ModTime().Before(s.older) {
+		return false
+	}
+	if s.minSize > 0 && info.Size() < s.minSize {
+		return false
+	}
+	if s.maxSize > 0 && info.Size() > s.maxSize {
+		return false
+	}
+	return true
+}
+
+// parseTime parses 'arg', either a date ("2006-01-02", "2006-01-02 15:04" or
+// RFC 3339) or a duration before 'now', e.g. "36h", "7d" or "2w". The zero time
+// is returned for the empty string.
+func parseTime(arg string, now time.Time) (time.Time, error) {
+	if arg == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, arg, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(arg, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(arg, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.ParseFloat(arg[:len(arg)-1], 64)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid time %q", arg)
+		}
+		return now.Add(-time.Duration(n * float64(unit))), nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q", arg)
+	}
+	return now.Add(-d), nil
+}
+
+// parseSize parses 'arg', a number of bytes with an optional binary unit, e.g.
+// "500K", "1.5M" or "2G". It returns 0 for the empty string.
+func parseSize(arg string) (int64, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	number := strings.TrimRight(strings.ToUpper(arg), "BI")
+	if number == "" {
+		return 0, fmt.Errorf("invalid size %q", arg)
+	}
+	unit := int64(1)
+	if i := strings.IndexByte("KMGT", number[len(number)-1]); i >= 0 {
+		number = number[:len(number)-1]
+		unit = 1 << (10 * uint(i+1))
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", arg)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// filterInput evaluates the 'filter' action over the probed input of 'fr'. It
+// returns errFiltered if the file is excluded.
+func filterInput(L *lua.State, fr *FileRecord) error {
+	// Multi-track files are filtered as a whole: the track tags are left out.
+	info := fr.input
+	info.tags = map[string]string{}
+	for k, v := range fr.input.filetags {
+		info.tags[k] = v
+	}
+
+	keep, err := RunFilter(L, &info)
+	if err != nil {
+		fr.error.Printf("Filter: %s", err)
+		emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventFailed}, err)
+		return err
+	}
+	if !keep {
+		fr.info.Print("Excluded by the filter")
+		emitEvent(fr, Event{Stage: stageAnalyzer, Type: eventSkipped}, errFiltered)
+		return errFiltered
+	}
+	return nil
+}
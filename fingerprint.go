@@ -12,10 +12,16 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 )
 
+// fpcalc only fingerprints the first 120 seconds by default.
+const fingerprintLength = 120 * 1000
+
 func fingerprint(file string) (fingerprint string, duration int, err error) {
 	if _, err := exec.LookPath("fpcalc"); err != nil {
 		return "", 0, errors.New("fpcalc not found")
@@ -24,6 +30,7 @@ func fingerprint(file string) (fingerprint string, duration int, err error) {
 	cmd := exec.Command("fpcalc", file)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
+	detachProcess(cmd)
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -56,3 +63,69 @@ func fingerprint(file string) (fingerprint string, duration int, err error) {
 	}
 	return string(out), duration, nil
 }
+
+// fingerprintSegment fingerprints the audio of 'file' between 'start' and
+// 'start+duration', in milliseconds. The segment is extracted to a temporary
+// file since fpcalc cannot seek.
+func fingerprintSegment(file string, start, duration int) (string, error) {
+	if duration > fingerprintLength {
+		duration = fingerprintLength
+	}
+
+	fd, err := ioutil.TempFile("", "demlo")
+	if err != nil {
+		return "", err
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+
+	cmd := exec.Command("ffmpeg", "-nostdin", "-v", "error", "-y",
+		"-ss", ffmpegTime(start), "-t", ffmpegTime(duration), "-i", file,
+		"-map", "0:a:0", "-f", "wav", fd.Name())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	detachProcess(cmd)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("segment extraction: %s", stderr.String())
+	}
+
+	fingerprint, _, err := fingerprint(fd.Name())
+	return fingerprint, err
+}
+
+// fingerprintRaw returns the uncompressed fingerprint of 'file', as needed to
+// compare fingerprints, and its duration in seconds.
+func fingerprintRaw(file string) (fingerprint []uint32, duration int, err error) {
+	cmd := exec.Command("fpcalc", "-raw", file)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	detachProcess(cmd)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, 0, fmt.Errorf("fingerprint: %s", stderr.String())
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "DURATION="):
+			duration, err = strconv.Atoi(strings.TrimPrefix(line, "DURATION="))
+			if err != nil {
+				return nil, 0, err
+			}
+		case strings.HasPrefix(line, "FINGERPRINT="):
+			for _, v := range strings.Split(strings.TrimPrefix(line, "FINGERPRINT="), ",") {
+				// Older versions of fpcalc print signed integers.
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return nil, 0, fmt.Errorf("fingerprint: %v", err)
+				}
+				fingerprint = append(fingerprint, uint32(n))
+			}
+		}
+	}
+	if len(fingerprint) == 0 {
+		return nil, 0, errors.New("fingerprint: empty fingerprint")
+	}
+	return fingerprint, duration, nil
+}
@@ -0,0 +1,134 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Album grouping.
+//
+// The scripts are run per track and cannot see the other tracks of the album.
+// When grouping is enabled, the FileRecords are held between the preparer and
+// the analyzer until all the records of their group are prepared. The inputs of
+// the group are then exposed to the scripts in the 'album' table.
+//
+// Groups are either the folders, which the producer knows in advance, or the
+// albums as identified by their AlbumKey, which can only be known once all the
+// files have been prepared.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	groupNone   = "none"
+	groupFolder = "folder"
+	groupAlbum  = "album"
+)
+
+// fileGroup holds the FileRecords of a group until all of them have either
+// arrived or been discarded. 'size' must be set before any record of the group
+// is fed to the pipeline.
+type fileGroup struct {
+	size    int
+	records []*FileRecord
+	dropped int
+	sync.Mutex
+}
+
+// add registers the arrival of 'fr' in the group, or its removal if 'fr' is nil.
+// It returns the records of the group once it is complete, nil otherwise.
+func (g *fileGroup) add(fr *FileRecord) []*FileRecord {
+	g.Lock()
+	defer g.Unlock()
+	if fr == nil {
+		g.dropped++
+	} else {
+		g.records = append(g.records, fr)
+	}
+	if len(g.records)+g.dropped < g.size {
+		return nil
+	}
+	return g.records
+}
+
+// walkGroups walks 'root' like RealPathWalk and calls 'visit' once per folder
+// with its regular files, in lexical order, as soon as the folder and its
+// subfolders have been walked.
+func walkGroups(root string, visit func(paths []string)) {
+	sep := string(filepath.Separator)
+	var stack []string
+	files := map[string][]string{}
+
+	flush := func(dir string) {
+		if len(files[dir]) > 0 {
+			visit(files[dir])
+		}
+		delete(files, dir)
+	}
+
+	// 'walk' always keeps going, so no error.
+	_ = RealPathWalk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Flush the folders that do not contain 'path'.
+		for len(stack) > 0 && !strings.HasPrefix(path, strings.TrimSuffix(stack[len(stack)-1], sep)+sep) {
+			flush(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		}
+		if info.IsDir() {
+			stack = append(stack, path)
+		} else if info.Mode().IsRegular() {
+			dir := filepath.Dir(path)
+			files[dir] = append(files[dir], path)
+		}
+		return nil
+	})
+
+	for len(stack) > 0 {
+		flush(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+	}
+	// 'root' is a file.
+	for dir := range files {
+		flush(dir)
+	}
+}
+
+// setAlbum exposes the inputs of 'records' to each of them. Multi-track files
+// provide one input per track.
+func setAlbum(records []*FileRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].input.path < records[j].input.path
+	})
+
+	var album []inputInfo
+	for _, fr := range records {
+		for track := 0; track < fr.input.trackCount; track++ {
+			info := fr.input
+			info.tags = map[string]string{}
+			prepareTrackTags(&info, track)
+			album = append(album, info)
+		}
+	}
+
+	for _, fr := range records {
+		fr.album = album
+	}
+}
+
+// groupByAlbum calls setAlbum over the records sharing the same AlbumKey. The
+// file tags are used so that multi-track files are grouped by their album.
+func groupByAlbum(records []*FileRecord) {
+	albums := map[AlbumKey][]*FileRecord{}
+	for _, fr := range records {
+		key := makeAlbumKey(&inputInfo{path: fr.input.path, tags: fr.input.filetags})
+		albums[key] = append(albums[key], fr)
+	}
+	for _, album := range albums {
+		setAlbum(album)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Interactive selection of the online release.
+//
+// The user is prompted once per album since the release is memoized by
+// AlbumKey. Prompts are serialized so that parallel analyzers do not mix their
+// questions.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of candidates shown to the user.
+const interactiveCandidates = 5
+
+var (
+	reMBID      = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	promptMutex sync.Mutex
+)
+
+// chooseRelease prompts the user on the terminal to choose the release of the
+// album of 'fr' among 'candidates'. If the terminal cannot be opened, the best
+// candidate is chosen as in non-interactive mode.
+// It returns errReleaseSkipped if the user skips the album.
+func chooseRelease(fr *FileRecord, candidates []releaseCandidate) (ReleaseID, RecordingID, error) {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fr.warning.Print("Cannot prompt for release, use best match: ", err)
+		return bestRelease(candidates)
+	}
+	defer tty.Close()
+
+	return promptRelease(tty, tty, &fr.input, candidates)
+}
+
+// bestRelease returns the first of 'candidates' if it scores at least
+// 'MatchThreshold', errUnidentAlbum otherwise.
+func bestRelease(candidates []releaseCandidate) (ReleaseID, RecordingID, error) {
+	if len(candidates) == 0 || candidates[0].score < options.MatchThreshold {
+		return "", "", errUnidentAlbum
+	}
+	return candidates[0].releaseID, candidates[0].recordingID, nil
+}
+
+// promptRelease writes the candidates to 'w' and reads the choice from 'r'. The
+// default choice is the first candidate, if any, or skipping otherwise. The
+// RecordingID is unknown when a release ID is entered.
+func promptRelease(r io.Reader, w io.Writer, input *inputInfo, candidates []releaseCandidate) (ReleaseID, RecordingID, error) {
+	if len(candidates) > interactiveCandidates {
+		candidates = candidates[:interactiveCandidates]
+	}
+
+	fmt.Fprintf(w, "\nRelease of %q\n", input.path)
+	fmt.Fprintf(w, "Album %q, album artist %q, date %q\n", input.tags["album"], input.tags["album_artist"], input.tags["date"])
+	for k, c := range candidates {
+		provider := providerMusicBrainz
+		if p, _, err := providerOf(c.releaseID); err == nil {
+			provider = p.Name()
+		}
+		fmt.Fprintf(w, "%d) [%s] %s (%d), %d tracks: %q by %q, score %.4g\n", k+1, provider, c.album, c.year, c.trackCount, c.title, c.artist, c.score)
+		for _, line := range strings.Split(strings.TrimSpace(c.details), "\n") {
+			fmt.Fprintf(w, "     %s\n", line)
+		}
+	}
+
+	def := "s"
+	choices := "'s' to skip"
+	if len(candidates) > 0 {
+		def = "1"
+		choices = fmt.Sprintf("[1-%d], %s", len(candidates), choices)
+	}
+
+	s := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "Choose %s, or enter a MusicBrainz release ID (default: %s): ", choices, def)
+		// The default is used on end of input.
+		answer := def
+		if s.Scan() {
+			answer = strings.TrimSpace(s.Text())
+			if answer == "" {
+				answer = def
+			}
+		}
+
+		if answer == "s" {
+			return "", "", errReleaseSkipped
+		}
+		if id := reMBID.FindString(answer); id != "" {
+			return ReleaseID(strings.ToLower(id)), "", nil
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(candidates) {
+			return candidates[n-1].releaseID, candidates[n-1].recordingID, nil
+		}
+		fmt.Fprintf(w, "Invalid choice %q\n", answer)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Record the file system changes made by the transformer so that a run can be
+// reverted.
+//
+// The journal is a sequence of JSON objects, one per line, appended as the
+// changes happen. Reverting processes the entries in reverse order. Removed
+// sources, overwritten destinations and the originals of in-place transcoding
+// are moved to the trash folder, so that they are restored like any moved file.
+// Older journals may record removals that cannot be reverted: those are
+// reported, and the outputs of a removed source are kept since they are the
+// only copies left.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/ambrevar/demlo/tagwriter"
+)
+
+const (
+	journalCreate = "create" // 'dst' was created.
+	journalMove   = "move"   // 'src' was moved to 'dst'.
+	journalTags   = "tags"   // Tags of 'dst' were changed in place, 'tags' are the former tags.
+)
+
+// Actions of older journals, the lost data cannot be restored.
+const (
+	journalInplace   = "inplace"   // 'dst' was transcoded in place, 'tags' are the former tags.
+	journalOverwrite = "overwrite" // 'dst' existed and was overwritten.
+	journalRemove    = "remove"    // 'src' was removed.
+)
+
+var journal Journal
+
+// JournalEntry describes one change on the file system.
+type JournalEntry struct {
+	Action string            `json:"action"`
+	Src    string            `json:"src,omitempty"`
+	Dst    string            `json:"dst,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// Journal writes the changes of the transformer as they happen, so that they
+// survive an interruption. Without '-p' no journal is opened, and the changes
+// are not recorded.
+type Journal struct {
+	f   *os.File
+	enc *json.Encoder
+	sync.Mutex
+}
+
+// OpenJournal opens 'path' for appending.
+func OpenJournal(path string) (Journal, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return Journal{}, err
+	}
+	return Journal{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends 'e' to the journal.
+// Errors are reported to 'fr' since they should not abort the transformation.
+func (j *Journal) Record(fr *FileRecord, e JournalEntry) {
+	if j.f == nil {
+		return
+	}
+	j.Lock()
+	err := j.enc.Encode(e)
+	j.Unlock()
+	if err != nil {
+		fr.warning.Print("journal: ", err)
+	}
+}
+
+// Close the journal file.
+func (j *Journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// Undo reverts the changes recorded in the journal at 'path'.
+// If 'apply' is false, only print what would be done.
+func Undo(path string, apply bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, indexMaxsize)
+	for line := 1; s.Scan(); line++ {
+		var e JournalEntry
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	failed := false
+	// Sources that cannot be restored.
+	lost := map[string]bool{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Action == journalCreate && lost[e.Src] {
+			warning.Printf("keep %q: its source %q cannot be restored", e.Dst, e.Src)
+			failed = true
+			continue
+		}
+		err := undoEntry(e, apply)
+		if err != nil {
+			warning.Print(err)
+			failed = true
+			if e.Action == journalRemove {
+				lost[e.Src] = true
+			}
+		}
+	}
+	if failed {
+		return errors.New("some changes could not be reverted")
+	}
+	return nil
+}
+
+func undoEntry(e JournalEntry, apply bool) error {
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	switch e.Action {
+	case journalCreate:
+		if !exists(e.Dst) {
+			return nil
+		}
+		log.Printf("Remove %q", e.Dst)
+		if apply {
+			return os.Remove(e.Dst)
+		}
+
+	case journalMove:
+		if exists(e.Src) {
+			return fmt.Errorf("cannot move %q back: %q exists", e.Dst, e.Src)
+		}
+		if !exists(e.Dst) {
+			return fmt.Errorf("cannot move %q back: file is missing", e.Dst)
+		}
+		log.Printf("Move %q to %q", e.Dst, e.Src)
+		if apply {
+			err := os.Rename(e.Dst, e.Src)
+			if err != nil {
+				// Cross-device move.
+				f, err := os.OpenFile(e.Src, os.O_CREATE|os.O_EXCL, 0666)
+				if err != nil {
+					return err
+				}
+				f.Close()
+				err = CopyFile(e.Src, e.Dst)
+				if err != nil {
+					return err
+				}
+				err = os.Remove(e.Dst)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if e.Tags != nil {
+			return undoTags(e.Src, e.Tags, apply)
+		}
+
+	case journalTags:
+		return undoTags(e.Dst, e.Tags, apply)
+
+	case journalInplace:
+		warning.Printf("cannot restore the audio of %q transcoded in place", e.Dst)
+		return undoTags(e.Dst, e.Tags, apply)
+
+	case journalOverwrite:
+		return fmt.Errorf("cannot restore overwritten file %q", e.Dst)
+
+	case journalRemove:
+		return fmt.Errorf("cannot restore removed file %q", e.Src)
+
+	default:
+		return fmt.Errorf("unknown journal action %q", e.Action)
+	}
+
+	return nil
+}
+
+// undoTags restores the former tags, unless they are already set.
+func undoTags(path string, tags map[string]string, apply bool) error {
+	if current, err := tagwriter.Read(path); err == nil && reflect.DeepEqual(current, tags) {
+		return nil
+	}
+	log.Printf("Restore tags of %q", path)
+	if !apply {
+		return nil
+	}
+	return tagwriter.Write(path, tags)
+}
@@ -0,0 +1,271 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Loudness analysis with FFmpeg's EBU R128 filter.
+//
+// Album values are computed over the tracks of the same folder that share the
+// AlbumKey of the analyzed file, whether they are part of the run or not. The
+// album loudness is the duration-weighted energy mean of the track loudnesses,
+// which is a close approximation of the loudness of the concatenated tracks.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reference level of ReplayGain 2.0, in LUFS.
+const replayGainReference = -18
+
+var (
+	reLoudnessIntegrated = regexp.MustCompile(`(?m)^\s*I:\s*(-?[0-9.]+|-inf) LUFS`)
+	reLoudnessRange      = regexp.MustCompile(`(?m)^\s*LRA:\s*(-?[0-9.]+) LU`)
+	reLoudnessPeak       = regexp.MustCompile(`(?m)^\s*Peak:\s*(-?[0-9.]+|-inf) dBFS`)
+
+	errLoudnessSummary = errors.New("no loudness summary in FFmpeg output")
+
+	loudnessCache = LoudnessCache{
+		tracks: map[string]*trackLoudnessEntry{},
+		albums: map[albumLoudnessKey]*albumLoudnessEntry{},
+	}
+)
+
+// loudnessInfo is exposed to the scripts as 'input.loudness'.
+// Loudness values are in LUFS, the range is in LU and the gains are in dB
+// relative to the ReplayGain 2.0 reference (-18 LUFS). Peaks are true peaks
+// with a linear scale, 1.0 being full scale.
+type loudnessInfo struct {
+	integrated      float64 `lua:"integrated"`
+	lra             float64 `lua:"range"`
+	peak            float64 `lua:"peak"`
+	trackGain       float64 `lua:"trackgain"`
+	albumIntegrated float64 `lua:"albumintegrated"`
+	albumPeak       float64 `lua:"albumpeak"`
+	albumGain       float64 `lua:"albumgain"`
+}
+
+type trackLoudness struct {
+	integrated float64
+	lra        float64
+	peak       float64
+	// In seconds, used as weight for the album loudness.
+	duration float64
+}
+
+type trackLoudnessEntry struct {
+	loudness trackLoudness
+	err      error
+	ready    chan struct{}
+}
+
+type albumLoudnessKey struct {
+	dir   string
+	album AlbumKey
+}
+
+type albumLoudnessEntry struct {
+	loudness trackLoudness
+	ready    chan struct{}
+}
+
+// LoudnessCache memoizes the analysis of the tracks and albums so that each
+// file is analyzed only once, even when it is the sibling of several processed
+// files.
+type LoudnessCache struct {
+	tracks map[string]*trackLoudnessEntry
+	albums map[albumLoudnessKey]*albumLoudnessEntry
+	sync.Mutex
+}
+
+func (c *LoudnessCache) track(fr *FileRecord, path string, duration float64) (trackLoudness, error) {
+	c.Lock()
+	e := c.tracks[path]
+	if e == nil {
+		e = &trackLoudnessEntry{ready: make(chan struct{})}
+		c.tracks[path] = e
+		c.Unlock()
+		e.loudness, e.err = analyzeLoudness(fr, path)
+		e.loudness.duration = duration
+		close(e.ready)
+	} else {
+		c.Unlock()
+		<-e.ready
+	}
+	return e.loudness, e.err
+}
+
+func (c *LoudnessCache) album(fr *FileRecord, input *inputInfo) trackLoudness {
+	key := albumLoudnessKey{dir: filepath.Dir(input.path), album: makeAlbumKey(input)}
+
+	c.Lock()
+	e := c.albums[key]
+	if e == nil {
+		e = &albumLoudnessEntry{ready: make(chan struct{})}
+		c.albums[key] = e
+		c.Unlock()
+		e.loudness = c.analyzeAlbum(fr, key)
+		close(e.ready)
+	} else {
+		c.Unlock()
+		<-e.ready
+	}
+	return e.loudness
+}
+
+// analyzeAlbum analyzes the single-track files of 'key.dir' which belong to
+// 'key.album'. Siblings that cannot be analyzed are skipped.
+func (c *LoudnessCache) analyzeAlbum(fr *FileRecord, key albumLoudnessKey) trackLoudness {
+	fd, err := os.Open(key.dir)
+	if err != nil {
+		fr.warning.Print(err)
+		return trackLoudness{}
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		fr.warning.Print(err)
+		return trackLoudness{}
+	}
+
+	var energy, duration float64
+	album := trackLoudness{integrated: math.Inf(-1)}
+	for _, name := range names {
+		if !options.Extensions[strings.ToLower(Ext(name))] {
+			continue
+		}
+		info := inputInfo{path: filepath.Join(key.dir, name)}
+		if prepareInput(fr, &info) != nil || info.trackCount != 1 {
+			continue
+		}
+		prepareTrackTags(&info, 1)
+		if makeAlbumKey(&info) != key.album {
+			continue
+		}
+
+		l, err := c.track(fr, info.path, infoDuration(&info))
+		if err != nil {
+			fr.warning.Printf("Loudness analysis of %q: %v", info.path, err)
+			continue
+		}
+		energy += l.duration * math.Pow(10, l.integrated/10)
+		duration += l.duration
+		album.peak = math.Max(album.peak, l.peak)
+	}
+
+	if duration > 0 && energy > 0 {
+		album.integrated = 10 * math.Log10(energy/duration)
+	}
+	album.duration = duration
+	return album
+}
+
+// infoDuration returns the duration in seconds of the first audio stream, or
+// of the file if the stream does not say.
+func infoDuration(info *inputInfo) float64 {
+	if info.audioIndex >= 0 && info.audioIndex < len(info.Streams) {
+		if s, ok := info.Streams[info.audioIndex]["duration"].(string); ok {
+			if d, err := strconv.ParseFloat(s, 64); err == nil {
+				return d
+			}
+		}
+	}
+	if s, ok := info.Format["duration"].(string); ok {
+		if d, err := strconv.ParseFloat(s, 64); err == nil {
+			return d
+		}
+	}
+	return 0
+}
+
+// analyzeLoudness runs the EBU R128 filter on the first audio stream of 'path'.
+func analyzeLoudness(fr *FileRecord, path string) (trackLoudness, error) {
+	cmdArray := []string{"-nostdin", "-hide_banner", "-nostats", "-i", path, "-map", "0:a:0", "-af", "ebur128=peak=true", "-f", "null", "-"}
+	fr.debug.Printf("FFmpeg parameters: %q", cmdArray)
+	cmd := exec.Command("ffmpeg", cmdArray...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	detachProcess(cmd)
+	err := cmd.Run()
+	if err != nil {
+		return trackLoudness{}, errors.New(stderr.String())
+	}
+	return parseLoudnessSummary(stderr.String())
+}
+
+// parseLoudnessSummary parses the summary printed by the 'ebur128' filter.
+func parseLoudnessSummary(out string) (trackLoudness, error) {
+	var l trackLoudness
+
+	// Only consider the summary, not the per-frame logs.
+	i := strings.LastIndex(out, "Summary:")
+	if i < 0 {
+		return l, errLoudnessSummary
+	}
+	out = out[i:]
+
+	parse := func(re *regexp.Regexp) (float64, error) {
+		m := re.FindStringSubmatch(out)
+		if m == nil {
+			return 0, errLoudnessSummary
+		}
+		if m[1] == "-inf" {
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(m[1], 64)
+	}
+
+	var err error
+	if l.integrated, err = parse(reLoudnessIntegrated); err != nil {
+		return l, err
+	}
+	if l.lra, err = parse(reLoudnessRange); err != nil {
+		return l, err
+	}
+	peak, err := parse(reLoudnessPeak)
+	if err != nil {
+		return l, err
+	}
+	l.peak = math.Pow(10, peak/20)
+	return l, nil
+}
+
+// getLoudness sets 'input.loudness'. Only single-track files are supported. The
+// track tags must be prepared since they are needed to find the album.
+func getLoudness(fr *FileRecord) {
+	input := &fr.input
+
+	track, err := loudnessCache.track(fr, input.path, infoDuration(input))
+	if err != nil {
+		fr.warning.Print("Loudness analysis: ", err)
+		return
+	}
+	if math.IsInf(track.integrated, -1) {
+		fr.warning.Print("Loudness analysis: track is silent")
+		return
+	}
+	album := loudnessCache.album(fr, input)
+	if album.duration == 0 || math.IsInf(album.integrated, -1) {
+		// The file itself could not be found among its siblings, e.g. if its
+		// extension is not in the list.
+		album = track
+	}
+
+	input.loudness = &loudnessInfo{
+		integrated:      track.integrated,
+		lra:             track.lra,
+		peak:            track.peak,
+		trackGain:       replayGainReference - track.integrated,
+		albumIntegrated: album.integrated,
+		albumPeak:       album.peak,
+		albumGain:       replayGainReference - album.integrated,
+	}
+}
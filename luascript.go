@@ -166,30 +166,21 @@ func outputNumbersToStrings(L *lua.State) {
 
 // RunAction is similar to RunScript.
 func RunAction(L *lua.State, action string, input *inputInfo, output *outputInfo, exist *inputInfo) error {
-	return run(L, registryActions, action, input, output, exist)
+	return run(L, registryActions, action, input, output, exist, nil)
 }
 
 // RunScript executes script named 'script' with 'input' and 'output' set as global variable.
 // Any change made to 'input' is discarded. Change to 'output' are transferred
 // back to Go on every script call to guarantee type consistency across script
 // calls (Lua is dynamically typed).
-func RunScript(L *lua.State, script string, input *inputInfo, output *outputInfo) error {
-	return run(L, registryScripts, script, input, output, nil)
+// The inputs of the album, if any, are set in the 'album' global variable.
+func RunScript(L *lua.State, script string, input *inputInfo, output *outputInfo, album []inputInfo) error {
+	return run(L, registryScripts, script, input, output, nil, album)
 }
 
-// 'exist' is optional.
-func run(L *lua.State, registryIndex string, code string, input *inputInfo, output *outputInfo, exist *inputInfo) error {
-	// Restore the sandbox.
-	err := L.DoString(luaRestoreSandbox)
-	if err != nil {
-		log.Fatal("Cannot load function to restore sandbox", err)
-	}
-	L.PushString(registryWhitelist)
-	L.GetTable(lua.LUA_REGISTRYINDEX)
-	err = L.Call(1, 0)
-	if err != nil {
-		log.Fatal("Failed to restore sandbox", err)
-	}
+// 'exist' and 'album' are optional.
+func run(L *lua.State, registryIndex string, code string, input *inputInfo, output *outputInfo, exist *inputInfo, album []inputInfo) error {
+	restoreSandbox(L)
 
 	goToLua(L, "input", *input)
 	goToLua(L, "output", *output)
@@ -197,6 +188,9 @@ func run(L *lua.State, registryIndex string, code string, input *inputInfo, outp
 	if exist != nil {
 		goToLua(L, "existinfo", *exist)
 	}
+	if album != nil {
+		goToLua(L, "album", album)
+	}
 
 	// Shortcut (mostly for prescript and postscript).
 	L.GetGlobal("input")
@@ -208,7 +202,90 @@ func run(L *lua.State, registryIndex string, code string, input *inputInfo, outp
 	L.SetGlobal("o")
 	L.Pop(1)
 
-	// Call the compiled script.
+	err := call(L, registryIndex, code)
+	if err != nil {
+		return err
+	}
+
+	// Allow tags to be numbers for convenience.
+	outputNumbersToStrings(L)
+
+	L.GetGlobal("output")
+	err = luar.LuaToGo(L, -1, &output)
+	L.Pop(1)
+	return err
+}
+
+// RunDedupeAction runs 'action' with the copies of a recording set in the
+// 'duplicates' global variable. It returns the index of the copy to keep as set
+// in the 'keep' global variable by the action, starting from 1, or 0 if unset.
+func RunDedupeAction(L *lua.State, action string, duplicates []inputInfo) (int, error) {
+	restoreSandbox(L)
+	goToLua(L, "duplicates", duplicates)
+
+	err := call(L, registryActions, action)
+	if err != nil {
+		return 0, err
+	}
+
+	L.GetGlobal("keep")
+	defer L.Pop(1)
+	if L.IsNil(-1) {
+		return 0, nil
+	}
+	if !L.IsNumber(-1) {
+		return 0, fmt.Errorf("'keep' is not a number")
+	}
+	keep := L.ToInteger(-1)
+	if keep < 0 || keep > len(duplicates) {
+		return 0, fmt.Errorf("'keep' is out of range: %v", keep)
+	}
+	return keep, nil
+}
+
+// RunFilter evaluates the 'filter' action, a Lua expression, over 'input'. It
+// returns whether the file is kept.
+func RunFilter(L *lua.State, input *inputInfo) (bool, error) {
+	restoreSandbox(L)
+	goToLua(L, "input", *input)
+	L.GetGlobal("input")
+	L.GetField(-1, "tags")
+	L.SetGlobal("i")
+	L.Pop(1)
+
+	L.PushString(registryActions)
+	L.GetTable(lua.LUA_REGISTRYINDEX)
+	L.GetField(-1, actionFilter)
+	if !L.IsFunction(-1) {
+		L.Pop(2)
+		return true, nil
+	}
+	err := L.Call(0, 1)
+	if err != nil {
+		L.SetTop(0)
+		return false, fmt.Errorf("%s", err)
+	}
+	keep := L.ToBoolean(-1)
+	L.Pop(2)
+	return keep, nil
+}
+
+// restoreSandbox purges the global variables left by the previous call.
+func restoreSandbox(L *lua.State) {
+	err := L.DoString(luaRestoreSandbox)
+	if err != nil {
+		log.Fatal("Cannot load function to restore sandbox", err)
+	}
+	L.PushString(registryWhitelist)
+	L.GetTable(lua.LUA_REGISTRYINDEX)
+	err = L.Call(1, 0)
+	if err != nil {
+		log.Fatal("Failed to restore sandbox", err)
+	}
+}
+
+// call runs the compiled 'code' stored in 'registryIndex'.
+func call(L *lua.State, registryIndex string, code string) error {
 	L.PushString(registryIndex)
 	L.GetTable(lua.LUA_REGISTRYINDEX)
 	L.PushString(code)
@@ -227,14 +304,7 @@ func run(L *lua.State, registryIndex string, code string, input *inputInfo, outp
 		L.Pop(1)
 	}
 	L.Pop(1)
-
-	// Allow tags to be numbers for convenience.
-	outputNumbersToStrings(L)
-
-	L.GetGlobal("output")
-	err = luar.LuaToGo(L, -1, &output)
-	L.Pop(1)
-	return err
+	return nil
 }
 
 // LoadConfig parses the Lua file pointed by 'config' and stores it to options.
@@ -260,11 +330,13 @@ func LoadConfig(config string, options *Options) {
 func PrintScriptHelp(script string) {
 	L := MakeSandbox(log.Println)
 
-	// Scripts expect to receive "input", "output", "i" and "o", even if empty.
+	// Scripts expect to receive "input", "output", "album", "i" and "o", even if
+	// empty.
 	input := inputInfo{}
 	output := outputInfo{}
 	goToLua(L, "input", input)
 	goToLua(L, "output", output)
+	goToLua(L, "album", []inputInfo{input})
 	L.GetGlobal("input")
 	L.GetField(-1, "tags")
 	L.SetGlobal("i")
@@ -0,0 +1,299 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Lyrics fetching.
+//
+// Lyrics are looked up with the artist, title, album and duration of the
+// track, from the providers listed in the 'LyricsProviders' option, in order.
+// The first provider with lyrics wins. Lyrics come in two flavors: plain text
+// and synced, i.e. in the LRC format with a timestamp per line.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	lyricsProviderLocal  = "local"
+	lyricsProviderLRCLIB = "lrclib"
+)
+
+const (
+	defaultLRCLIBURL = "https://lrclib.net"
+	diskCacheLyrics  = "lyrics"
+)
+
+var (
+	// LRC tags, e.g. "[01:02.03]" timestamps or "[ar:Artist]" metadata.
+	reLRCTag = regexp.MustCompile(`^\[[^\]]*\]`)
+	// Timestamps are "[mm:ss]", "[mm:ss.xx]" or "[mm:ss:xx]".
+	reLRCTimestamp = regexp.MustCompile(`(?m)^\[\d+:\d\d([.:]\d+)?\]`)
+
+	errNoLyrics = errors.New("no lyrics found")
+)
+
+var lyricsProviders = map[string]lyricsProvider{
+	lyricsProviderLocal:  &localLyricsProvider{},
+	lyricsProviderLRCLIB: lrclibProvider{},
+}
+
+// lyricsInfo is exposed to the scripts as 'input.lyrics'.
+type lyricsInfo struct {
+	Plain string `lua:"plain"`
+	// In the LRC format, empty if the provider has no synced lyrics.
+	Synced string `lua:"synced"`
+	// Name of the provider.
+	Source string `lua:"source"`
+}
+
+// lyricsQuery identifies the track whose lyrics are looked up.
+type lyricsQuery struct {
+	artist string
+	title  string
+	album  string
+	// In seconds, 0 if unknown.
+	duration int
+	// Path of the input file.
+	path string
+}
+
+// A lyricsProvider is a source of lyrics. Lyrics returns errNoLyrics when the
+// track is unknown to the provider.
+type lyricsProvider interface {
+	Lyrics(q lyricsQuery) (lyricsInfo, error)
+}
+
+// getLyrics sets the lyrics of single-track files from the providers. The
+// online tags, if any, take precedence over the input tags for the query.
+func getLyrics(fr *FileRecord) {
+	input := &fr.input
+	tags := map[string]string{}
+	for k, v := range input.tags {
+		tags[k] = v
+	}
+	if len(fr.defaultTags) > 0 {
+		for k, v := range fr.defaultTags[0] {
+			tags[k] = v
+		}
+	}
+
+	q := lyricsQuery{
+		artist: tags["artist"],
+		title:  tags["title"],
+		album:  tags["album"],
+		path:   input.path,
+	}
+	duration, err := strconv.ParseFloat(fr.Format.Duration, 64)
+	if err == nil {
+		q.duration = int(duration + 0.5)
+	}
+
+	for _, name := range options.LyricsProviders {
+		lyrics, err := lyricsProviders[name].Lyrics(q)
+		if err == errNoLyrics {
+			fr.debug.Printf("No lyrics from %v", name)
+			continue
+		}
+		if err != nil {
+			fr.warning.Printf("Lyrics query error (%v): %v", name, err)
+			continue
+		}
+		fr.debug.Printf("Lyrics from %v", name)
+		lyrics.Source = name
+		input.lyrics = &lyrics
+		return
+	}
+}
+
+// makeLyrics returns the lyrics of an LRC file or of plain text.
+func makeLyrics(text string) lyricsInfo {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if reLRCTimestamp.MatchString(text) {
+		return lyricsInfo{Plain: lrcPlain(text), Synced: text}
+	}
+	return lyricsInfo{Plain: text}
+}
+
+// lrcPlain strips the tags of the LRC lyrics 'lrc'. Metadata lines are
+// removed.
+func lrcPlain(lrc string) string {
+	var lines []string
+	for _, line := range strings.Split(lrc, "\n") {
+		tagged := false
+		for reLRCTag.MatchString(line) {
+			tag := reLRCTag.FindString(line)
+			if !reLRCTimestamp.MatchString(tag) {
+				// Metadata.
+				break
+			}
+			tagged = true
+			line = line[len(tag):]
+		}
+		if reLRCTag.MatchString(line) && !tagged {
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// localLyricsProvider looks up the '.lrc' file next to the input file, then
+// the '.lrc' and '.txt' files of the 'LyricsDir' folder. Files of the folder
+// are named after the artist and the title, e.g. "Artist - Title.lrc" or
+// "Artist/Title.lrc". Names are compared with punctuation and case ignored.
+type localLyricsProvider struct {
+	// Normalized names of the files of 'LyricsDir'.
+	index map[string]string
+	once  sync.Once
+}
+
+func (p *localLyricsProvider) Lyrics(q lyricsQuery) (lyricsInfo, error) {
+	path := StripExt(q.path) + ".lrc"
+	if _, err := os.Stat(path); err != nil {
+		p.once.Do(p.load)
+		path = p.index[stringNorm(q.artist)+stringNorm(q.title)]
+		if path == "" || q.title == "" {
+			return lyricsInfo{}, errNoLyrics
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lyricsInfo{}, err
+	}
+	return makeLyrics(string(buf)), nil
+}
+
+// load indexes the lyrics of 'LyricsDir'.
+func (p *localLyricsProvider) load() {
+	p.index = map[string]string{}
+	if options.LyricsDir == "" {
+		return
+	}
+	filepath.Walk(options.LyricsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			warning.Print(err)
+			return nil
+		}
+		ext := strings.ToLower(Ext(path))
+		if info.IsDir() || (ext != "lrc" && ext != "txt") {
+			return nil
+		}
+		name := stringNorm(StripExt(filepath.Base(path)))
+		if _, ok := p.index[name]; !ok {
+			p.index[name] = path
+		}
+		// "Artist/Title.lrc".
+		name = stringNorm(filepath.Base(filepath.Dir(path))) + name
+		if _, ok := p.index[name]; !ok {
+			p.index[name] = path
+		}
+		return nil
+	})
+}
+
+// lrclibProvider queries the LRCLIB database, see https://lrclib.net/docs.
+type lrclibProvider struct{}
+
+func (lrclibProvider) Lyrics(q lyricsQuery) (lyricsInfo, error) {
+	if q.artist == "" || q.title == "" {
+		return lyricsInfo{}, errNoLyrics
+	}
+	query := url.Values{}
+	query.Set("artist_name", q.artist)
+	query.Set("track_name", q.title)
+	if q.album != "" {
+		query.Set("album_name", q.album)
+	}
+	if q.duration > 0 {
+		query.Set("duration", strconv.Itoa(q.duration))
+	}
+
+	var lyrics lyricsInfo
+	key := query.Encode()
+	if onlineDiskCache.GetJSON(diskCacheLyrics, key, &lyrics) {
+		return lyrics, nil
+	}
+
+	resp, err := serviceGet(lrclibClient, options.LRCLIBURL+"/api/get?"+key)
+	if err != nil {
+		return lyricsInfo{}, errors.New("LRCLIB: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return lyricsInfo{}, errNoLyrics
+	}
+	if resp.StatusCode != http.StatusOK {
+		return lyricsInfo{}, errors.New("LRCLIB: " + resp.Status)
+	}
+
+	var result struct {
+		Instrumental bool   `json:"instrumental"`
+		PlainLyrics  string `json:"plainLyrics"`
+		SyncedLyrics string `json:"syncedLyrics"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return lyricsInfo{}, errors.New("LRCLIB: " + err.Error())
+	}
+	if result.Instrumental || (result.PlainLyrics == "" && result.SyncedLyrics == "") {
+		return lyricsInfo{}, errNoLyrics
+	}
+
+	lyrics = lyricsInfo{Plain: result.PlainLyrics, Synced: result.SyncedLyrics}
+	if lyrics.Plain == "" {
+		lyrics.Plain = lrcPlain(lyrics.Synced)
+	}
+	if err := onlineDiskCache.PutJSON(diskCacheLyrics, key, lyrics); err != nil {
+		warning.Print("cannot cache lyrics: ", err)
+	}
+	return lyrics, nil
+}
+
+// writeLyrics writes the sidecar LRC file of 'track', next to its output.
+// An existing LRC file is only replaced if the output is overwritten, in which
+// case it is backed up so that it can be restored.
+func writeLyrics(fr *FileRecord, track int) error {
+	output := &fr.output[track]
+	dst := StripExt(output.Path) + ".lrc"
+
+	if buf, err := ioutil.ReadFile(dst); err == nil {
+		if string(buf) == output.LRC {
+			return nil
+		}
+		if output.Write != existWriteOver {
+			fr.info.Printf("Keep existing lyrics %q", dst)
+			return nil
+		}
+		f, err := TempFile(filepath.Dir(dst), StripExt(filepath.Base(dst))+"_", ".lrc.bak")
+		if err != nil {
+			return err
+		}
+		backup := f.Name()
+		f.Close()
+		fr.info.Printf("Back up lyrics %q to %q", dst, backup)
+		err = os.Rename(dst, backup)
+		if err != nil {
+			os.Remove(backup)
+			return err
+		}
+		journal.Record(fr, JournalEntry{Action: journalMove, Src: dst, Dst: backup})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	journal.Record(fr, JournalEntry{Action: journalCreate, Dst: dst})
+	fr.info.Printf("Write lyrics to %q", dst)
+	return ioutil.WriteFile(dst, []byte(output.LRC), 0666)
+}
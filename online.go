@@ -2,14 +2,6 @@
 // Use of this file is governed by the license that can be found in LICENSE.
 
 // TODO: Test how memoization scales with caches.
-// TODO: Check if proxy env variables are taken into account for AcoustID and musicbrainz.
-// TODO: Add CLI option to select the online entry to tag from.
-// TODO: Add CLI option to select the tolerance to tag approximation when online-tagging:
-// 0: always use acoustid;
-// 1: check album, artist and date;
-// 2: check album and	artist;
-// 3: check album only;
-// 4: use only 1 album.
 
 // Fetch cover and tags online.
 //
@@ -26,12 +18,17 @@
 // To save some fingerprinting between files of the same album, we index
 // ReleaseIDs by {album, albumartist, date} so that we can query them with tags
 // only.
+//
+// The releases are identified, and their tags and covers fetched, by the
+// providers of provider.go.
 
 package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -40,21 +37,58 @@ import (
 	_ "image/png"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/ambrevar/demlo/acoustid"
-	"github.com/michiwend/gomusicbrainz"
 )
 
-const acoustIDAPIKey = "iOiEFv7y"
+// Default endpoints of the online services. They can be changed to use
+// mirrors.
+const (
+	defaultAcoustIDKey        = "iOiEFv7y"
+	defaultAcoustIDURL        = acoustid.DefaultURL
+	defaultCoverArtArchiveURL = "http://coverartarchive.org"
+	defaultMusicBrainzURL     = "https://musicbrainz.org"
+)
+
+// Tolerance levels when reusing the release of a previous file for a file of a
+// similar album, from the strictest to the loosest.
+const (
+	// Always fingerprint and query AcoustID.
+	toleranceAcoustID = "acoustid"
+	// Check album, album artist and date.
+	toleranceFull = "full"
+	// Check album and album artist.
+	toleranceArtist = "artist"
+	// Check album only.
+	toleranceAlbum = "album"
+	// Use only one album.
+	toleranceAny = "any"
+)
+
+// When 'title' and 'artist' fully match, there is no better result. Thus this
+// accounts for >50%. In case of tie, album and album_artist determines the best
+// subresult. This accounts for >25%. In case of tie, position has more weight
+// than year and duration.
+var defaultMatchWeights = map[string]float64{
+	"title":       26,
+	"artist":      25,
+	"albumartist": 13,
+	"album":       13,
+	"position":    9,
+	"year":        7,
+	"duration":    7,
+}
 
 var (
-	// gomusicbrainz recreates an HTTP transport stream on every connection, thus
-	// inhibiting the benefit of keep-alive connections. TODO: report upstream.
-	musicBrainzClient *gomusicbrainz.WS2Client
+	// MusicBrainz requires a meaningful User-Agent.
+	userAgent = application + "/" + version + " ( " + URL + " )"
 
 	reCover = regexp.MustCompile(`<div class="cover-art"><img src="([^"]+)"`)
 	reYear  = regexp.MustCompile(`\d\d\d\d+`)
@@ -71,12 +105,42 @@ var (
 	tagsCache      = TagsCache{v: map[ReleaseID]*tagsEntry{}}
 	coverCache     = CoverCache{v: map[ReleaseID]*coverEntry{}}
 
-	errMissingCover = errors.New("cover not found")
-	errUnidentAlbum = errors.New("unidentifiable album")
+	errDiscMismatch   = errors.New("no disc matches the track count and durations")
+	errMissingCover   = errors.New("cover not found")
+	errReleaseSkipped = errors.New("album skipped")
+	errUnidentAlbum   = errors.New("unidentifiable album")
 )
 
-func init() {
-	musicBrainzClient, _ = gomusicbrainz.NewWS2Client("https://musicbrainz.org/ws/2", application, version, URL)
+// musicBrainzProvider identifies the releases with AcoustID and fetches their
+// tags from MusicBrainz and their covers from the Cover Art Archive.
+type musicBrainzProvider struct{}
+
+func (musicBrainzProvider) Name() string {
+	return providerMusicBrainz
+}
+
+func (musicBrainzProvider) LookupFingerprint(fr *FileRecord, fp *trackFingerprint) ([]releaseCandidate, error) {
+	fingerprint, duration, err := fp.get()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := newAcoustIDClient().Lookup(context.Background(), fingerprint, duration)
+	if err != nil {
+		return nil, err
+	}
+	return queryAcoustID(fr, meta, duration)
+}
+
+func (musicBrainzProvider) Search(fr *FileRecord) ([]releaseCandidate, error) {
+	return nil, errNotSupported
+}
+
+func (musicBrainzProvider) Release(id string) (Tags, error) {
+	return queryMusicBrainz(ReleaseID(id))
+}
+
+func (musicBrainzProvider) Cover(id string) (Cover, error) {
+	return queryCover(ReleaseID(id))
 }
 
 // AlbumKey is used to cluster tracks by album. The key is used in the lookup
@@ -111,19 +175,30 @@ type Recording struct {
 	duration int
 	title    string
 	track    string
+	// Medium and track positions, used to match multi-track files.
+	disc     int
+	position int
+	// Number of tracks of the medium.
+	trackTotal int
+	// MusicBrainz IDs, empty for other providers.
+	mbid       string
+	artistMBID string
+	isrc       string
 }
 
 // RecordingID is the MusicBrainz ID of a specific track. Different remixes have
 // different RecordingIDs.
-type RecordingID gomusicbrainz.MBID
+type RecordingID string
 
 // ReleaseID is the MusicBrainz ID of a specific album release. Releases in
 // different countries with varying bonus content have different ReleaseIDs.
-type ReleaseID gomusicbrainz.MBID
+type ReleaseID string
 
 type releaseIDEntry struct {
 	releaseID ReleaseID
-	ready     chan struct{}
+	// Set when the user skipped the album in interactive mode.
+	skipped bool
+	ready   chan struct{}
 }
 
 // ReleaseIDCache allows to retrieve the ReleaseID of track for a known album,
@@ -137,12 +212,15 @@ type ReleaseIDCache struct {
 }
 
 // Return the releaseID corresponding most to tags found in 'input'.
-// When the relation is < RELATION_THRESHOLD, return the zero ReleaseID "".
 // The RecordingID comes for free when the release ID is queried, so we might
 // just return it as well.
 func (c *ReleaseIDCache) get(albumKey AlbumKey, fr *FileRecord) (ReleaseID, RecordingID, error) {
+	if options.MatchTolerance == toleranceAcoustID {
+		// Every file is identified on its own.
+		return identifyRelease(fr)
+	}
+
 	var recordingID RecordingID
-	var err error
 
 	c.Lock()
 	e, exactMatch := c.fuzzyMatch(albumKey)
@@ -157,16 +235,19 @@ func (c *ReleaseIDCache) get(albumKey AlbumKey, fr *FileRecord) (ReleaseID, Reco
 			close(e.ready)
 		}()
 
-		fingerprint, duration, err := fingerprint(fr.input.path)
-		if err != nil {
-			return "", "", err
-		}
-		meta, err := acoustid.Get(acoustIDAPIKey, fingerprint, duration)
-		if err != nil {
-			return "", "", err
+		var cachedID string
+		if onlineDiskCache.GetJSON(diskCacheReleaseIDs, albumKey.String(), &cachedID) {
+			fr.debug.Print("Use releaseID from disk cache")
+			e.releaseID = ReleaseID(cachedID)
+			return e.releaseID, "", nil
 		}
+
 		var releaseID ReleaseID
-		recordingID, releaseID, err = queryAcoustID(fr, meta, duration)
+		var err error
+		releaseID, recordingID, err = identifyRelease(fr)
+		if err == errReleaseSkipped {
+			e.skipped = true
+		}
 		if err != nil {
 			return "", "", err
 		}
@@ -174,10 +255,19 @@ func (c *ReleaseIDCache) get(albumKey AlbumKey, fr *FileRecord) (ReleaseID, Reco
 		// Only set e.releaseID when all the queries succeed to guarantee
 		// e.releaseID is either zero or a valid release ID.
 		e.releaseID = releaseID
+		if err := onlineDiskCache.PutJSON(diskCacheReleaseIDs, albumKey.String(), string(releaseID)); err != nil {
+			fr.debug.Print("Cannot store releaseID in disk cache: ", err)
+		}
 	} else {
 		c.Unlock()
 		fr.debug.Print("Wait for cached releaseID")
 		<-e.ready
+		if e.skipped {
+			return "", "", errReleaseSkipped
+		}
+		if e.releaseID == "" {
+			return "", "", errUnidentAlbum
+		}
 
 		if !exactMatch {
 			// If a non-exact match was found, the key is not cache at this point. Add
@@ -192,9 +282,61 @@ func (c *ReleaseIDCache) get(albumKey AlbumKey, fr *FileRecord) (ReleaseID, Reco
 		}
 	}
 
-	return e.releaseID, recordingID, err
+	return e.releaseID, recordingID, nil
 }
 
+// identifyRelease returns the best release found by the providers of the
+// 'Providers' option, or the one chosen by the user in interactive mode. The
+// next provider is tried when the best release of a provider scores below the
+// 'MatchThreshold' option. In interactive mode, the releases of all the
+// providers are proposed.
+func identifyRelease(fr *FileRecord) (ReleaseID, RecordingID, error) {
+	fp := trackFingerprint{path: fr.input.path}
+	var candidates []releaseCandidate
+	var err error
+
+	for _, name := range options.Providers {
+		var c []releaseCandidate
+		c, err = lookupRelease(fr, providers[name], &fp)
+		if err != nil {
+			fr.debug.Printf("Provider %v: %v", name, err)
+			continue
+		}
+
+		if options.Interactive {
+			candidates = append(candidates, c...)
+			continue
+		}
+		if len(c) == 0 {
+			fr.debug.Printf("Provider %v: no release", name)
+			continue
+		}
+		if c[0].score < options.MatchThreshold {
+			fr.debug.Printf("Provider %v: best score %.4g below threshold %v", name, c[0].score, options.MatchThreshold)
+			continue
+		}
+		return c[0].releaseID, c[0].recordingID, nil
+	}
+
+	if options.Interactive && (len(candidates) > 0 || err == nil) {
+		// On equal scores, keep the order of the providers.
+		sortCandidates(candidates)
+		releaseID, recordingID, err := chooseRelease(fr, candidates)
+		if err == nil && releaseID == "" {
+			err = errUnidentAlbum
+		}
+		return releaseID, recordingID, err
+	}
+
+	// Report the error of the last provider, if any.
+	if err != nil {
+		return "", "", err
+	}
+	return "", "", errUnidentAlbum
+}
+
+// fuzzyMatch returns the entry of an album similar to 'albumKey', as required
+// by the 'MatchTolerance' option.
 // WARNING: not concurrent-safe, caller must mutex the call.
 // We look for exact matches first to speed-up the process.
 func (c *ReleaseIDCache) fuzzyMatch(albumKey AlbumKey) (r *releaseIDEntry, exactMatch bool) {
@@ -203,37 +345,44 @@ func (c *ReleaseIDCache) fuzzyMatch(albumKey AlbumKey) (r *releaseIDEntry, exact
 		return r, true
 	}
 
-	// Threshold above which a key is considered a match for the cache.
-	const relationThreshold = 0.7
-
 	// Lookup the release in cache.
-	albumMatches := []AlbumKey{}
-	albumArtistMatches := []AlbumKey{}
-	relMax := 0.0
+	relMax := -1.0
 	var matchKey AlbumKey
 
 	for key := range c.v {
-		rel := stringRel(albumKey.album, key.album)
-		if rel >= relationThreshold {
-			albumMatches = append(albumMatches, key)
+		rel := 0.0
+		if options.MatchTolerance != toleranceAny {
+			relAlbum := stringRel(albumKey.album, key.album)
+			if relAlbum < options.MatchRelation {
+				continue
+			}
+			rel += relAlbum
 		}
-	}
-
-	for _, key := range albumMatches {
-		rel := stringRel(albumKey.albumartist, key.albumartist)
-		if rel >= relationThreshold {
-			albumArtistMatches = append(albumArtistMatches, key)
+		if options.MatchTolerance == toleranceFull || options.MatchTolerance == toleranceArtist {
+			relAlbumArtist := stringRel(albumKey.albumartist, key.albumartist)
+			if relAlbumArtist < options.MatchRelation {
+				continue
+			}
+			rel += relAlbumArtist
+		}
+		if options.MatchTolerance == toleranceFull {
+			relDate := stringRel(albumKey.date, key.date)
+			if relDate < options.MatchRelation {
+				continue
+			}
+			rel += relDate
 		}
-	}
 
-	for _, key := range albumArtistMatches {
-		rel := stringRel(albumKey.date, key.date)
-		if rel >= relationThreshold && rel > relMax {
+		// Break ties deterministically.
+		if rel > relMax || (rel == relMax && key.String() < matchKey.String()) {
 			relMax = rel
 			matchKey = key
 		}
 	}
 
+	if relMax < 0 {
+		return nil, false
+	}
 	return c.v[matchKey], false
 }
 
@@ -243,6 +392,19 @@ type Tags struct {
 	albumartist string
 	date        string
 	recordings  map[RecordingID]Recording
+
+	// MusicBrainz IDs, empty for other providers.
+	mbid            string
+	albumartistMBID string
+
+	barcode       string
+	catalogNumber string
+	country       string
+	discTotal     int
+	// Sorted by decreasing popularity, separated by "; ".
+	genre        string
+	label        string
+	originalDate string
 }
 
 type tagsEntry struct {
@@ -276,7 +438,21 @@ func (c *TagsCache) get(releaseID ReleaseID, albumKey AlbumKey, fr *FileRecord)
 
 		// We use releaseID to identify albums: it is more reliable than the album
 		// name in tags.
-		e.tags, err = queryMusicBrainz(releaseID)
+		if onlineDiskCache.GetJSON(diskCacheTags, string(releaseID), &e.tags) {
+			fr.debug.Print("Use tags from disk cache")
+		} else {
+			var p Provider
+			var id string
+			p, id, err = providerOf(releaseID)
+			if err == nil {
+				e.tags, err = p.Release(id)
+			}
+			if err == nil {
+				if err := onlineDiskCache.PutJSON(diskCacheTags, string(releaseID), e.tags); err != nil {
+					fr.debug.Print("Cannot store tags in disk cache: ", err)
+				}
+			}
+		}
 		close(e.ready)
 	} else {
 		c.Unlock()
@@ -318,7 +494,22 @@ func (c *CoverCache) get(releaseID ReleaseID, fr *FileRecord) (*Cover, error) {
 		c.v[releaseID] = e
 		c.Unlock()
 
-		e.cover, err = queryCover(releaseID)
+		if picture, ok := onlineDiskCache.Get(diskCacheCovers, string(releaseID)); ok {
+			fr.debug.Print("Use cover from disk cache")
+			e.cover, err = makeCover(picture)
+		} else {
+			var p Provider
+			var id string
+			p, id, err = providerOf(releaseID)
+			if err == nil {
+				e.cover, err = p.Cover(id)
+			}
+			if err == nil {
+				if err := onlineDiskCache.Put(diskCacheCovers, string(releaseID), e.cover.picture); err != nil {
+					fr.debug.Print("Cannot store cover in disk cache: ", err)
+				}
+			}
+		}
 		close(e.ready)
 	} else {
 		c.Unlock()
@@ -329,43 +520,131 @@ func (c *CoverCache) get(releaseID ReleaseID, fr *FileRecord) (*Cover, error) {
 	return &e.cover, err
 }
 
-// MusicBrainz returns 2 artist names per recording. They are stored in the NameCredit struct:
-// type NameCredit struct {
-// 	Name string   `xml:"name"` // Not implemented!
-// 	Artist Artist `xml:"artist"`
-// }
-// 'Name' is the name as showed on the official album case.
-// 'Artist' links to the official artist name.
-// As of 2015/12/06, gomusicbrainz does not implement 'name'. TODO: Report upstream? The official name is better anyways.
+// musicBrainzCredit is an artist credit of the MusicBrainz web service. The
+// 'name' is the name as credited on the release, 'artist.name' is the official
+// artist name. We use the latter.
+type musicBrainzCredit struct {
+	Artist struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"artist"`
+}
+
+type musicBrainzGenre struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type musicBrainzRelease struct {
+	ID           string              `json:"id"`
+	Title        string              `json:"title"`
+	Date         string              `json:"date"`
+	Country      string              `json:"country"`
+	Barcode      string              `json:"barcode"`
+	ArtistCredit []musicBrainzCredit `json:"artist-credit"`
+	Genres       []musicBrainzGenre  `json:"genres"`
+	LabelInfo    []struct {
+		CatalogNumber string `json:"catalog-number"`
+		Label         struct {
+			Name string `json:"name"`
+		} `json:"label"`
+	} `json:"label-info"`
+	ReleaseGroup struct {
+		FirstReleaseDate string             `json:"first-release-date"`
+		Genres           []musicBrainzGenre `json:"genres"`
+	} `json:"release-group"`
+	Media []struct {
+		Position   int `json:"position"`
+		TrackCount int `json:"track-count"`
+		Tracks     []struct {
+			Number    string `json:"number"`
+			Position  int    `json:"position"`
+			Length    int    `json:"length"`
+			Recording struct {
+				ID           string              `json:"id"`
+				Title        string              `json:"title"`
+				Length       int                 `json:"length"`
+				ArtistCredit []musicBrainzCredit `json:"artist-credit"`
+				ISRCs        []string            `json:"isrcs"`
+			} `json:"recording"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+// serviceGet sends a GET request to 'uri' with 'client'. The status is not
+// checked.
+func serviceGet(client *http.Client, uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return client.Do(req)
+}
+
 func queryMusicBrainz(releaseID ReleaseID) (Tags, error) {
-	mbRelease, err := musicBrainzClient.LookupRelease(gomusicbrainz.MBID(releaseID), "recordings", "artist-credits")
+	resp, err := serviceGet(musicBrainzClient, options.MusicBrainzURL+"/ws/2/release/"+url.PathEscape(string(releaseID))+"?inc=recordings+artist-credits+labels+isrcs+genres+release-groups&fmt=json")
+	if err != nil {
+		return Tags{}, errors.New("MusicBrainz: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Tags{}, errors.New("MusicBrainz: " + resp.Status)
+	}
+
+	var mbRelease musicBrainzRelease
+	err = json.NewDecoder(resp.Body).Decode(&mbRelease)
 	if err != nil {
 		return Tags{}, errors.New("MusicBrainz: " + err.Error())
 	}
 
 	// Store the releaseID for cover retrieval when cache is used (and not
 	// AcoustID).
-	tags := Tags{date: strconv.Itoa(mbRelease.Date.Time.Year()), album: mbRelease.Title}
+	tags := Tags{
+		date:         reYear.FindString(mbRelease.Date),
+		album:        mbRelease.Title,
+		mbid:         mbRelease.ID,
+		barcode:      mbRelease.Barcode,
+		country:      mbRelease.Country,
+		discTotal:    len(mbRelease.Media),
+		originalDate: mbRelease.ReleaseGroup.FirstReleaseDate,
+	}
 	tags.recordings = make(map[RecordingID]Recording)
 
-	if len(mbRelease.ArtistCredit.NameCredits) > 0 {
-		tags.albumartist = mbRelease.ArtistCredit.NameCredits[0].Artist.Name
+	if len(mbRelease.ArtistCredit) > 0 {
+		tags.albumartist = mbRelease.ArtistCredit[0].Artist.Name
+		tags.albumartistMBID = mbRelease.ArtistCredit[0].Artist.ID
 	}
+	if len(mbRelease.LabelInfo) > 0 {
+		tags.label = mbRelease.LabelInfo[0].Label.Name
+		tags.catalogNumber = mbRelease.LabelInfo[0].CatalogNumber
+	}
+	// Releases are rarely tagged with genres, fall back to the release group.
+	genres := mbRelease.Genres
+	if len(genres) == 0 {
+		genres = mbRelease.ReleaseGroup.Genres
+	}
+	tags.genre = musicBrainzGenres(genres)
 
-	// TODO: Add more MusicBrainz debug info.
-	// fr.debug.Print("musicbrainz: release albumartist: ", tags.albumartist)
-
-	for _, entry := range mbRelease.Mediums {
+	for _, entry := range mbRelease.Media {
 		for _, v := range entry.Tracks {
 
 			rec := Recording{
-				track:    v.Number,
-				title:    v.Recording.Title,
-				duration: v.Recording.Length,
+				track:      v.Number,
+				title:      v.Recording.Title,
+				duration:   v.Recording.Length,
+				disc:       entry.Position,
+				position:   v.Position,
+				trackTotal: entry.TrackCount,
+				mbid:       v.Recording.ID,
 			}
 
-			if len(v.Recording.ArtistCredit.NameCredits) > 0 {
-				rec.artist = v.Recording.ArtistCredit.NameCredits[0].Artist.Name
+			if len(v.Recording.ArtistCredit) > 0 {
+				rec.artist = v.Recording.ArtistCredit[0].Artist.Name
+				rec.artistMBID = v.Recording.ArtistCredit[0].Artist.ID
+			}
+			if len(v.Recording.ISRCs) > 0 {
+				rec.isrc = v.Recording.ISRCs[0]
 			}
 
 			if v.Recording.Length == 0 {
@@ -379,12 +658,85 @@ func queryMusicBrainz(releaseID ReleaseID) (Tags, error) {
 	return tags, nil
 }
 
-func queryAcoustID(fr *FileRecord, meta acoustid.Meta, duration int) (recordingID RecordingID, releaseID ReleaseID, err error) {
+// musicBrainzGenres joins the names of 'genres', the most voted first.
+func musicBrainzGenres(genres []musicBrainzGenre) string {
+	sorted := append([]musicBrainzGenre(nil), genres...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Count > sorted[j].Count })
+	names := make([]string, len(sorted))
+	for i, v := range sorted {
+		names[i] = v.Name
+	}
+	return strings.Join(names, "; ")
+}
+
+// trackTags returns the output tags of 'recording' from album 'tags'. Tags
+// unknown to the provider are left out.
+func trackTags(tags *Tags, recording Recording) map[string]string {
+	result := map[string]string{
+		"album":        tags.album,
+		"album_artist": tags.albumartist,
+		"artist":       recording.artist,
+		"date":         tags.date,
+		"title":        recording.title,
+		"track":        recording.track,
+	}
+
+	extra := map[string]string{
+		"barcode":                   tags.barcode,
+		"catalognumber":             tags.catalogNumber,
+		"genre":                     tags.genre,
+		"isrc":                      recording.isrc,
+		"label":                     tags.label,
+		"musicbrainz_albumartistid": tags.albumartistMBID,
+		"musicbrainz_albumid":       tags.mbid,
+		"musicbrainz_artistid":      recording.artistMBID,
+		"musicbrainz_trackid":       recording.mbid,
+		"originaldate":              tags.originalDate,
+		"releasecountry":            tags.country,
+	}
+	if recording.disc > 0 {
+		extra["disc"] = strconv.Itoa(recording.disc)
+	}
+	if tags.discTotal > 0 {
+		extra["disctotal"] = strconv.Itoa(tags.discTotal)
+	}
+	if recording.trackTotal > 0 {
+		extra["tracktotal"] = strconv.Itoa(recording.trackTotal)
+	}
+	for k, v := range extra {
+		if v != "" {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// releaseCandidate is a release returned by AcoustID, with the details of its
+// score.
+type releaseCandidate struct {
+	releaseID   ReleaseID
+	recordingID RecordingID
+	score       float64
+
+	title      string
+	artist     string
+	album      string
+	year       int
+	trackCount int
+	// Medium of the release, only for multi-track files.
+	disc int
+	// Score breakdown.
+	details string
+}
+
+// queryAcoustID returns the releases of 'meta', best match first. Each release
+// is only listed once, with the best matching recording.
+func queryAcoustID(fr *FileRecord, meta acoustid.Meta, duration int) ([]releaseCandidate, error) {
 	// Shorthand.
 	tags := fr.input.tags
 
 	if meta.Status == "error" {
-		return "", "", errors.New("AcoustID: " + meta.Error.Message)
+		return nil, errors.New("AcoustID: " + meta.Error.Message)
 	}
 
 	disc, err := strconv.Atoi(tags["disc"])
@@ -403,7 +755,15 @@ func queryAcoustID(fr *FileRecord, meta acoustid.Meta, duration int) (recordingI
 		track = 0
 	}
 
+	w := options.MatchWeights
+	wSum := 0.0
+	for k := range defaultMatchWeights {
+		wSum += w[k]
+	}
+
 	scoreMax := 0.0
+	var candidates []releaseCandidate
+	index := map[ReleaseID]int{}
 
 	for _, acoustResult := range meta.Results {
 		for _, acoustRecording := range acoustResult.Recordings {
@@ -447,21 +807,11 @@ func queryAcoustID(fr *FileRecord, meta acoustid.Meta, duration int) (recordingI
 					}
 				}
 
-				relYear := 0.0
 				year, err := strconv.Atoi(date)
 				if err != nil {
 					year = 0
 				}
-
-				switch acoustRelease.Date.Year {
-				case year:
-					relYear = 1
-				case year - 1, year + 1:
-					// Arbitrary distance: when an album is released around the
-					// beginning/end of the year Y, the publishing date that is reported
-					// can vary between Y-1 and Y+1.
-					relYear = 0.75
-				}
+				relYear := scoreYear(acoustRelease.Date.Year, year)
 
 				relPosition := 0.0
 				dbgMedium := 0
@@ -499,21 +849,17 @@ func queryAcoustID(fr *FileRecord, meta acoustid.Meta, duration int) (recordingI
 					}
 				}
 
-				// Score heuristic from 0 to 1.
-				// When 'title' and 'artist' fully match, there is no better result. Thus this accounts for >50%.
-				// In case of tie, album and album_artist determines the best subresult. This accounts for >25%.
-				// In case of tie, position has more weight than year and duration.
-				score := (26*relTitle + 25*relArtist + 13*relAlbumArtist + 13*relAlbum + 9*relPosition + 7*relYear + 7*relDuration) / 100
+				// Score heuristic from 0 to 1, weighted with the 'MatchWeights' option.
+				// See defaultMatchWeights.
+				score := (w["title"]*relTitle + w["artist"]*relArtist + w["albumartist"]*relAlbumArtist + w["album"]*relAlbum + w["position"]*relPosition + w["year"]*relYear + w["duration"]*relDuration) / wSum
 
 				if score > scoreMax {
 					fr.debug.Printf("Score: %.4g (new max)", score)
 					scoreMax = score
-					releaseID = ReleaseID(acoustRelease.ID)
-					recordingID = RecordingID(acoustRecording.ID)
 				} else {
 					fr.debug.Printf("Score: %.4g", score)
 				}
-				fr.debug.Printf(`
+				details := fmt.Sprintf(`
 %-12s %-7.4g [%v]
 %-12s %-7.4g [%v]
 %-12s %-7.4g [%v]
@@ -527,20 +873,44 @@ Disc %v, Track %v, TrackCount %v: %.4g
 					"AlbumArtist", relAlbumArtist, dbgAlbumArtist,
 					"Year", relYear, acoustRelease.Date.Year,
 					dbgMedium, dbgTrack, dbgTrackCount, relPosition)
+				fr.debug.Print(details)
 
-				if score == 1 {
-					// Maximum reached, we can stop here.
-					return recordingID, releaseID, nil
+				id := makeReleaseID(providerMusicBrainz, acoustRelease.ID)
+				if k, ok := index[id]; ok && candidates[k].score >= score {
+					continue
+				}
+				trackCount := dbgTrackCount
+				if trackCount == 0 {
+					trackCount = acoustRelease.Track_count
+				}
+				candidate := releaseCandidate{
+					releaseID:   id,
+					recordingID: RecordingID(acoustRecording.ID),
+					score:       score,
+					title:       acoustRecording.Title,
+					artist:      dbgArtist,
+					album:       acoustRelease.Title,
+					year:        acoustRelease.Date.Year,
+					trackCount:  trackCount,
+					details:     details,
+				}
+				if k, ok := index[id]; ok {
+					candidates[k] = candidate
+				} else {
+					index[id] = len(candidates)
+					candidates = append(candidates, candidate)
 				}
 			}
 		}
 	}
 
-	return recordingID, releaseID, nil
+	// On equal scores, keep the first result.
+	sortCandidates(candidates)
+	return candidates, nil
 }
 
 func queryCover(releaseID ReleaseID) (Cover, error) {
-	resp, err := http.DefaultClient.Get("http://coverartarchive.org/release/" + string(releaseID) + "/front")
+	resp, err := serviceGet(coverArtArchiveClient, options.CoverArtArchiveURL+"/release/"+string(releaseID)+"/front")
 	if err != nil {
 		return Cover{}, err
 	}
@@ -548,7 +918,7 @@ func queryCover(releaseID ReleaseID) (Cover, error) {
 
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		resp, err = http.DefaultClient.Get("https://musicbrainz.org/release/" + string(releaseID))
+		resp, err = serviceGet(musicBrainzClient, options.MusicBrainzURL+"/release/"+string(releaseID))
 
 		if err != nil {
 			return Cover{}, err
@@ -571,7 +941,7 @@ func queryCover(releaseID ReleaseID) (Cover, error) {
 		}
 		uri := string(matches[1])
 
-		resp, err = http.DefaultClient.Get(uri)
+		resp, err = serviceGet(coverArtArchiveClient, uri)
 		if err != nil {
 			return Cover{}, err
 		}
@@ -582,13 +952,18 @@ func queryCover(releaseID ReleaseID) (Cover, error) {
 		}
 	}
 
-	cover := Cover{}
-
-	cover.picture, err = ioutil.ReadAll(resp.Body)
+	picture, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return cover, err
+		return Cover{}, err
 	}
 
+	return makeCover(picture)
+}
+
+// makeCover decodes the properties of 'picture'.
+func makeCover(picture []byte) (Cover, error) {
+	cover := Cover{picture: picture}
+
 	reader := bytes.NewBuffer(cover.picture)
 	config, format, err := image.DecodeConfig(reader)
 	if err != nil {
@@ -665,9 +1040,10 @@ func GetOnlineTags(fr *FileRecord) (ReleaseID, map[string]string, error) {
 		}
 
 		for k, v := range tags.recordings {
-			// If duration score does not fit +/- 4 seconds, reject.
-			if inputDuration-v.duration < 4000 &&
-				inputDuration-v.duration > -4000 {
+			// If duration score does not fit +/- 4 seconds, reject. Some providers
+			// do not know all the durations.
+			d := inputDuration - v.duration
+			if v.duration == 0 || d < 4000 && d > -4000 {
 				matches = append(matches, k)
 			}
 		}
@@ -701,16 +1077,7 @@ func GetOnlineTags(fr *FileRecord) (ReleaseID, map[string]string, error) {
 	fr.debug.Printf("recordingID = %q", recordingID)
 
 	// At this point, 'release' and 'recording' must be properly set.
-	var result map[string]string
-	result = make(map[string]string)
-	result["album"] = tags.album
-	result["album_artist"] = tags.albumartist
-	result["artist"] = recording.artist
-	result["date"] = tags.date
-	result["title"] = recording.title
-	result["track"] = recording.track
-
-	return releaseID, result, nil
+	return releaseID, trackTags(tags, recording), nil
 }
 
 // GetOnlineCover is like GetOnlineTags.
@@ -745,3 +1112,317 @@ func GetOnlineCover(fr *FileRecord, releaseID ReleaseID) (picture []byte, desc i
 
 	return cover.picture, cover.desc, nil
 }
+
+// submitFingerprint submits the fingerprint of the output file of 'track' to
+// AcoustID with its output tags, so that the file can be identified in the
+// future.
+func submitFingerprint(fr *FileRecord, track int) error {
+	output := &fr.output[track]
+	fingerprint, duration, err := fingerprint(output.Path)
+	if err != nil {
+		return err
+	}
+
+	year, _ := strconv.Atoi(reYear.FindString(output.Tags["date"]))
+	trackNumber, _ := strconv.Atoi(reTrack.FindString(output.Tags["track"]))
+	discNumber, _ := strconv.Atoi(reTrack.FindString(output.Tags["disc"]))
+	submission := acoustid.Submission{
+		Fingerprint: fingerprint,
+		Duration:    duration,
+		Track:       output.Tags["title"],
+		Artist:      output.Tags["artist"],
+		Album:       output.Tags["album"],
+		AlbumArtist: output.Tags["album_artist"],
+		Year:        year,
+		TrackNumber: trackNumber,
+		DiscNumber:  discNumber,
+		FileFormat:  output.Format,
+	}
+
+	statuses, err := newAcoustIDClient().Submit(context.Background(), []acoustid.Submission{submission})
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		fr.info.Printf("AcoustID submission %v: %v", s.ID, s.Status)
+	}
+	return nil
+}
+
+// discKey identifies a medium of a release.
+type discKey struct {
+	releaseID ReleaseID
+	disc      int
+}
+
+// cachedDisc is the disk cache entry of a multi-track file.
+type cachedDisc struct {
+	ReleaseID string
+	Disc      int
+}
+
+// audioTracks returns the indices of the audio tracks of a multi-track file.
+// The data tracks are not fingerprinted nor matched against the mediums.
+func audioTracks(input *inputInfo) []int {
+	var tracks []int
+	for track := 0; track < input.trackCount; track++ {
+		if len(input.cuesheet.Files) == 0 || input.cuesheet.Files[input.cuesheetFile][track].IsAudio() {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// segmentDurations returns the durations in milliseconds of the audio tracks of
+// a multi-track file. Pregaps are appended to the previous track, like the
+// track lengths of MusicBrainz.
+func segmentDurations(fr *FileRecord) []int {
+	input := &fr.input
+	total, _ := strconv.ParseFloat(fr.Format.Duration, 64)
+	tracks := audioTracks(input)
+	durations := make([]int, len(tracks))
+	for i, track := range tracks {
+		_, durations[i], _ = splitTimes(input.cuesheet, input.cuesheetFile, track, total, gapsAppend)
+	}
+	return durations
+}
+
+// identifyDisc returns the ReleaseID of a multi-track file. Every audio track is
+// fingerprinted separately. Like identifyRelease, the best medium must score at
+// least 'MatchThreshold', unless the user chooses it in interactive mode.
+func identifyDisc(fr *FileRecord) (ReleaseID, discKey, error) {
+	input := &fr.input
+
+	musicBrainz := false
+	for _, name := range options.Providers {
+		musicBrainz = musicBrainz || name == providerMusicBrainz
+	}
+	if !musicBrainz {
+		fr.debug.Print("Multi-track files require the MusicBrainz provider")
+		return "", discKey{}, errUnidentAlbum
+	}
+
+	albumKey := makeAlbumKey(&inputInfo{path: input.path, tags: input.filetags})
+	fr.debug.Printf("albumKey = %q", albumKey)
+	var cached cachedDisc
+	if onlineDiskCache.GetJSON(diskCacheDiscs, albumKey.String(), &cached) {
+		fr.debug.Print("Use releaseID from disk cache")
+		disc := discKey{releaseID: ReleaseID(cached.ReleaseID), disc: cached.Disc}
+		return disc.releaseID, disc, nil
+	}
+
+	total, _ := strconv.ParseFloat(fr.Format.Duration, 64)
+	tracks := audioTracks(input)
+	metas := make([]acoustid.Meta, len(tracks))
+	for i, track := range tracks {
+		start, duration, _ := splitTimes(input.cuesheet, input.cuesheetFile, track, total, gapsAppend)
+		fingerprint, err := fingerprintSegment(input.path, start, duration)
+		if err != nil {
+			return "", discKey{}, err
+		}
+		metas[i], err = newAcoustIDClient().Lookup(context.Background(), fingerprint, duration/1000)
+		if err != nil {
+			return "", discKey{}, err
+		}
+		if metas[i].Status == "error" {
+			return "", discKey{}, errors.New("AcoustID: " + metas[i].Error.Message)
+		}
+	}
+
+	candidates, err := matchDisc(metas)
+	var disc discKey
+	if options.Interactive {
+		if err != nil && err != errUnidentAlbum {
+			return "", discKey{}, err
+		}
+		releaseID, _, err := chooseRelease(fr, candidates)
+		if err == nil && releaseID == "" {
+			err = errUnidentAlbum
+		}
+		if err != nil {
+			return "", discKey{}, err
+		}
+		// The disc of a release entered by the user is guessed from the durations.
+		disc.releaseID = releaseID
+		for _, c := range candidates {
+			if c.releaseID == releaseID {
+				disc.disc = c.disc
+				break
+			}
+		}
+	} else {
+		if err != nil {
+			return "", discKey{}, err
+		}
+		if candidates[0].score < options.MatchThreshold {
+			fr.debug.Printf("Best score %.4g below threshold %v", candidates[0].score, options.MatchThreshold)
+			return "", discKey{}, errUnidentAlbum
+		}
+		disc = discKey{releaseID: candidates[0].releaseID, disc: candidates[0].disc}
+	}
+
+	fr.debug.Printf("releaseID = %q, disc = %v", disc.releaseID, disc.disc)
+	if err := onlineDiskCache.PutJSON(diskCacheDiscs, albumKey.String(), cachedDisc{ReleaseID: string(disc.releaseID), Disc: disc.disc}); err != nil {
+		fr.debug.Print("Cannot store releaseID in disk cache: ", err)
+	}
+	return disc.releaseID, disc, nil
+}
+
+// matchDisc returns the mediums matching the fingerprinted segments, best match
+// first, 'metas' being the AcoustID results of the segments in order. A segment
+// matches better when its position on the medium and the track count are
+// right. The score of a medium is averaged over the segments and must reach
+// 0.5.
+func matchDisc(metas []acoustid.Meta) ([]releaseCandidate, error) {
+	matches := map[discKey]*releaseCandidate{}
+	segments := map[discKey]int{}
+	for i, meta := range metas {
+		// Only count the best match of each segment.
+		best := map[discKey]float64{}
+		for _, result := range meta.Results {
+			for _, recording := range result.Recordings {
+				for _, release := range recording.Releases {
+					for _, medium := range release.Mediums {
+						score := 0.5
+						if medium.Track_count == len(metas) {
+							score += 0.25
+						}
+						for _, track := range medium.Tracks {
+							if track.Position == i+1 {
+								score += 0.25
+								break
+							}
+						}
+						score *= result.Score
+						key := discKey{releaseID: makeReleaseID(providerMusicBrainz, release.ID), disc: medium.Position}
+						if matches[key] == nil {
+							var artists []string
+							for _, a := range release.Artists {
+								artists = append(artists, a.Name)
+							}
+							matches[key] = &releaseCandidate{
+								releaseID:  key.releaseID,
+								title:      fmt.Sprintf("Disc %v", medium.Position),
+								artist:     strings.Join(artists, ", "),
+								album:      release.Title,
+								year:       release.Date.Year,
+								trackCount: medium.Track_count,
+								disc:       medium.Position,
+							}
+						}
+						if score > best[key] {
+							best[key] = score
+						}
+					}
+				}
+			}
+		}
+		for key, score := range best {
+			matches[key].score += score
+			segments[key]++
+		}
+	}
+
+	var candidates []releaseCandidate
+	for key, c := range matches {
+		c.score /= float64(len(metas))
+		if c.score < 0.5 {
+			continue
+		}
+		c.details = fmt.Sprintf("Segments found: %v/%v\n", segments[key], len(metas))
+		candidates = append(candidates, *c)
+	}
+	if len(candidates) == 0 {
+		return nil, errUnidentAlbum
+	}
+	// Break ties deterministically.
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return a.releaseID < b.releaseID || a.releaseID == b.releaseID && a.disc < b.disc
+	})
+	return candidates, nil
+}
+
+// matchMedium returns the recordings of the medium of 'tags' that match the
+// track count and the durations (in milliseconds) of the segments. The 'disc'
+// hint is preferred if it matches. Durations must fit +/- 4 seconds, unknown
+// durations are ignored.
+func matchMedium(tags *Tags, durations []int, disc int) ([]Recording, error) {
+	media := map[int][]Recording{}
+	for _, r := range tags.recordings {
+		if r.disc > 0 && r.position > 0 {
+			media[r.disc] = append(media[r.disc], r)
+		}
+	}
+
+	var match []Recording
+	deviationMin := -1
+	for position, recordings := range media {
+		if len(recordings) != len(durations) {
+			continue
+		}
+		sort.Slice(recordings, func(i, j int) bool { return recordings[i].position < recordings[j].position })
+
+		deviation := 0
+		for i, r := range recordings {
+			if r.duration == 0 {
+				continue
+			}
+			d := r.duration - durations[i]
+			if d < 0 {
+				d = -d
+			}
+			if d >= 4000 {
+				deviation = -1
+				break
+			}
+			deviation += d
+		}
+		if deviation < 0 {
+			continue
+		}
+		if position == disc {
+			return recordings, nil
+		}
+		if deviationMin < 0 || deviation < deviationMin {
+			deviationMin = deviation
+			match = recordings
+		}
+	}
+
+	if match == nil {
+		return nil, errDiscMismatch
+	}
+	return match, nil
+}
+
+// GetOnlineDiscTags is like GetOnlineTags for multi-track files. It returns
+// the tags of every track. 'disc' is the medium found by identifyDisc, if any.
+func GetOnlineDiscTags(fr *FileRecord, releaseID ReleaseID, disc discKey) ([]map[string]string, error) {
+	fr.debug.Printf("Get disc tags (releaseID = %q)", releaseID)
+
+	albumKey := makeAlbumKey(&inputInfo{path: fr.input.path, tags: fr.input.filetags})
+	tags, err := tagsCache.get(releaseID, albumKey, fr)
+	if err != nil {
+		return nil, err
+	}
+	if tags.recordings == nil {
+		return nil, errUnidentAlbum
+	}
+
+	recordings, err := matchMedium(tags, segmentDurations(fr), disc.disc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data tracks get no tags.
+	tracks := audioTracks(&fr.input)
+	result := make([]map[string]string, fr.input.trackCount)
+	for i, recording := range recordings {
+		result[tracks[i]] = trackTags(tags, recording)
+	}
+	return result, nil
+}
@@ -4,12 +4,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -136,6 +139,71 @@ func realPathWalk(path string, info os.FileInfo, walkFn filepath.WalkFunc, visit
 	return nil
 }
 
+// trashFile moves the file at 'path' to the folder 'trash' and returns its new
+// path. A random suffix is appended to the name if needed.
+func trashFile(path, trash string) (string, error) {
+	err := os.MkdirAll(trash, 0777)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(trash, filepath.Base(path))
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL, 0666)
+	if err == nil {
+		f.Close()
+	} else if dst, err = mkTemp(dst); err != nil {
+		return "", err
+	}
+
+	err = os.Rename(path, dst)
+	if err != nil {
+		// Cross-device move.
+		err = CopyFile(dst, path)
+		if err == nil {
+			err = os.Remove(path)
+		}
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+// ReadFileList returns the paths listed in 'r', separated by NUL characters as
+// printed by 'find -print0', or else by newlines. Empty paths are skipped.
+func ReadFileList(r io.Reader) ([]string, error) {
+	// A path is shorter than the peeked buffer: if the buffer holds no NUL,
+	// paths are separated by newlines.
+	const peekSize = 16 * 1024
+	br := bufio.NewReaderSize(r, peekSize)
+	buf, err := br.Peek(peekSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sep := byte('\n')
+	if bytes.IndexByte(buf, 0) >= 0 {
+		sep = 0
+	}
+
+	var paths []string
+	for {
+		path, err := br.ReadString(sep)
+		path = strings.TrimSuffix(path, string(sep))
+		if sep == '\n' {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 // RealPathWalk is like filepath.Walk but follows symlinks.
 func RealPathWalk(root string, walkFn filepath.WalkFunc) error {
 	info, err := os.Lstat(root)
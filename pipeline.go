@@ -4,18 +4,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 )
 
+var errStopped = errors.New("pipeline stopped")
+
+// logOutput receives the logs of the records leaving the Pipeline.
+var logOutput io.Writer = os.Stderr
+
 // Stage is the interface implemented by an object that can be added to a
 // pipeline to process incoming FileRecords.
 // Multiple stages of the same kind can be run in parallel.
 // Init() and Close() are run once per goroutine.
+// Run() should abort as soon as possible when the context is canceled and
+// leave no partial output behind.
 type Stage interface {
 	Init()
-	Run(*FileRecord) error
+	Run(context.Context, *FileRecord) error
 	Close()
 }
 
@@ -27,17 +37,35 @@ type Stage interface {
 // - It groups log messages by FileRecord; no manual flushing required.
 // - It removes some parallelization boilerplate such as channel loops.
 // - It makes it easy to change the number of goroutines allocated to the various stages.
+//
+// A Pipeline can be stopped: the records that have not started a stage yet are
+// discarded while the in-flight ones complete. Canceling the context of the
+// Pipeline aborts the in-flight records as well.
 type Pipeline struct {
+	ctx    context.Context
 	input  chan *FileRecord
 	output chan *FileRecord
 	log    chan *FileRecord
 	logWg  sync.WaitGroup
+
+	// Set by AddGroup to release the groups whose last records get discarded.
+	release func([]*FileRecord)
+
+	// Closed by Stop.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Guard the input channel so that it can be closed by Stop while the
+	// producer feeds it.
+	inputClosed bool
+	inputMutex  sync.Mutex
 }
 
 // NewPipeline initializes a Pipeline with an input queue and a log queue.
-// The Pipeline waits until its input channel is fed.
-func NewPipeline(inputQueueSize, logQueueSize int) *Pipeline {
+// The Pipeline waits until its input channel is fed with Feed.
+func NewPipeline(ctx context.Context, inputQueueSize, logQueueSize int) *Pipeline {
 	var p Pipeline
+	p.ctx = ctx
+	p.stop = make(chan struct{})
 	p.input = make(chan *FileRecord, inputQueueSize)
 	p.output = p.input
 	p.log = make(chan *FileRecord, logQueueSize)
@@ -45,7 +73,9 @@ func NewPipeline(inputQueueSize, logQueueSize int) *Pipeline {
 	p.logWg.Add(1)
 	go func() {
 		for fr := range p.log {
-			fmt.Fprint(os.Stderr, fr)
+			fmt.Fprint(logOutput, fr)
+			progress.Finish(fr)
+			report.Finish(fr)
 		}
 		p.logWg.Done()
 	}()
@@ -76,8 +106,13 @@ func (p *Pipeline) Add(NewStage func() Stage, routineCount int) {
 			s := NewStage()
 			s.Init()
 			for fr := range input {
-				err := s.Run(fr)
+				if p.Stopped() {
+					p.drop(fr)
+					continue
+				}
+				err := s.Run(p.ctx, fr)
 				if err != nil {
+					p.drop(fr)
 					p.log <- fr
 					continue
 				}
@@ -99,6 +134,118 @@ func (p *Pipeline) Add(NewStage func() Stage, routineCount int) {
 	}()
 }
 
+// AddGroup appends a grouping step to the Pipeline. Records are held until all
+// the records of their fileGroup have either reached this step or been
+// discarded by a previous Stage. 'release' is then called over the records of
+// the group before they are forwarded. Records without group are released
+// alone.
+// If 'barrier' is true, all records are held until the input is exhausted and
+// 'release' is called once over all of them.
+func (p *Pipeline) AddGroup(release func([]*FileRecord), barrier bool) {
+	out := make(chan *FileRecord, 1)
+	var wg sync.WaitGroup
+
+	forward := func(records []*FileRecord) {
+		release(records)
+		for _, fr := range records {
+			fr.group = nil
+			out <- fr
+		}
+	}
+	p.release = func(records []*FileRecord) {
+		wg.Add(1)
+		forward(records)
+		wg.Done()
+	}
+
+	wg.Add(1)
+	go func(input <-chan *FileRecord) {
+		var held []*FileRecord
+		for fr := range input {
+			switch {
+			case barrier:
+				held = append(held, fr)
+			case fr.group == nil:
+				forward([]*FileRecord{fr})
+			default:
+				if records := fr.group.add(fr); records != nil {
+					forward(records)
+				}
+			}
+		}
+		if barrier && len(held) > 0 {
+			forward(held)
+		}
+		wg.Done()
+	}(p.output)
+
+	p.output = out
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// drop removes 'fr' from its group. If it was the last awaited record, the
+// group is released.
+func (p *Pipeline) drop(fr *FileRecord) {
+	if fr.group == nil || p.release == nil {
+		return
+	}
+	if records := fr.group.add(nil); records != nil {
+		p.release(records)
+	}
+}
+
+// Feed sends 'fr' to the Pipeline. It returns false if the Pipeline is stopped,
+// in which case 'fr' is discarded.
+func (p *Pipeline) Feed(fr *FileRecord) bool {
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if p.inputClosed || p.Stopped() {
+		return false
+	}
+	select {
+	case p.input <- fr:
+		return true
+	case <-p.stop:
+		return false
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// CloseInput signals that the input has been fully produced.
+func (p *Pipeline) CloseInput() {
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if !p.inputClosed {
+		p.inputClosed = true
+		close(p.input)
+	}
+}
+
+// Stop the Pipeline: the input is closed and the records that have not started
+// a stage yet are discarded.
+func (p *Pipeline) Stop() {
+	// Unblock the producer before closing the input.
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.CloseInput()
+}
+
+// Stopped reports whether the Pipeline was stopped or its context canceled.
+func (p *Pipeline) Stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	case <-p.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 // Close the Pipeline to finish logging.
 // Call it once the input has been fully produced and the output fully consumed.
 func (p *Pipeline) Close() {
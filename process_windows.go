@@ -0,0 +1,15 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachProcess runs 'cmd' in its own process group so that it does not get
+// the interrupts sent from the console. Interrupts are handled by demlo.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,277 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Progress display.
+//
+// The progress is fed by the events of the pipeline stages and by the records
+// leaving the pipeline. The input files are counted beforehand to estimate the
+// remaining time. On a terminal, a status line is kept below the log output.
+// Otherwise a progress line is printed periodically.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var progress Progress
+
+// Progress tracks the files and bytes processed so far against the counted
+// input. Nothing is displayed until Start is called with an output.
+type Progress struct {
+	out *os.File
+	// Whether 'out' is a terminal.
+	tty   bool
+	start time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	// Number of input files, -1 while unknown.
+	total       int
+	discovered  int
+	analyzed    int
+	transformed int
+	skipped     int
+	failed      int
+	done        int
+	// Bytes of the written output files.
+	written int64
+	// Input records in the pipeline, true if they failed in a stage. They are
+	// counted once they leave the pipeline.
+	records map[*FileRecord]bool
+	// Whether the status line is displayed.
+	shown bool
+	sync.Mutex
+}
+
+// Start displays the progress on 'out' every 'interval'. On a terminal, the
+// status line is refreshed every second instead. If 'roots' is not nil, the
+// input files found in 'roots' are counted to estimate the remaining time.
+func (p *Progress) Start(out *os.File, interval time.Duration, roots []string) {
+	p.out = out
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.total = -1
+	p.records = map[*FileRecord]bool{}
+
+	st, _ := out.Stat()
+	if st != nil && st.Mode()&os.ModeCharDevice != 0 {
+		if _, _, err := TerminalSize(int(out.Fd())); err == nil {
+			p.tty = true
+			interval = time.Second
+		}
+	}
+
+	if roots != nil {
+		go func() {
+			total := countInputFiles(roots)
+			p.Lock()
+			p.total = total
+			p.Unlock()
+		}()
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Lock()
+				p.display()
+				p.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the display and print the final progress line.
+func (p *Progress) Stop() {
+	if p.out == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.Lock()
+	p.clear()
+	fmt.Fprintln(p.out, log.Prefix()+"Progress: "+p.line())
+	p.Unlock()
+}
+
+// Write 'b' to the output above the status line. Progress can be used as the
+// output of the loggers.
+func (p *Progress) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	shown := p.shown
+	p.clear()
+	n, err := p.out.Write(b)
+	if shown {
+		p.display()
+	}
+	return n, err
+}
+
+// Event counts 'e', emitted for 'fr'.
+func (p *Progress) Event(fr *FileRecord, e Event) {
+	if p.out == nil {
+		return
+	}
+	var size int64
+	if e.Type == eventTranscoded || e.Type == eventTagged {
+		if st, err := os.Stat(e.Output); err == nil {
+			size = st.Size()
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	switch e.Type {
+	case eventDiscovered:
+		p.discovered++
+		p.records[fr] = false
+	case eventSkipped:
+		// Tracks skipped by the transformer are not counted.
+		if e.Stage != stageTransformer {
+			p.skipped++
+			p.records[fr] = false
+		}
+	case eventAnalyzed:
+		p.analyzed++
+	case eventTranscoded, eventTagged:
+		p.transformed++
+		p.written += size
+	case eventFailed, eventScriptsFailed:
+		p.records[fr] = true
+	}
+}
+
+// Finish counts 'fr' as done. It is called once 'fr' leaves the pipeline.
+func (p *Progress) Finish(fr *FileRecord) {
+	if p.out == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	failed, ok := p.records[fr]
+	if !ok {
+		// Not an input file, e.g. a cover in a folder.
+		return
+	}
+	delete(p.records, fr)
+	p.done++
+	if failed {
+		p.failed++
+	}
+}
+
+// display prints the progress: the status line on a terminal, a log line
+// otherwise. The lock must be held.
+func (p *Progress) display() {
+	line := p.line()
+	if !p.tty {
+		fmt.Fprintln(p.out, log.Prefix()+"Progress: "+line)
+		return
+	}
+	if width, _, err := TerminalSize(int(p.out.Fd())); err == nil && width > 0 && len(line) >= width {
+		line = line[:width-1]
+	}
+	p.clear()
+	io.WriteString(p.out, line)
+	p.shown = true
+}
+
+// clear erases the status line. The lock must be held.
+func (p *Progress) clear() {
+	if p.shown {
+		io.WriteString(p.out, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// line returns the progress summary. The lock must be held.
+func (p *Progress) line() string {
+	elapsed := time.Since(p.start)
+
+	var fields []string
+	if p.total >= 0 {
+		percent := 100
+		if p.total > 0 && p.done < p.total {
+			percent = 100 * p.done / p.total
+		}
+		fields = append(fields, fmt.Sprintf("%v/%v files (%v%%)", p.done, p.total, percent))
+	} else {
+		fields = append(fields, fmt.Sprintf("%v/%v files", p.done, p.discovered))
+	}
+	fields = append(fields, fmt.Sprintf("%v analyzed, %v written, %v skipped, %v failed", p.analyzed, p.transformed, p.skipped, p.failed))
+
+	seconds := elapsed.Seconds()
+	if seconds > 0 {
+		fields = append(fields, fmt.Sprintf("%v (%v/s), %.1f files/min",
+			formatBytes(p.written), formatBytes(int64(float64(p.written)/seconds)), float64(p.done)*60/seconds))
+	}
+
+	timing := "elapsed " + formatDuration(elapsed)
+	if p.total > 0 && p.done > 0 && p.done < p.total {
+		eta := time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(p.done))
+		timing += ", ETA " + formatDuration(eta)
+	}
+	fields = append(fields, timing)
+
+	return strings.Join(fields, " | ")
+}
+
+// countInputFiles returns the number of files of 'roots' with a known
+// extension that are selected.
+func countInputFiles(roots []string) int {
+	visited := map[string]bool{}
+	for _, root := range roots {
+		// 'visit' always keeps going, so no error.
+		_ = RealPathWalk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || visited[path] {
+				return nil
+			}
+			if options.Extensions[strings.ToLower(Ext(path))] && selection.Selected(path, info) {
+				visited[path] = true
+			}
+			return nil
+		})
+	}
+	return len(visited)
+}
+
+// formatBytes returns 'n' in a human-readable unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration returns 'd' rounded to the second, e.g. "1h02m03s".
+func formatDuration(d time.Duration) string {
+	s := int(d.Seconds() + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%vh%02vm%02vs", s/3600, s/60%60, s%60)
+	}
+	if s >= 60 {
+		return fmt.Sprintf("%vm%02vs", s/60, s%60)
+	}
+	return fmt.Sprintf("%vs", s)
+}
@@ -0,0 +1,124 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Online metadata providers.
+//
+// A provider is a source of releases: it identifies the release of a track,
+// from its fingerprint or from its tags, and fetches the tags and the cover of
+// the release. The providers of the 'Providers' option are tried in order
+// until one of them returns a good enough match.
+//
+// Release IDs are namespaced by provider, e.g. "discogs:1234", so that the
+// caches can hold releases of any provider. MusicBrainz IDs are not prefixed
+// for compatibility with existing disk caches.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	providerMusicBrainz = "musicbrainz"
+	providerDiscogs     = "discogs"
+)
+
+var (
+	providers = map[string]Provider{
+		providerMusicBrainz: musicBrainzProvider{},
+		providerDiscogs:     discogsProvider{},
+	}
+
+	errNotSupported = errors.New("not supported by provider")
+)
+
+// Provider is a source of release metadata. Lookups return the candidate
+// releases sorted by score, best first, with release IDs made with
+// makeReleaseID. Operations a provider cannot perform return errNotSupported.
+type Provider interface {
+	// Name is the name of the provider in the 'Providers' option.
+	Name() string
+	// LookupFingerprint returns the releases of the track fingerprinted as
+	// 'fp'.
+	LookupFingerprint(fr *FileRecord, fp *trackFingerprint) ([]releaseCandidate, error)
+	// Search returns the releases matching the tags of 'fr'.
+	Search(fr *FileRecord) ([]releaseCandidate, error)
+	// Release returns the tags of the release 'id', without namespace.
+	Release(id string) (Tags, error)
+	// Cover returns the front cover of the release 'id', without namespace.
+	Cover(id string) (Cover, error)
+}
+
+// makeReleaseID returns the ReleaseID of release 'id' of provider 'name'.
+func makeReleaseID(name, id string) ReleaseID {
+	if name == providerMusicBrainz {
+		return ReleaseID(id)
+	}
+	return ReleaseID(name + ":" + id)
+}
+
+// providerOf returns the provider of 'releaseID' and the ID of the release
+// for this provider.
+func providerOf(releaseID ReleaseID) (Provider, string, error) {
+	name, id := providerMusicBrainz, string(releaseID)
+	if i := strings.Index(id, ":"); i >= 0 {
+		name, id = id[:i], id[i+1:]
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, "", errors.New("unknown provider: " + name)
+	}
+	return p, id, nil
+}
+
+// lookupRelease returns the candidate releases of 'fr' from provider 'p'. The
+// fingerprint is preferred, the tags are searched when the provider does not
+// support fingerprints.
+func lookupRelease(fr *FileRecord, p Provider, fp *trackFingerprint) ([]releaseCandidate, error) {
+	candidates, err := p.LookupFingerprint(fr, fp)
+	if err != errNotSupported {
+		return candidates, err
+	}
+	return p.Search(fr)
+}
+
+// trackFingerprint memoizes the fingerprint of a file so that it is computed
+// at most once, and only for the providers that need it.
+type trackFingerprint struct {
+	path     string
+	value    string
+	duration int
+	err      error
+	done     bool
+}
+
+func (fp *trackFingerprint) get() (string, int, error) {
+	if !fp.done {
+		fp.value, fp.duration, fp.err = fingerprint(fp.path)
+		fp.done = true
+	}
+	return fp.value, fp.duration, fp.err
+}
+
+// sortCandidates sorts 'candidates' by score, best first. The order of
+// candidates with equal scores is kept.
+func sortCandidates(candidates []releaseCandidate) {
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+}
+
+// scoreYear returns the relation between release year 'year' and the year
+// from the tags, 'tagYear'.
+func scoreYear(year, tagYear int) float64 {
+	switch year {
+	case tagYear:
+		return 1
+	case tagYear - 1, tagYear + 1:
+		// Arbitrary distance: when an album is released around the
+		// beginning/end of the year Y, the publishing date that is reported
+		// can vary between Y-1 and Y+1.
+		return 0.75
+	}
+	return 0
+}
@@ -0,0 +1,250 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// Rate limiting and retries of the online queries.
+//
+// Every online service has its own HTTP client. The requests of all the
+// goroutines to a service are spaced by the rate limit of the service, e.g. 1
+// request per second for MusicBrainz. Throttled requests (429, 503) and
+// failed requests are retried with an exponential backoff. A 'Retry-After'
+// header delays all the requests to the service. Delays are capped and the
+// waits end when the request is canceled.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ambrevar/demlo/acoustid"
+)
+
+const (
+	serviceAcoustID        = "acoustid"
+	serviceCoverArtArchive = "coverartarchive"
+	serviceDiscogs         = "discogs"
+	serviceLRCLIB          = "lrclib"
+	serviceMusicBrainz     = "musicbrainz"
+)
+
+// Default rate limits in requests per second, as required by the services.
+var defaultOnlineRates = map[string]float64{
+	serviceAcoustID:        3,
+	serviceCoverArtArchive: 0,
+	serviceDiscogs:         1,
+	serviceLRCLIB:          0,
+	serviceMusicBrainz:     1,
+}
+
+// Delay before the first retry. It is doubled on every retry.
+const retryDelay = time.Second
+
+var (
+	acoustIDClient        = http.DefaultClient
+	coverArtArchiveClient = http.DefaultClient
+	discogsClient         = http.DefaultClient
+	lrclibClient          = http.DefaultClient
+	musicBrainzClient     = http.DefaultClient
+)
+
+// newAcoustIDClient returns a client of the AcoustID server of the options.
+func newAcoustIDClient() *acoustid.Client {
+	return &acoustid.Client{
+		HTTPClient: acoustIDClient,
+		URL:        options.AcoustIDURL,
+		Key:        options.AcoustIDKey,
+		UserKey:    options.AcoustIDUserKey,
+		UserAgent:  userAgent,
+	}
+}
+
+// initOnlineClients sets up the clients of the online services from the
+// 'OnlineRates', 'OnlineRetries', 'OnlineMaxDelay' and 'OnlineTimeout' options.
+func initOnlineClients() {
+	newClient := func(service string) *http.Client {
+		t := newLimitedTransport(service, http.DefaultTransport, options.OnlineRates[service], options.OnlineRetries, time.Duration(options.OnlineTimeout)*time.Second)
+		t.maxDelay = time.Duration(options.OnlineMaxDelay) * time.Second
+		return &http.Client{Transport: t}
+	}
+	acoustIDClient = newClient(serviceAcoustID)
+	coverArtArchiveClient = newClient(serviceCoverArtArchive)
+	discogsClient = newClient(serviceDiscogs)
+	lrclibClient = newClient(serviceLRCLIB)
+	musicBrainzClient = newClient(serviceMusicBrainz)
+}
+
+// limitedTransport is an http.RoundTripper that spaces the requests by
+// 'interval' and retries them up to 'retries' times. Every attempt, including
+// the reading of the response body, must complete within 'timeout', if
+// positive. The time spent waiting for the rate limit does not count.
+type limitedTransport struct {
+	service  string
+	base     http.RoundTripper
+	interval time.Duration
+	retries  int
+	timeout  time.Duration
+	// Maximum delay before a retry, if positive.
+	maxDelay time.Duration
+	// Time of the next allowed request.
+	next time.Time
+	sync.Mutex
+}
+
+// newLimitedTransport returns a transport for 'service' allowing 'rate'
+// requests per second, or unlimited if 'rate' is not positive.
+func newLimitedTransport(service string, base http.RoundTripper, rate float64, retries int, timeout time.Duration) *limitedTransport {
+	t := &limitedTransport{service: service, base: base, retries: retries, timeout: timeout}
+	if rate > 0 {
+		t.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return t
+}
+
+// wait blocks until the next request is allowed and books the following slot.
+// It returns early with the error of 'ctx' if it is done.
+func (t *limitedTransport) wait(ctx context.Context) error {
+	t.Lock()
+	now := time.Now()
+	start := t.next
+	if start.Before(now) {
+		start = now
+	}
+	t.next = start.Add(t.interval)
+	t.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay postpones all the requests by 'd'.
+func (t *limitedTransport) delay(d time.Duration) {
+	t.Lock()
+	if next := time.Now().Add(d); next.After(t.next) {
+		t.next = next
+	}
+	t.Unlock()
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				// The body cannot be sent again.
+				return nil, fmt.Errorf("%s: cannot retry request", t.service)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			// A RoundTripper must not modify the request.
+			r = new(http.Request)
+			*r = *req
+			r.Body = body
+		}
+
+		if err := t.wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := t.roundTrip(r)
+		if err != nil && req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		if !retryable(resp, err) {
+			return resp, err
+		}
+		if attempt >= t.retries {
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v (%d attempts)", t.service, err, attempt+1)
+			}
+			return resp, nil
+		}
+
+		backoff := retryDelay << uint(attempt)
+		if resp != nil {
+			if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				backoff = d
+			}
+			// Drain the body so that the connection can be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if t.maxDelay > 0 && backoff > t.maxDelay {
+			backoff = t.maxDelay
+		}
+		t.delay(backoff)
+	}
+}
+
+// roundTrip sends 'req' once, within the timeout.
+func (t *limitedTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryable reports whether a request that ended with 'resp' and 'err' is
+// worth retrying.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the value of a 'Retry-After' header, either in seconds or
+// an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		d := time.Until(date)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
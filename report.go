@@ -0,0 +1,186 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// End-of-run summary.
+//
+// Like the progress, the report is fed by the events of the pipeline stages and
+// by the records leaving the pipeline. It sets the exit code of the run.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Exit codes. Fatal errors exit with 1.
+const (
+	exitPartialFailure = 2 // Some files failed.
+	exitFailure        = 3 // All files failed.
+)
+
+// Failure reasons.
+const (
+	reasonInput     = "input"     // The file could not be read.
+	reasonProbe     = "probe"     // FFprobe or the cover analysis failed.
+	reasonScripts   = "scripts"   // A script failed.
+	reasonTransform = "transform" // Transcoding, copying or tagging failed.
+	reasonCover     = "cover"     // A cover could not be transferred.
+)
+
+var report Report
+
+// fileReport is what happened to a record in the pipeline.
+type fileReport struct {
+	reasons    []string
+	discovered bool
+	skipped    bool
+	written    bool
+}
+
+// Report tallies the outcome of every file leaving the pipeline and the reasons
+// of the failures, for the summary and the exit code. The stages report their
+// events from their own goroutines.
+type Report struct {
+	processed int
+	skipped   int
+	suffixed  int
+	failed    int
+	// Number of failed files by reason.
+	reasons map[string]int
+	// Failed paths with their reasons.
+	failedPaths []string
+	// Records in the pipeline.
+	files map[*FileRecord]*fileReport
+	sync.Mutex
+}
+
+// file returns the report of 'fr'. The lock must be held.
+func (r *Report) file(fr *FileRecord) *fileReport {
+	if r.files == nil {
+		r.files = map[*FileRecord]*fileReport{}
+		r.reasons = map[string]int{}
+	}
+	f := r.files[fr]
+	if f == nil {
+		f = &fileReport{}
+		r.files[fr] = f
+	}
+	return f
+}
+
+// Event records 'e', emitted for 'fr'.
+func (r *Report) Event(fr *FileRecord, e Event) {
+	reason := ""
+	switch {
+	case e.Stage == stageDedupe:
+		return
+	case e.Type == eventScriptsFailed:
+		reason = reasonScripts
+	case e.Type != eventFailed:
+	case e.Stage == stageWalker:
+		reason = reasonInput
+	case e.Stage == stageAnalyzer:
+		reason = reasonProbe
+	case e.Track == 0:
+		// Covers are transferred for the whole file.
+		reason = reasonCover
+	default:
+		reason = reasonTransform
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	f := r.file(fr)
+	switch e.Type {
+	case eventDiscovered:
+		f.discovered = true
+	case eventSkipped:
+		f.skipped = true
+	case eventTranscoded, eventTagged:
+		f.written = true
+	}
+	if reason != "" {
+		for _, v := range f.reasons {
+			if v == reason {
+				return
+			}
+		}
+		f.reasons = append(f.reasons, reason)
+	}
+}
+
+// Finish counts 'fr' once it leaves the pipeline.
+func (r *Report) Finish(fr *FileRecord) {
+	r.Lock()
+	defer r.Unlock()
+	f := r.file(fr)
+	delete(r.files, fr)
+
+	switch {
+	case len(f.reasons) > 0:
+		r.failed++
+		for _, reason := range f.reasons {
+			r.reasons[reason]++
+		}
+		r.failedPaths = append(r.failedPaths, fmt.Sprintf("%v (%v)", fr.input.path, strings.Join(f.reasons, ", ")))
+	case f.skipped && !f.written:
+		r.skipped++
+	case f.discovered:
+		r.processed++
+	default:
+		// Not an input file, e.g. a cover in a folder.
+		return
+	}
+
+	for track := range fr.status {
+		output := &fr.output[track]
+		if fr.status[track] == statusExist && output.Write == existWriteSuffix && (!output.Removesource || output.Path != fr.input.path) {
+			r.suffixed++
+			break
+		}
+	}
+}
+
+// Print the summary of the run and the failed paths.
+func (r *Report) Print() {
+	r.Lock()
+	defer r.Unlock()
+	log.Printf("Summary: %v processed, %v skipped, %v suffixed because the destination existed, %v failed",
+		r.processed, r.skipped, r.suffixed, r.failed)
+	if r.failed == 0 {
+		return
+	}
+
+	var reasons []string
+	for reason := range r.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%v %v", r.reasons[reason], reason)
+	}
+	log.Printf("Failures by reason: %v", strings.Join(reasons, ", "))
+
+	sort.Strings(r.failedPaths)
+	log.Print("Failed files:")
+	for _, path := range r.failedPaths {
+		log.Print("  " + path)
+	}
+}
+
+// ExitCode returns the exit code of the run: 0 if no file failed.
+func (r *Report) ExitCode() int {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case r.failed == 0:
+		return 0
+	case r.processed == 0 && r.skipped == 0:
+		return exitFailure
+	}
+	return exitPartialFailure
+}
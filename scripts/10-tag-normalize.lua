@@ -118,6 +118,28 @@ help([[
 tags.date = o.date and o.date:match([[\d\d\d\d+]]) or nil
 tags.date = tags.date and tags.date or (o.year and o.year:match([[\d\d\d\d+]]) or '')
 
+help([[
+- Identifiers and release details, as fetched online or set by Picard, are kept
+  as is: MusicBrainz IDs, ISRC, barcode, catalog number, label, original date,
+  release country and disc and track totals.
+]])
+for _, k in ipairs({
+	'barcode',
+	'catalognumber',
+	'isrc',
+	'label',
+	'musicbrainz_albumartistid',
+	'musicbrainz_albumid',
+	'musicbrainz_artistid',
+	'musicbrainz_trackid',
+	'originaldate',
+	'releasecountry',
+}) do
+	tags[k] = not empty(o[k]) and o[k] or nil
+end
+tags.disctotal = not empty(tags.disc) and not empty(o.disctotal) and o.disctotal:match([[0*(\d*)]]) or nil
+tags.tracktotal = not empty(tags.track) and not empty(o.tracktotal) and o.tracktotal:match([[0*(\d*)]]) or nil
+
 -- Replace all tags.
 output.tags = tags
 o = output.tags
@@ -10,7 +10,7 @@ The input container is kept _only if supported_.
 to set the stream codec, the bitrate, etc.
 
 If 'output.parameters' is {'-c:a', 'copy'} and the format is identical, then
-taglib will be used instead of FFmpeg. Use this rule from a (post)script to
+the tags are set in place instead of using FFmpeg. Use this rule from a (post)script to
 disable encoding by setting the same format and the copy parameters. This speeds
 up the process.
 
@@ -0,0 +1,64 @@
+-- demlo script
+help([[
+Set the ReplayGain or R128 tags from the loudness analysis.
+
+The analysis is only run with '-loudness'. Without it, this script does nothing.
+
+Opus files get the R128_TRACK_GAIN and R128_ALBUM_GAIN tags, relative to
+-23 LUFS as per RFC 7845. Other files get the REPLAYGAIN_* tags, relative to the
+ReplayGain 2.0 reference level of -18 LUFS.
+
+This script must run after the encoding script since the tags depend on the
+output codec.
+
+GLOBAL OPTIONS
+
+- noalbumgain: boolean (default: false)
+  Only set the track tags.
+
+EXAMPLES
+
+	demlo -loudness -s loudness album/
+
+Analyze all tracks of 'album' and set the gain tags.
+]])
+
+local l = input.loudness
+if not l then
+	return
+end
+
+local opus = output.format == 'opus'
+for _, v in ipairs(output.parameters) do
+	if v == 'libopus' or v == 'opus' then
+		opus = true
+	end
+end
+if not opus and #output.parameters == 2 and output.parameters[2] == 'copy' then
+	local stream = input.streams[input.audioindex+1]
+	opus = stream and stream.codec_name == 'opus'
+end
+
+local function r128(gain)
+	-- Q7.8 fixed point number. R128 reference is 5 dB below ReplayGain.
+	return tostring(math.floor((gain - 5) * 256 + 0.5))
+end
+
+-- Remove former gain tags.
+for _, k in ipairs({'replaygain_track_gain', 'replaygain_track_peak', 'replaygain_album_gain', 'replaygain_album_peak', 'r128_track_gain', 'r128_album_gain'}) do
+	o[k] = nil
+end
+
+if opus then
+	o.r128_track_gain = r128(l.trackgain)
+	if not noalbumgain then
+		o.r128_album_gain = r128(l.albumgain)
+	end
+else
+	o.replaygain_track_gain = string.format('%.2f dB', l.trackgain)
+	o.replaygain_track_peak = string.format('%.6f', l.peak)
+	if not noalbumgain then
+		o.replaygain_album_gain = string.format('%.2f dB', l.albumgain)
+		o.replaygain_album_peak = string.format('%.6f', l.albumpeak)
+	end
+end
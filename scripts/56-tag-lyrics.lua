@@ -0,0 +1,46 @@
+-- demlo script
+help([[
+Store the lyrics fetched with '-lyrics'.
+
+Without '-lyrics', or when no lyrics were found, this script does nothing.
+
+The plain lyrics are stored in the 'lyrics' tag. The synced lyrics, if any, are
+written to a sidecar LRC file next to the output file.
+
+This script must run after the tag normalization since the 'lyrics' tag is not
+kept there.
+
+GLOBAL OPTIONS
+
+- nolyricstag: boolean (default: false)
+  Do not set the 'lyrics' tag.
+
+- nolrc: boolean (default: false)
+  Do not write the LRC file.
+
+- syncedtag: boolean (default: false)
+  Store the synced lyrics in the 'lyrics' tag when available.
+
+EXAMPLES
+
+	demlo -lyrics -s lyrics album/
+
+Fetch the lyrics of all tracks of 'album' and store them.
+
+	demlo -lyrics -lyrics-dir ~/lyrics -pre 'nolyricstag=true' -s lyrics album/
+
+Only write the LRC files, looking up the lyrics in '~/lyrics' first.
+]])
+
+local l = input.lyrics
+if not l then
+	return
+end
+
+if not nolyricstag then
+	o.lyrics = (syncedtag and l.synced ~= '') and l.synced or l.plain
+end
+
+if not nolrc and l.synced ~= '' then
+	output.lrc = l.synced
+end
@@ -80,12 +80,36 @@ The format is specified by FFmpeg this time. See the comments on 'format' for
 
 'parameters' is used in the same fashion as 'output.parameters'.
 
+Covers can be embedded into the output audio file with
+
+	output.embedcovers = {
+		embedcover, ...
+	}
+
+'embedcover' has the following structure:
+
+	{
+		source = 'external', -- 'external', 'online' or 'embedded'.
+		name = 'cover basename', -- For external covers.
+		index = 1, -- For embedded covers, as in 'input.embeddedcovers'.
+		type = 'front', -- 'front' or 'back'.
+		format = '', -- e.g. 'mjpeg'.
+		parameters = {},
+	}
+
+The covers are transcoded like 'outputcover' and embedded in order. When
+'output.embedcovers' is not empty, it replaces all the pictures of the output
+file. Embedding is supported for MP3, FLAC, Ogg and MP4 files.
+
 GLOBAL OPTIONS
 
 - ossep: string (default: ']] .. osseparator .. [[')
   OS path separator.
   Separators are replaced by ' - ' in folder names.
 
+- embedcover: boolean (default: false)
+  Embed the first cover that passes the quality checks as front cover.
+
 EXAMPLES
 
 	demlo -p -c -r '' -s cover -s remove_source album/track
@@ -109,6 +133,7 @@ if output.tags.album then
 end
 
 local checksum_list = {}
+local embed = embedcover or false
 
 local function to_jpeg(input_cover, stream, file)
 	stream = stream or 0
@@ -149,6 +174,26 @@ local function to_jpeg(input_cover, stream, file)
 	output_cover.format = 'mjpeg'
 	output_cover.path = dirname .. '/' .. basename .. '.jpg'
 
+	if embed and #output.embedcovers == 0 then
+		local embed_cover = {type = 'front', format = 'mjpeg', parameters = {}}
+		if file then
+			embed_cover.source = 'external'
+			embed_cover.name = file
+		elseif stream ~= 0 then
+			embed_cover.source = 'embedded'
+			embed_cover.index = stream
+		else
+			embed_cover.source = 'online'
+		end
+		-- The cover is piped to FFmpeg: there is only one stream.
+		if max_ratio > 1 then
+			embed_cover.parameters = {output_cover.parameters[1], output_cover.parameters[2], '-c:v', 'mjpeg'}
+		elseif input_cover.format ~= 'jpeg' then
+			embed_cover.parameters = {'-c:v', 'mjpeg'}
+		end
+		output.embedcovers[1] = embed_cover
+	end
+
 	return output_cover
 end
 
@@ -0,0 +1,310 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	flacStreamInfo    = 0
+	flacPadding       = 1
+	flacVorbisComment = 4
+	flacPicture       = 6
+
+	flacMaxBlockSize = 1<<24 - 1
+	// Padding added when the file needs to be rewritten, so that future changes
+	// can be made in place.
+	flacDefaultPadding = 8192
+)
+
+// FFmpeg tag names to Vorbis comment field names. Other tags are uppercased.
+var vorbisNames = map[string]string{
+	"album_artist": "ALBUMARTIST",
+	"disc":         "DISCNUMBER",
+	"track":        "TRACKNUMBER",
+}
+
+var ffmpegVorbisNames = reverse(vorbisNames)
+
+// Comments holding pictures are not tags: they must be preserved.
+var vorbisPictureNames = map[string]bool{
+	"METADATA_BLOCK_PICTURE": true,
+	"COVERART":               true,
+	"COVERARTMIME":           true,
+}
+
+type vorbisComment struct {
+	vendor   string
+	comments []string
+}
+
+// parseVorbisComment parses the comment header without framing.
+func parseVorbisComment(buf []byte) (vorbisComment, error) {
+	var c vorbisComment
+	next := func() (string, bool) {
+		if len(buf) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < n {
+			return "", false
+		}
+		s := string(buf[:n])
+		buf = buf[n:]
+		return s, true
+	}
+
+	var ok bool
+	c.vendor, ok = next()
+	if !ok || len(buf) < 4 {
+		return c, ErrCorrupt
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+	for i := uint32(0); i < count; i++ {
+		s, ok := next()
+		if !ok {
+			return c, ErrCorrupt
+		}
+		c.comments = append(c.comments, s)
+	}
+	return c, nil
+}
+
+func (c vorbisComment) bytes() []byte {
+	size := 4 + len(c.vendor) + 4
+	for _, s := range c.comments {
+		size += 4 + len(s)
+	}
+	buf := make([]byte, 0, size)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(c.vendor)))
+	buf = append(append(buf, n[:]...), c.vendor...)
+	binary.LittleEndian.PutUint32(n[:], uint32(len(c.comments)))
+	buf = append(buf, n[:]...)
+	for _, s := range c.comments {
+		binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+		buf = append(append(buf, n[:]...), s...)
+	}
+	return buf
+}
+
+// set replaces the tags while keeping the pictures.
+func (c *vorbisComment) set(tags map[string]string) {
+	var comments []string
+	for _, s := range c.comments {
+		if vorbisPictureNames[strings.ToUpper(strings.SplitN(s, "=", 2)[0])] {
+			comments = append(comments, s)
+		}
+	}
+	for _, k := range sortedKeys(tags) {
+		name, ok := vorbisNames[k]
+		if !ok {
+			name = strings.ToUpper(k)
+		}
+		comments = append(comments, name+"="+tags[k])
+	}
+	c.comments = comments
+}
+
+// setPictures replaces the pictures with METADATA_BLOCK_PICTURE comments.
+func (c *vorbisComment) setPictures(pictures []Picture) {
+	var comments []string
+	for _, s := range c.comments {
+		if !vorbisPictureNames[strings.ToUpper(strings.SplitN(s, "=", 2)[0])] {
+			comments = append(comments, s)
+		}
+	}
+	for _, p := range pictures {
+		comments = append(comments, "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(p.flacBytes()))
+	}
+	c.comments = comments
+}
+
+func (c vorbisComment) tags() map[string]string {
+	tags := map[string]string{}
+	for _, s := range c.comments {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || vorbisPictureNames[strings.ToUpper(kv[0])] {
+			continue
+		}
+		key, ok := ffmpegVorbisNames[strings.ToUpper(kv[0])]
+		if !ok {
+			key = strings.ToLower(kv[0])
+		}
+		if tags[key] != "" {
+			// Multiple values.
+			tags[key] += ";" + kv[1]
+		} else {
+			tags[key] = kv[1]
+		}
+	}
+	return tags
+}
+
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// readFLACBlocks returns the metadata blocks and the offset of the audio frames.
+func readFLACBlocks(r io.ReaderAt) ([]flacBlock, int64, error) {
+	var blocks []flacBlock
+	offset := int64(4)
+	for {
+		var header [4]byte
+		if _, err := r.ReadAt(header[:], offset); err != nil {
+			return nil, 0, ErrCorrupt
+		}
+		last := header[0]&0x80 != 0
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		b := flacBlock{typ: header[0] & 0x7f, data: make([]byte, size)}
+		if _, err := r.ReadAt(b.data, offset+4); err != nil {
+			return nil, 0, ErrCorrupt
+		}
+		blocks = append(blocks, b)
+		offset += 4 + size
+		if last {
+			break
+		}
+	}
+	if len(blocks) == 0 || blocks[0].typ != flacStreamInfo {
+		return nil, 0, ErrCorrupt
+	}
+	return blocks, offset, nil
+}
+
+func marshalFLACBlocks(blocks []flacBlock) []byte {
+	buf := []byte("fLaC")
+	for i, b := range blocks {
+		header := [4]byte{b.typ, byte(len(b.data) >> 16), byte(len(b.data) >> 8), byte(len(b.data))}
+		if i == len(blocks)-1 {
+			header[0] |= 0x80
+		}
+		buf = append(append(buf, header[:]...), b.data...)
+	}
+	return buf
+}
+
+func readFLAC(f *os.File) (map[string]string, error) {
+	blocks, _, err := readFLACBlocks(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.typ == flacVorbisComment {
+			c, err := parseVorbisComment(b.data)
+			if err != nil {
+				return nil, err
+			}
+			return c.tags(), nil
+		}
+	}
+	return map[string]string{}, nil
+}
+
+// setFLACBlocks writes 'blocks' to 'f', adding padding as needed. If they fit in
+// the existing metadata area, the file is modified in place.
+func setFLACBlocks(f *os.File, blocks []flacBlock, audioOffset int64) error {
+	size := int64(4)
+	for _, b := range blocks {
+		if len(b.data) > flacMaxBlockSize {
+			return ErrUnsupported
+		}
+		size += 4 + int64(len(b.data))
+	}
+
+	if size == audioOffset || size+4 <= audioOffset {
+		if size != audioOffset {
+			blocks = append(blocks, flacBlock{typ: flacPadding, data: make([]byte, audioOffset-size-4)})
+		}
+		_, err := f.WriteAt(marshalFLACBlocks(blocks), 0)
+		return err
+	}
+
+	blocks = append(blocks, flacBlock{typ: flacPadding, data: make([]byte, flacDefaultPadding)})
+	return rewrite(f, func(w io.Writer) error {
+		if _, err := w.Write(marshalFLACBlocks(blocks)); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, io.NewSectionReader(f, audioOffset, 1<<62))
+		return err
+	})
+}
+
+// editFLAC applies 'edit' on the metadata blocks of 'f', padding excluded.
+func editFLAC(f *os.File, edit func([]flacBlock) []flacBlock) error {
+	blocks, audioOffset, err := readFLACBlocks(f)
+	if err != nil {
+		return err
+	}
+	var result []flacBlock
+	for _, b := range blocks {
+		// Padding is recomputed.
+		if b.typ != flacPadding {
+			result = append(result, b)
+		}
+	}
+	return setFLACBlocks(f, edit(result), audioOffset)
+}
+
+func writeFLAC(f *os.File, tags map[string]string) error {
+	return editFLAC(f, func(blocks []flacBlock) []flacBlock {
+		var result []flacBlock
+		found := false
+		for _, b := range blocks {
+			if b.typ != flacVorbisComment {
+				result = append(result, b)
+				continue
+			}
+			if found {
+				// Only one comment block is allowed.
+				continue
+			}
+			found = true
+			c, err := parseVorbisComment(b.data)
+			if err != nil {
+				c = vorbisComment{}
+			}
+			c.set(tags)
+			result = append(result, flacBlock{typ: flacVorbisComment, data: c.bytes()})
+		}
+		if !found {
+			c := vorbisComment{}
+			c.set(tags)
+			// Right after STREAMINFO.
+			result = append(result[:1], append([]flacBlock{{typ: flacVorbisComment, data: c.bytes()}}, result[1:]...)...)
+		}
+		return result
+	})
+}
+
+func setFLACPictures(f *os.File, pictures []Picture) error {
+	return editFLAC(f, func(blocks []flacBlock) []flacBlock {
+		var result []flacBlock
+		for _, b := range blocks {
+			switch b.typ {
+			case flacPicture:
+				continue
+			case flacVorbisComment:
+				// Legacy pictures stored in comments.
+				if c, err := parseVorbisComment(b.data); err == nil {
+					c.setPictures(nil)
+					b.data = c.bytes()
+				}
+			}
+			result = append(result, b)
+		}
+		for _, p := range pictures {
+			result = append(result, flacBlock{typ: flacPicture, data: p.flacBytes()})
+		}
+		return result
+	})
+}
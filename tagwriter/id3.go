@@ -0,0 +1,519 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	id3HeaderSize = 10
+	// Padding added when the file needs to be rewritten.
+	id3DefaultPadding = 1024
+
+	id3FlagUnsync   = 0x80
+	id3FlagExtended = 0x40
+	id3FlagFooter   = 0x10
+
+	// Frame format flags that make the data not plain text: grouping,
+	// compression, encryption and, in ID3v2.4, data length indicator.
+	id3FrameFlagsV3 = 0xE0
+	id3FrameFlagsV4 = 0x4D
+
+	id3EncodingLatin1  = 0
+	id3EncodingUTF16   = 1
+	id3EncodingUTF16BE = 2
+	id3EncodingUTF8    = 3
+)
+
+// FFmpeg tag names to ID3v2 text frames. Other tags are stored in TXXX frames,
+// except the MusicBrainz recording ID and the lowercased IDs of other text
+// frames, e.g. "tbpm".
+var id3Frames = map[string]string{
+	"album":        "TALB",
+	"album_artist": "TPE2",
+	"album-sort":   "TSOA",
+	"artist":       "TPE1",
+	"artist-sort":  "TSOP",
+	"bpm":          "TBPM",
+	"comment":      "COMM",
+	"compilation":  "TCMP",
+	"composer":     "TCOM",
+	"copyright":    "TCOP",
+	"date":         "TDRC",
+	"disc":         "TPOS",
+	"encoded_by":   "TENC",
+	"encoder":      "TSSE",
+	"genre":        "TCON",
+	"grouping":     "TIT1",
+	"isrc":         "TSRC",
+	"label":        "TPUB",
+	"language":     "TLAN",
+	"lyrics":       "USLT",
+	"originaldate": "TDOR",
+	"performer":    "TPE3",
+	"publisher":    "TPUB",
+	"title":        "TIT2",
+	"title-sort":   "TSOT",
+	"track":        "TRCK",
+}
+
+var id3Names = reverse(id3Frames)
+
+const (
+	// Owner of the UFID frame holding the MusicBrainz recording ID.
+	id3MusicBrainzOwner = "http://musicbrainz.org"
+	id3MusicBrainzTag   = "musicbrainz_trackid"
+)
+
+// Dates in the ID3v2.3 frames: TYER holds the year and TDAT the day and month.
+var reID3Date = regexp.MustCompile(`^(\d{4})(?:-(\d\d)-(\d\d))?`)
+
+func init() {
+	// Read as FFmpeg does.
+	id3Names["TPUB"] = "publisher"
+	// ID3v2.3 equivalents.
+	id3Names["TYER"] = "date"
+	id3Names["TORY"] = "originaldate"
+}
+
+type id3Frame struct {
+	id    string
+	flags [2]byte
+	data  []byte
+}
+
+type id3Tag struct {
+	version byte
+	frames  []id3Frame
+	// Size of the tag on disk, header included. 0 if the file has no tag.
+	size int64
+}
+
+// removeUnsync reverts the unsynchronisation scheme: 0xFF 0x00 becomes 0xFF.
+func removeUnsync(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+}
+
+func readID3Tag(r io.ReaderAt) (*id3Tag, error) {
+	var header [id3HeaderSize]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil || string(header[:3]) != "ID3" {
+		// No tag.
+		return &id3Tag{version: 4}, nil
+	}
+	t := &id3Tag{version: header[3]}
+	if t.version != 3 && t.version != 4 {
+		return nil, ErrUnsupported
+	}
+	flags := header[5]
+	size := int64(syncsafe(header[6:]))
+	t.size = id3HeaderSize + size
+	if flags&id3FlagFooter != 0 {
+		t.size += id3HeaderSize
+	}
+
+	body := make([]byte, size)
+	if _, err := r.ReadAt(body, id3HeaderSize); err != nil {
+		return nil, ErrCorrupt
+	}
+	if t.version == 3 && flags&id3FlagUnsync != 0 {
+		body = removeUnsync(body)
+	}
+	if flags&id3FlagExtended != 0 {
+		if len(body) < 4 {
+			return nil, ErrCorrupt
+		}
+		var n int
+		if t.version == 3 {
+			n = 4 + int(binary.BigEndian.Uint32(body))
+		} else {
+			n = int(syncsafe(body))
+		}
+		if n > len(body) {
+			return nil, ErrCorrupt
+		}
+		body = body[n:]
+	}
+
+	for len(body) >= id3HeaderSize && body[0] != 0 {
+		f := id3Frame{id: string(body[:4])}
+		var n int
+		if t.version == 3 {
+			n = int(binary.BigEndian.Uint32(body[4:]))
+		} else {
+			n = int(syncsafe(body[4:]))
+		}
+		copy(f.flags[:], body[8:10])
+		body = body[id3HeaderSize:]
+		if n > len(body) {
+			return nil, ErrCorrupt
+		}
+		f.data = body[:n]
+		body = body[n:]
+		if t.version == 4 && (flags&id3FlagUnsync != 0 || f.flags[1]&0x02 != 0) {
+			f.data = removeUnsync(f.data)
+			f.flags[1] &^= 0x02
+		}
+		t.frames = append(t.frames, f)
+	}
+	return t, nil
+}
+
+func decodeID3Text(encoding byte, b []byte) string {
+	switch encoding {
+	case id3EncodingLatin1:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r)
+	case id3EncodingUTF16, id3EncodingUTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == id3EncodingUTF16 && len(b) >= 2 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			if (b[0] == 0xFF && b[1] == 0xFE) || (b[0] == 0xFE && b[1] == 0xFF) {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return string(b)
+}
+
+// splitID3Text splits 'b' at the first terminator of the given encoding.
+func splitID3Text(encoding byte, b []byte) ([]byte, []byte) {
+	if encoding == id3EncodingUTF16 || encoding == id3EncodingUTF16BE {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// text returns the tag name and value of text frames. 'ok' is false for other
+// frames. The frame flags depend on the tag 'version'.
+func (f id3Frame) text(version byte) (name, value string, ok bool) {
+	mask := byte(id3FrameFlagsV4)
+	if version == 3 {
+		mask = id3FrameFlagsV3
+	}
+	if len(f.data) == 0 || f.flags[1]&mask != 0 {
+		return "", "", false
+	}
+	if f.id == "UFID" {
+		owner, id := splitID3Text(id3EncodingLatin1, f.data)
+		if string(owner) != id3MusicBrainzOwner {
+			return "", "", false
+		}
+		return id3MusicBrainzTag, string(id), true
+	}
+	encoding, data := f.data[0], f.data[1:]
+	switch {
+	case f.id == "TXXX":
+		desc, rest := splitID3Text(encoding, data)
+		name = userTagName(decodeID3Text(encoding, desc))
+		data = rest
+	case f.id == "COMM" || f.id == "USLT":
+		if len(data) < 3 {
+			return "", "", false
+		}
+		desc, rest := splitID3Text(encoding, data[3:])
+		if len(desc) != 0 {
+			// Only the main comment is managed.
+			return "", "", false
+		}
+		name = id3Names[f.id]
+		data = rest
+	case f.id[0] == 'T':
+		// Other text frames are named after their lowercased ID, which
+		// newID3TextFrame maps back.
+		name, ok = id3Names[f.id]
+		if !ok {
+			name = strings.ToLower(f.id)
+		}
+	default:
+		return "", "", false
+	}
+
+	// Multiple values are separated by null characters in ID3v2.4.
+	var values []string
+	for len(data) > 0 {
+		var v []byte
+		v, data = splitID3Text(encoding, data)
+		values = append(values, decodeID3Text(encoding, v))
+	}
+	return name, strings.Join(values, ";"), true
+}
+
+// id3Encoding returns the text encoding able to represent all of 'strs'.
+func id3Encoding(version byte, strs ...string) byte {
+	if version == 4 {
+		return id3EncodingUTF8
+	}
+	for _, s := range strs {
+		for _, r := range s {
+			if r > 0xFF {
+				return id3EncodingUTF16
+			}
+		}
+	}
+	return id3EncodingLatin1
+}
+
+// encodeID3Text encodes 's' with terminator using 'encoding'.
+func encodeID3Text(encoding byte, s string) []byte {
+	switch encoding {
+	case id3EncodingLatin1:
+		b := make([]byte, 0, len(s)+1)
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+		return append(b, 0)
+	case id3EncodingUTF16:
+		b := []byte{0xFF, 0xFE}
+		for _, c := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(c), byte(c>>8))
+		}
+		return append(b, 0, 0)
+	}
+	return append([]byte(s), 0)
+}
+
+// isID3TextID reports whether 'name' is the lowercased ID of a standard text
+// frame, e.g. "tbpm".
+func isID3TextID(name string) bool {
+	if len(name) != 4 || name[0] != 't' || name == "txxx" {
+		return false
+	}
+	for _, c := range name[1:] {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID3TextFrame(version byte, name, value string) id3Frame {
+	if name == id3MusicBrainzTag {
+		return id3Frame{id: "UFID", data: append([]byte(id3MusicBrainzOwner+"\x00"), value...)}
+	}
+	id, ok := id3Frames[name]
+	if !ok {
+		id = "TXXX"
+		if isID3TextID(name) {
+			id = strings.ToUpper(name)
+		}
+	}
+
+	var encoding byte
+	var desc []byte
+	switch id {
+	case "TXXX":
+		// The description uses the same encoding as the value.
+		d := userDescription(name)
+		encoding = id3Encoding(version, d, value)
+		desc = encodeID3Text(encoding, d)
+	case "COMM", "USLT":
+		encoding = id3Encoding(version, value)
+		desc = append([]byte("XXX"), encodeID3Text(encoding, "")...)
+	default:
+		encoding = id3Encoding(version, value)
+	}
+
+	data := append([]byte{encoding}, desc...)
+	data = append(data, encodeID3Text(encoding, value)...)
+	return id3Frame{id: id, data: data}
+}
+
+func (t *id3Tag) tags() map[string]string {
+	tags := map[string]string{}
+	for _, f := range t.frames {
+		name, value, ok := f.text(t.version)
+		if !ok {
+			continue
+		}
+		if tags[name] != "" {
+			tags[name] += ";" + value
+		} else {
+			tags[name] = value
+		}
+	}
+	if day := tags["tdat"]; t.version == 3 && len(day) == 4 && len(tags["date"]) == 4 {
+		tags["date"] += "-" + day[2:] + "-" + day[:2]
+		delete(tags, "tdat")
+	}
+	return tags
+}
+
+// id3v3Dates returns the ID3v2.3 frames of 'date' or 'originaldate'. Only the
+// year of 'originaldate' fits in TORY. Dates that do not start with a year are
+// dropped.
+func id3v3Dates(name, value string) []id3Frame {
+	m := reID3Date.FindStringSubmatch(value)
+	if m == nil {
+		return nil
+	}
+	if name == "originaldate" {
+		return []id3Frame{newID3TextFrame(3, "tory", m[1])}
+	}
+	frames := []id3Frame{newID3TextFrame(3, "tyer", m[1])}
+	if m[2] != "" {
+		frames = append(frames, newID3TextFrame(3, "tdat", m[3]+m[2]))
+	}
+	return frames
+}
+
+// set replaces the text frames while keeping the others.
+func (t *id3Tag) set(tags map[string]string) {
+	var frames []id3Frame
+	for _, f := range t.frames {
+		if _, _, ok := f.text(t.version); !ok {
+			frames = append(frames, f)
+		}
+	}
+	tags = pairTotals(tags)
+	for _, k := range sortedKeys(tags) {
+		if t.version == 3 && (k == "date" || k == "originaldate") {
+			frames = append(frames, id3v3Dates(k, tags[k])...)
+			continue
+		}
+		frames = append(frames, newID3TextFrame(t.version, k, tags[k]))
+	}
+	t.frames = frames
+}
+
+// bytes returns the tag with 'padding' null bytes.
+func (t *id3Tag) bytes(padding int) []byte {
+	buf := make([]byte, id3HeaderSize)
+	copy(buf, "ID3")
+	buf[3] = t.version
+	for _, f := range t.frames {
+		var header [id3HeaderSize]byte
+		copy(header[:], f.id)
+		if t.version == 3 {
+			binary.BigEndian.PutUint32(header[4:], uint32(len(f.data)))
+		} else {
+			putSyncsafe(header[4:], uint32(len(f.data)))
+		}
+		copy(header[8:], f.flags[:])
+		buf = append(append(buf, header[:]...), f.data...)
+	}
+	buf = append(buf, make([]byte, padding)...)
+	putSyncsafe(buf[6:], uint32(len(buf)-id3HeaderSize))
+	return buf
+}
+
+// id3v1Size returns the size of the ID3v1 tag at the end of 'f', if any.
+func id3v1Size(f *os.File) (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() < 128 {
+		return 0, nil
+	}
+	var magic [3]byte
+	if _, err := f.ReadAt(magic[:], st.Size()-128); err != nil {
+		return 0, err
+	}
+	if string(magic[:]) == "TAG" {
+		return 128, nil
+	}
+	return 0, nil
+}
+
+func readID3(f *os.File) (map[string]string, error) {
+	t, err := readID3Tag(f)
+	if err != nil {
+		return nil, err
+	}
+	return t.tags(), nil
+}
+
+// editID3 applies 'edit' on the tag of 'f' and saves it.
+func editID3(f *os.File, edit func(*id3Tag)) error {
+	t, err := readID3Tag(f)
+	if err != nil {
+		return err
+	}
+	edit(t)
+
+	// ID3v1 is limited and would shadow the new tags in some players. It is
+	// only dropped once the new tag is saved.
+	v1, err := id3v1Size(f)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := st.Size() - v1
+
+	buf := t.bytes(0)
+	if int64(len(buf)) <= t.size {
+		buf = t.bytes(int(t.size) - len(buf))
+		if _, err := f.WriteAt(buf, 0); err != nil {
+			return err
+		}
+		if v1 != 0 {
+			return f.Truncate(end)
+		}
+		return nil
+	}
+
+	buf = t.bytes(id3DefaultPadding)
+	return rewrite(f, func(w io.Writer) error {
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, io.NewSectionReader(f, t.size, end-t.size))
+		return err
+	})
+}
+
+func writeID3(f *os.File, tags map[string]string) error {
+	return editID3(f, func(t *id3Tag) { t.set(tags) })
+}
+
+func newID3Picture(version byte, p Picture) id3Frame {
+	encoding := id3Encoding(version, p.Description)
+	data := append([]byte{encoding}, p.MIME...)
+	data = append(data, 0, byte(p.Type))
+	data = append(data, encodeID3Text(encoding, p.Description)...)
+	return id3Frame{id: "APIC", data: append(data, p.Data...)}
+}
+
+func setID3Pictures(f *os.File, pictures []Picture) error {
+	return editID3(f, func(t *id3Tag) {
+		var frames []id3Frame
+		for _, f := range t.frames {
+			if f.id != "APIC" {
+				frames = append(frames, f)
+			}
+		}
+		for _, p := range pictures {
+			frames = append(frames, newID3Picture(t.version, p))
+		}
+		t.frames = frames
+	})
+}
@@ -0,0 +1,593 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	mp4DataUTF8 = 1
+	mp4DataGIF  = 12
+	mp4DataJPEG = 13
+	mp4DataPNG  = 14
+	mp4DataInt  = 21
+	mp4DataBMP  = 27
+
+	// Free space added after 'moov' when the file needs to be rewritten.
+	mp4DefaultPadding = 2048
+	// Namespace of freeform atoms.
+	mp4FreeformMean = "com.apple.iTunes"
+)
+
+// FFmpeg tag names to MP4 item atoms. Other tags are stored in freeform atoms.
+var mp4Items = map[string]string{
+	"album":         "\xa9alb",
+	"album_artist":  "aART",
+	"artist":        "\xa9ART",
+	"comment":       "\xa9cmt",
+	"composer":      "\xa9wrt",
+	"copyright":     "cprt",
+	"date":          "\xa9day",
+	"description":   "desc",
+	"encoder":       "\xa9too",
+	"genre":         "\xa9gen",
+	"grouping":      "\xa9grp",
+	"lyrics":        "\xa9lyr",
+	"show":          "tvsh",
+	"title":         "\xa9nam",
+	"synopsis":      "ldes",
+	"album-sort":    "soal",
+	"artist-sort":   "soar",
+	"title-sort":    "sonm",
+	"composer-sort": "soco",
+	// Binary items.
+	"compilation":      "cpil",
+	"disc":             "disk",
+	"episode_sort":     "tves",
+	"gapless_playback": "pgap",
+	"hd_video":         "hdvd",
+	"media_type":       "stik",
+	"podcast":          "pcst",
+	"rating":           "rtng",
+	"season_number":    "tvsn",
+	"track":            "trkn",
+}
+
+var mp4Names = reverse(mp4Items)
+
+// Size in bytes of integer items.
+var mp4IntSizes = map[string]int{
+	"cpil": 1,
+	"hdvd": 1,
+	"pcst": 1,
+	"pgap": 1,
+	"rtng": 1,
+	"stik": 1,
+	"tves": 4,
+	"tvsn": 4,
+}
+
+type mp4Box struct {
+	typ string
+	// Offset of the box header in the file.
+	offset int64
+	size   int64
+	// Header size: 8, or 16 for 64-bit sizes.
+	header int64
+}
+
+// readMP4Boxes returns the boxes in the [start, end) range of 'r'.
+func readMP4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := start; offset+8 <= end; {
+		var buf [16]byte
+		if _, err := r.ReadAt(buf[:8], offset); err != nil {
+			return nil, ErrCorrupt
+		}
+		b := mp4Box{typ: string(buf[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(buf[:])), header: 8}
+		switch b.size {
+		case 0:
+			// Box extends to the end.
+			b.size = end - offset
+		case 1:
+			if _, err := r.ReadAt(buf[8:], offset+8); err != nil {
+				return nil, ErrCorrupt
+			}
+			b.size = int64(binary.BigEndian.Uint64(buf[8:]))
+			b.header = 16
+		}
+		if b.size < b.header || offset+b.size > end {
+			return nil, ErrCorrupt
+		}
+		boxes = append(boxes, b)
+		offset += b.size
+	}
+	return boxes, nil
+}
+
+func findMP4Box(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// An atom is an in-memory box: its payload is the data after the header.
+type mp4Atom struct {
+	typ     string
+	payload []byte
+}
+
+func parseMP4Atoms(buf []byte) ([]mp4Atom, error) {
+	var atoms []mp4Atom
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, ErrCorrupt
+		}
+		size := int(binary.BigEndian.Uint32(buf))
+		if size < 8 || size > len(buf) {
+			return nil, ErrCorrupt
+		}
+		atoms = append(atoms, mp4Atom{typ: string(buf[4:8]), payload: buf[8:size]})
+		buf = buf[size:]
+	}
+	return atoms, nil
+}
+
+func marshalMP4Atoms(atoms []mp4Atom) []byte {
+	var buf []byte
+	for _, a := range atoms {
+		buf = append(buf, a.bytes()...)
+	}
+	return buf
+}
+
+func (a mp4Atom) bytes() []byte {
+	buf := make([]byte, 8, 8+len(a.payload))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(a.payload)))
+	copy(buf[4:], a.typ)
+	return append(buf, a.payload...)
+}
+
+// mp4Data returns a 'data' atom.
+func mp4Data(class uint32, value []byte) mp4Atom {
+	payload := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint32(payload, class)
+	return mp4Atom{typ: "data", payload: append(payload, value...)}
+}
+
+// mp4Pair encodes "N/M" into the 'trkn' or 'disk' binary format.
+func mp4Pair(typ, value string) []byte {
+	parts := strings.SplitN(value, "/", 2)
+	n, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+	m := 0
+	if len(parts) == 2 {
+		m, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint16(buf[2:], uint16(n))
+	binary.BigEndian.PutUint16(buf[4:], uint16(m))
+	if typ == "trkn" {
+		buf = append(buf, 0, 0)
+	}
+	return buf
+}
+
+func newMP4Item(name, value string) mp4Atom {
+	typ, ok := mp4Items[name]
+	if !ok {
+		var payload []byte
+		payload = append(payload, mp4Atom{typ: "mean", payload: append([]byte{0, 0, 0, 0}, mp4FreeformMean...)}.bytes()...)
+		payload = append(payload, mp4Atom{typ: "name", payload: append([]byte{0, 0, 0, 0}, userDescription(name)...)}.bytes()...)
+		payload = append(payload, mp4Data(mp4DataUTF8, []byte(value)).bytes()...)
+		return mp4Atom{typ: "----", payload: payload}
+	}
+
+	var data mp4Atom
+	switch {
+	case typ == "trkn" || typ == "disk":
+		data = mp4Data(0, mp4Pair(typ, value))
+	case mp4IntSizes[typ] != 0:
+		n, _ := strconv.ParseUint(value, 10, 32)
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		data = mp4Data(mp4DataInt, buf[4-mp4IntSizes[typ]:])
+	default:
+		data = mp4Data(mp4DataUTF8, []byte(value))
+	}
+	return mp4Atom{typ: typ, payload: data.bytes()}
+}
+
+// text returns the tag name and value of 'item'. 'ok' is false for items that
+// are not managed, e.g. cover art.
+func (item mp4Atom) text() (name, value string, ok bool) {
+	children, err := parseMP4Atoms(item.payload)
+	if err != nil {
+		return "", "", false
+	}
+	var data []byte
+	var class uint32
+	for _, c := range children {
+		switch c.typ {
+		case "name":
+			if len(c.payload) >= 4 {
+				name = userTagName(string(c.payload[4:]))
+			}
+		case "data":
+			if len(c.payload) < 8 || data != nil {
+				continue
+			}
+			class = binary.BigEndian.Uint32(c.payload) & 0xFFFFFF
+			data = c.payload[8:]
+		}
+	}
+	if data == nil {
+		return "", "", false
+	}
+
+	if item.typ == "----" {
+		if name == "" || class != mp4DataUTF8 {
+			return "", "", false
+		}
+		return name, string(data), true
+	}
+	name, ok = mp4Names[item.typ]
+	if !ok {
+		return "", "", false
+	}
+
+	switch {
+	case item.typ == "trkn" || item.typ == "disk":
+		if len(data) < 6 {
+			return "", "", false
+		}
+		n, m := binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:])
+		value = strconv.Itoa(int(n))
+		if m != 0 {
+			value += "/" + strconv.Itoa(int(m))
+		}
+	case mp4IntSizes[item.typ] != 0:
+		var n uint64
+		for _, b := range data {
+			n = n<<8 | uint64(b)
+		}
+		value = strconv.FormatUint(n, 10)
+	default:
+		if class != mp4DataUTF8 {
+			return "", "", false
+		}
+		value = string(data)
+	}
+	return name, value, true
+}
+
+// mp4File locates the metadata of an MP4 file.
+type mp4File struct {
+	f    *os.File
+	size int64
+	top  []mp4Box
+	moov mp4Box
+	// Children of 'moov' in memory.
+	atoms []mp4Atom
+}
+
+func openMP4(f *os.File) (*mp4File, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mp4File{f: f, size: st.Size()}
+	m.top, err = readMP4Boxes(f, 0, m.size)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := findMP4Box(m.top, "moof"); ok {
+		// Fragmented files would need 'tfhd' offsets to be updated too.
+		return nil, ErrUnsupported
+	}
+	var ok bool
+	m.moov, ok = findMP4Box(m.top, "moov")
+	if !ok || m.moov.header != 8 {
+		return nil, ErrCorrupt
+	}
+	buf := make([]byte, m.moov.size-m.moov.header)
+	if _, err := f.ReadAt(buf, m.moov.offset+m.moov.header); err != nil {
+		return nil, ErrCorrupt
+	}
+	m.atoms, err = parseMP4Atoms(buf)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// isFullMeta reports whether the 'meta' payload starts with version and flags.
+// Some QuickTime files omit them.
+func isFullMeta(payload []byte) bool {
+	return len(payload) < 8 || string(payload[4:8]) != "hdlr"
+}
+
+// ilst returns the items of moov.udta.meta.ilst.
+func (m *mp4File) ilst() ([]mp4Atom, error) {
+	for _, udta := range m.atoms {
+		if udta.typ != "udta" {
+			continue
+		}
+		children, err := parseMP4Atoms(udta.payload)
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range children {
+			if meta.typ != "meta" {
+				continue
+			}
+			payload := meta.payload
+			if isFullMeta(payload) {
+				if len(payload) < 4 {
+					return nil, ErrCorrupt
+				}
+				payload = payload[4:]
+			}
+			children, err := parseMP4Atoms(payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, ilst := range children {
+				if ilst.typ == "ilst" {
+					return parseMP4Atoms(ilst.payload)
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// replaceChild replaces the first child of type 'typ' with 'a', or appends it.
+func replaceChild(atoms []mp4Atom, a mp4Atom) []mp4Atom {
+	for i := range atoms {
+		if atoms[i].typ == a.typ {
+			atoms[i] = a
+			return atoms
+		}
+	}
+	return append(atoms, a)
+}
+
+func childOf(atoms []mp4Atom, typ string) (mp4Atom, bool) {
+	for _, a := range atoms {
+		if a.typ == typ {
+			return a, true
+		}
+	}
+	return mp4Atom{}, false
+}
+
+// setIlst replaces moov.udta.meta.ilst, creating the parents as needed.
+func (m *mp4File) setIlst(items []mp4Atom) error {
+	ilst := mp4Atom{typ: "ilst", payload: marshalMP4Atoms(items)}
+
+	udta, _ := childOf(m.atoms, "udta")
+	udta.typ = "udta"
+	udtaChildren, err := parseMP4Atoms(udta.payload)
+	if err != nil {
+		return err
+	}
+
+	meta, ok := childOf(udtaChildren, "meta")
+	var prefix, payload []byte
+	if ok {
+		payload = meta.payload
+		if isFullMeta(payload) {
+			prefix, payload = payload[:4], payload[4:]
+		}
+	} else {
+		meta.typ = "meta"
+		prefix = []byte{0, 0, 0, 0}
+	}
+	metaChildren, err := parseMP4Atoms(payload)
+	if err != nil {
+		return err
+	}
+	if _, ok := childOf(metaChildren, "hdlr"); !ok {
+		hdlr := mp4Atom{typ: "hdlr", payload: make([]byte, 25)}
+		copy(hdlr.payload[8:], "mdirappl")
+		metaChildren = append([]mp4Atom{hdlr}, metaChildren...)
+	}
+	metaChildren = replaceChild(metaChildren, ilst)
+	meta.payload = append(append([]byte{}, prefix...), marshalMP4Atoms(metaChildren)...)
+
+	udta.payload = marshalMP4Atoms(replaceChild(udtaChildren, meta))
+	m.atoms = replaceChild(m.atoms, udta)
+	return nil
+}
+
+// shiftChunkOffsets adds 'delta' to the chunk offsets of all tracks that point
+// after 'moov'.
+func shiftChunkOffsets(atoms []mp4Atom, limit, delta int64) error {
+	for i := range atoms {
+		a := &atoms[i]
+		switch a.typ {
+		case "trak", "mdia", "minf", "stbl":
+			children, err := parseMP4Atoms(a.payload)
+			if err != nil {
+				return err
+			}
+			if err := shiftChunkOffsets(children, limit, delta); err != nil {
+				return err
+			}
+			a.payload = marshalMP4Atoms(children)
+		case "stco", "co64":
+			if len(a.payload) < 8 {
+				return ErrCorrupt
+			}
+			payload := append([]byte{}, a.payload...)
+			count := int(binary.BigEndian.Uint32(payload[4:]))
+			width := 4
+			if a.typ == "co64" {
+				width = 8
+			}
+			if len(payload) < 8+count*width {
+				return ErrCorrupt
+			}
+			for j := 0; j < count; j++ {
+				p := payload[8+j*width:]
+				if width == 4 {
+					o := int64(binary.BigEndian.Uint32(p))
+					if o > limit {
+						o += delta
+						if o > 0xFFFFFFFF {
+							return fmt.Errorf("mp4: chunk offset overflow")
+						}
+						binary.BigEndian.PutUint32(p, uint32(o))
+					}
+				} else {
+					o := int64(binary.BigEndian.Uint64(p))
+					if o > limit {
+						binary.BigEndian.PutUint64(p, uint64(o+delta))
+					}
+				}
+			}
+			a.payload = payload
+		}
+	}
+	return nil
+}
+
+// save writes 'moov' back. If it fits in its former place, possibly using the
+// 'free' box that follows, the file is modified in place.
+func (m *mp4File) save() error {
+	moov := mp4Atom{typ: "moov", payload: marshalMP4Atoms(m.atoms)}
+	size := int64(8 + len(moov.payload))
+	end := m.moov.offset + m.moov.size
+
+	// Space available in place.
+	available := m.moov.size
+	last := end == m.size
+	for _, b := range m.top {
+		if b.offset == end && (b.typ == "free" || b.typ == "skip") {
+			available += b.size
+		}
+	}
+
+	if last {
+		if _, err := m.f.WriteAt(moov.bytes(), m.moov.offset); err != nil {
+			return err
+		}
+		return m.f.Truncate(m.moov.offset + size)
+	}
+	if size == available || size+8 <= available {
+		buf := moov.bytes()
+		if size != available {
+			buf = append(buf, mp4Atom{typ: "free", payload: make([]byte, available-size-8)}.bytes()...)
+		}
+		_, err := m.f.WriteAt(buf, m.moov.offset)
+		return err
+	}
+
+	// The data after 'moov' is shifted: chunk offsets must follow.
+	padding := mp4Atom{typ: "free", payload: make([]byte, mp4DefaultPadding)}
+	delta := size + int64(len(padding.payload)+8) - available
+	if err := shiftChunkOffsets(m.atoms, m.moov.offset, delta); err != nil {
+		return err
+	}
+	moov.payload = marshalMP4Atoms(m.atoms)
+
+	return rewrite(m.f, func(w io.Writer) error {
+		if _, err := io.Copy(w, io.NewSectionReader(m.f, 0, m.moov.offset)); err != nil {
+			return err
+		}
+		if _, err := w.Write(append(moov.bytes(), padding.bytes()...)); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, io.NewSectionReader(m.f, m.moov.offset+available, 1<<62))
+		return err
+	})
+}
+
+func readMP4(f *os.File) (map[string]string, error) {
+	m, err := openMP4(f)
+	if err != nil {
+		return nil, err
+	}
+	items, err := m.ilst()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, item := range items {
+		if name, value, ok := item.text(); ok {
+			tags[name] = value
+		}
+	}
+	return tags, nil
+}
+
+// editMP4 applies 'edit' on the items of 'f' and saves them.
+func editMP4(f *os.File, edit func([]mp4Atom) []mp4Atom) error {
+	m, err := openMP4(f)
+	if err != nil {
+		return err
+	}
+	items, err := m.ilst()
+	if err != nil {
+		return err
+	}
+	if err := m.setIlst(edit(items)); err != nil {
+		return err
+	}
+	return m.save()
+}
+
+func writeMP4(f *os.File, tags map[string]string) error {
+	return editMP4(f, func(items []mp4Atom) []mp4Atom {
+		var result []mp4Atom
+		for _, item := range items {
+			if _, _, ok := item.text(); !ok {
+				result = append(result, item)
+			}
+		}
+		tags := pairTotals(tags)
+		for _, k := range sortedKeys(tags) {
+			result = append(result, newMP4Item(k, tags[k]))
+		}
+		return result
+	})
+}
+
+// MP4 has no picture type: all pictures go to the same 'covr' item.
+func setMP4Pictures(f *os.File, pictures []Picture) error {
+	return editMP4(f, func(items []mp4Atom) []mp4Atom {
+		var result []mp4Atom
+		for _, item := range items {
+			if item.typ != "covr" {
+				result = append(result, item)
+			}
+		}
+		if len(pictures) == 0 {
+			return result
+		}
+		covr := mp4Atom{typ: "covr"}
+		for _, p := range pictures {
+			class := uint32(mp4DataJPEG)
+			switch p.MIME {
+			case "image/png":
+				class = mp4DataPNG
+			case "image/gif":
+				class = mp4DataGIF
+			case "image/bmp":
+				class = mp4DataBMP
+			}
+			covr.payload = append(covr.payload, mp4Data(class, p.Data).bytes()...)
+		}
+		return append(result, covr)
+	})
+}
@@ -0,0 +1,279 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	oggContinued = 0x01
+	oggBOS       = 0x02
+
+	oggHeaderSize  = 27
+	oggMaxSegments = 255
+)
+
+var (
+	oggCRCTable [256]uint32
+
+	vorbisIDPrefix      = []byte("\x01vorbis")
+	vorbisCommentPrefix = []byte("\x03vorbis")
+	opusIDPrefix        = []byte("OpusHead")
+	opusCommentPrefix   = []byte("OpusTags")
+)
+
+func init() {
+	// CRC32 with polynomial 0x04c11db7, no reflection.
+	for i := range oggCRCTable {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		oggCRCTable[i] = r
+	}
+}
+
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	sequence   uint32
+	segments   []byte
+	data       []byte
+}
+
+func readOggPage(r io.Reader) (oggPage, error) {
+	var p oggPage
+	var header [oggHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return p, err
+	}
+	if string(header[:4]) != "OggS" || header[4] != 0 {
+		return p, ErrCorrupt
+	}
+	p.headerType = header[5]
+	p.granule = binary.LittleEndian.Uint64(header[6:])
+	p.serial = binary.LittleEndian.Uint32(header[14:])
+	p.sequence = binary.LittleEndian.Uint32(header[18:])
+	p.segments = make([]byte, header[26])
+	if _, err := io.ReadFull(r, p.segments); err != nil {
+		return p, ErrCorrupt
+	}
+	size := 0
+	for _, s := range p.segments {
+		size += int(s)
+	}
+	p.data = make([]byte, size)
+	if _, err := io.ReadFull(r, p.data); err != nil {
+		return p, ErrCorrupt
+	}
+	return p, nil
+}
+
+func (p oggPage) bytes() []byte {
+	buf := make([]byte, oggHeaderSize, oggHeaderSize+len(p.segments)+len(p.data))
+	copy(buf, "OggS")
+	buf[5] = p.headerType
+	binary.LittleEndian.PutUint64(buf[6:], p.granule)
+	binary.LittleEndian.PutUint32(buf[14:], p.serial)
+	binary.LittleEndian.PutUint32(buf[18:], p.sequence)
+	buf[26] = byte(len(p.segments))
+	buf = append(append(buf, p.segments...), p.data...)
+
+	var crc uint32
+	for _, b := range buf {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(buf[22:], crc)
+	return buf
+}
+
+// paginate splits 'packets' into pages starting at 'sequence'. All packets are
+// header packets: the granule position is 0 on pages where a packet ends.
+func paginate(packets [][]byte, serial, sequence uint32) []oggPage {
+	var pages []oggPage
+	page := oggPage{serial: serial, sequence: sequence, granule: ^uint64(0)}
+	flush := func(continued bool) {
+		pages = append(pages, page)
+		page = oggPage{serial: serial, sequence: page.sequence + 1, granule: ^uint64(0)}
+		if continued {
+			page.headerType = oggContinued
+		}
+	}
+
+	for _, packet := range packets {
+		for rest := packet; ; {
+			if len(page.segments) == oggMaxSegments {
+				flush(true)
+			}
+			n := len(rest)
+			if n > 255 {
+				n = 255
+			}
+			page.segments = append(page.segments, byte(n))
+			page.data = append(page.data, rest[:n]...)
+			rest = rest[n:]
+			if n < 255 {
+				page.granule = 0
+				break
+			}
+		}
+	}
+	if len(page.segments) > 0 {
+		flush(false)
+	}
+	return pages
+}
+
+// oggStream holds the header packets of the first logical stream of an Ogg file.
+type oggStream struct {
+	serial  uint32
+	packets [][]byte
+	// Number of pages holding the header packets.
+	pageCount int
+	opus      bool
+	reader    *bufio.Reader
+}
+
+// readOggHeaders reads the header pages. The reader is left at the first audio
+// page.
+func readOggHeaders(f *os.File) (*oggStream, error) {
+	s := &oggStream{reader: bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))}
+	want := 0
+	var packet []byte
+	for want == 0 || len(s.packets) < want {
+		p, err := readOggPage(s.reader)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		s.pageCount++
+		if s.pageCount == 1 {
+			s.serial = p.serial
+		} else if p.serial != s.serial {
+			// Multiplexed streams.
+			return nil, ErrUnsupported
+		}
+
+		offset := 0
+		for _, l := range p.segments {
+			packet = append(packet, p.data[offset:offset+int(l)]...)
+			offset += int(l)
+			if l == 255 {
+				continue
+			}
+			s.packets = append(s.packets, packet)
+			packet = nil
+			if len(s.packets) == 1 {
+				switch {
+				case bytes.HasPrefix(s.packets[0], vorbisIDPrefix):
+					want = 3
+				case bytes.HasPrefix(s.packets[0], opusIDPrefix):
+					want = 2
+					s.opus = true
+				default:
+					return nil, ErrUnsupported
+				}
+			}
+		}
+	}
+	// The last header page must not hold audio data.
+	if len(packet) != 0 || len(s.packets) != want {
+		return nil, ErrCorrupt
+	}
+	return s, nil
+}
+
+func (s *oggStream) comment() (vorbisComment, error) {
+	prefix := vorbisCommentPrefix
+	if s.opus {
+		prefix = opusCommentPrefix
+	}
+	if !bytes.HasPrefix(s.packets[1], prefix) {
+		return vorbisComment{}, ErrCorrupt
+	}
+	return parseVorbisComment(s.packets[1][len(prefix):])
+}
+
+func readOgg(f *os.File) (map[string]string, error) {
+	s, err := readOggHeaders(f)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.comment()
+	if err != nil {
+		return nil, err
+	}
+	return c.tags(), nil
+}
+
+// setComment replaces the comment packet and rewrites the file. Since page
+// sequence numbers follow, all the pages of the stream must be rewritten.
+func (s *oggStream) setComment(f *os.File, c vorbisComment) error {
+	if s.opus {
+		s.packets[1] = append(append([]byte{}, opusCommentPrefix...), c.bytes()...)
+	} else {
+		s.packets[1] = append(append(append([]byte{}, vorbisCommentPrefix...), c.bytes()...), 1)
+	}
+
+	// The identification packet must be alone on the first page.
+	pages := paginate(s.packets[:1], s.serial, 0)
+	pages[0].headerType = oggBOS
+	pages = append(pages, paginate(s.packets[1:], s.serial, 1)...)
+	delta := uint32(len(pages) - s.pageCount)
+
+	return rewrite(f, func(w io.Writer) error {
+		for _, p := range pages {
+			if _, err := w.Write(p.bytes()); err != nil {
+				return err
+			}
+		}
+		for {
+			p, err := readOggPage(s.reader)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.New("ogg: " + err.Error())
+			}
+			if p.serial == s.serial {
+				p.sequence += delta
+			}
+			if _, err := w.Write(p.bytes()); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// editOgg applies 'edit' on the comment header of 'f'.
+func editOgg(f *os.File, edit func(*vorbisComment)) error {
+	s, err := readOggHeaders(f)
+	if err != nil {
+		return err
+	}
+	c, err := s.comment()
+	if err != nil {
+		return err
+	}
+	edit(&c)
+	return s.setComment(f, c)
+}
+
+func writeOgg(f *os.File, tags map[string]string) error {
+	return editOgg(f, func(c *vorbisComment) { c.set(tags) })
+}
+
+func setOggPictures(f *os.File, pictures []Picture) error {
+	return editOgg(f, func(c *vorbisComment) { c.setPictures(pictures) })
+}
@@ -0,0 +1,79 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// PictureType follows the ID3v2 APIC specification, which FLAC uses too.
+type PictureType byte
+
+// Picture types. See the ID3v2 specification for the full list.
+const (
+	PictureOther      PictureType = 0
+	PictureFrontCover PictureType = 3
+	PictureBackCover  PictureType = 4
+)
+
+// Picture is an embedded image.
+// 'Width' and 'Height' are in pixels. They are optional.
+type Picture struct {
+	Type        PictureType
+	MIME        string
+	Description string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// flacBytes returns the content of a FLAC PICTURE block. The same structure is
+// used for the METADATA_BLOCK_PICTURE Vorbis comment.
+func (p Picture) flacBytes() []byte {
+	buf := make([]byte, 0, 32+len(p.MIME)+len(p.Description)+len(p.Data))
+	var n [4]byte
+	put := func(v uint32) {
+		binary.BigEndian.PutUint32(n[:], v)
+		buf = append(buf, n[:]...)
+	}
+	put(uint32(p.Type))
+	put(uint32(len(p.MIME)))
+	buf = append(buf, p.MIME...)
+	put(uint32(len(p.Description)))
+	buf = append(buf, p.Description...)
+	put(uint32(p.Width))
+	put(uint32(p.Height))
+	// Color depth and number of indexed colors are unknown.
+	put(0)
+	put(0)
+	put(uint32(len(p.Data)))
+	return append(buf, p.Data...)
+}
+
+// SetPictures replaces the pictures embedded in the file at 'path' with
+// 'pictures'. Tags are left untouched.
+func SetPictures(path string, pictures []Picture) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, err := detect(f)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case formatFLAC:
+		return setFLACPictures(f, pictures)
+	case formatOgg:
+		return setOggPictures(f, pictures)
+	case formatID3:
+		return setID3Pictures(f, pictures)
+	case formatMP4:
+		return setMP4Pictures(f, pictures)
+	}
+	return ErrUnsupported
+}
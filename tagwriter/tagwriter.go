@@ -0,0 +1,315 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+/*
+Package tagwriter reads and writes the metadata of audio files without
+touching the audio data.
+
+Supported containers:
+
+  - MP3 with ID3v2.3 or ID3v2.4 tags,
+  - FLAC, Ogg Vorbis and Ogg Opus with Vorbis comments,
+  - MP4 (M4A) with iTunes-style atoms.
+
+Tag names follow the FFmpeg conventions (e.g. 'album_artist', 'track', 'disc')
+so that they match what 'ffprobe' reports. They are mapped to the respective
+native names of every container. Tags without native equivalent are written as
+user-defined tags (TXXX frames in ID3v2, freeform atoms in MP4), named like
+MusicBrainz Picard does for the MusicBrainz identifiers, e.g. "MusicBrainz Album
+Id" for 'musicbrainz_albumid'. In ID3v2, 'isrc' is stored in TSRC and
+'musicbrainz_trackid' in the MusicBrainz UFID frame.
+
+In ID3v2 and MP4, 'tracktotal' and 'disctotal' are stored with the track and
+disc numbers as "N/M". ID3v2.3 has no full date frame: the year goes to TYER,
+the day and month to TDAT.
+
+Writing replaces all the tags of the file. Embedded pictures and other
+non-textual metadata are kept.
+
+When the new tags fit in the existing metadata area (including padding), the
+file is modified in place. Otherwise the new content is written to a temporary
+file next to the original, then copied over it so that links are kept.
+*/
+package tagwriter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type format int
+
+const (
+	formatUnknown format = iota
+	formatFLAC
+	formatOgg
+	formatID3
+	formatMP4
+)
+
+var (
+	// ErrUnsupported is returned for files whose format is not supported.
+	ErrUnsupported = errors.New("unsupported format")
+	// ErrCorrupt is returned when the existing metadata cannot be parsed.
+	ErrCorrupt = errors.New("corrupt metadata")
+)
+
+func detect(r io.ReaderAt) (format, error) {
+	var buf [12]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return formatUnknown, err
+	}
+	b := buf[:n]
+	switch {
+	case bytes.HasPrefix(b, []byte("fLaC")):
+		return formatFLAC, nil
+	case bytes.HasPrefix(b, []byte("OggS")):
+		return formatOgg, nil
+	case bytes.HasPrefix(b, []byte("ID3")):
+		// FLAC files are sometimes prefixed with an ID3v2 tag. We do not support
+		// them.
+		size := int64(syncsafe(b[6:10])) + 10
+		var magic [4]byte
+		if _, err := r.ReadAt(magic[:], size); err == nil && string(magic[:]) == "fLaC" {
+			return formatUnknown, ErrUnsupported
+		}
+		return formatID3, nil
+	case len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0:
+		// MPEG audio frame without tag.
+		return formatID3, nil
+	case len(b) >= 8 && string(b[4:8]) == "ftyp":
+		return formatMP4, nil
+	}
+	return formatUnknown, ErrUnsupported
+}
+
+// Supported reports whether the file at 'path' is in a format that can be
+// tagged. The codec of Ogg streams is checked since only Vorbis and Opus are
+// supported.
+func Supported(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	format, err := detect(f)
+	if err == nil && format == formatOgg {
+		_, err = readOggHeaders(f)
+	}
+	return err == nil
+}
+
+// Read returns the tags of the file at 'path'.
+func Read(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	format, err := detect(f)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case formatFLAC:
+		return readFLAC(f)
+	case formatOgg:
+		return readOgg(f)
+	case formatID3:
+		return readID3(f)
+	case formatMP4:
+		return readMP4(f)
+	}
+	return nil, ErrUnsupported
+}
+
+// Write replaces the tags of the file at 'path' with 'tags'.
+// Tags with empty values are skipped.
+func Write(path string, tags map[string]string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, err := detect(f)
+	if err != nil {
+		return err
+	}
+	tags = CanonicalTags(tags)
+	switch format {
+	case formatFLAC:
+		return writeFLAC(f, tags)
+	case formatOgg:
+		return writeOgg(f, tags)
+	case formatID3:
+		return writeID3(f, tags)
+	case formatMP4:
+		return writeMP4(f, tags)
+	}
+	return ErrUnsupported
+}
+
+// rewrite replaces the content of 'f' with the content produced by 'write'.
+// The new content is written to a temporary file in the same folder first, so
+// that 'f' is left untouched on error. It is then copied over 'f' so that the
+// inode, and thus the hard and symbolic links, are kept. Should the copy fail,
+// the temporary file is kept.
+func rewrite(f *os.File, write func(w io.Writer) error) error {
+	// A random name, so that the leftovers of a crash are not in the way.
+	dir, base := filepath.Dir(f.Name()), filepath.Base(f.Name())
+	tmp, err := ioutil.TempFile(dir, "."+base+".tagwriter")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	err = write(tmp)
+	var size int64
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if _, err := io.Copy(f, tmp); err != nil {
+		return fmt.Errorf("%v, new content left in %v", err, tmp.Name())
+	}
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("%v, new content left in %v", err, tmp.Name())
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// sortedKeys returns the keys of the non-empty tags in lexicographic order so
+// that the output is deterministic.
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Descriptions of the user-defined tags (TXXX frames, freeform atoms) used by
+// MusicBrainz Picard.
+var picardDescriptions = map[string]string{
+	"acoustid_id":                "Acoustid Id",
+	"barcode":                    "BARCODE",
+	"catalognumber":              "CATALOGNUMBER",
+	"isrc":                       "ISRC",
+	"musicbrainz_albumartistid":  "MusicBrainz Album Artist Id",
+	"musicbrainz_albumid":        "MusicBrainz Album Id",
+	"musicbrainz_artistid":       "MusicBrainz Artist Id",
+	"musicbrainz_releasegroupid": "MusicBrainz Release Group Id",
+	"musicbrainz_releasetrackid": "MusicBrainz Release Track Id",
+	"musicbrainz_trackid":        "MusicBrainz Track Id",
+	"releasecountry":             "MusicBrainz Album Release Country",
+	"releasestatus":              "MusicBrainz Album Status",
+	"releasetype":                "MusicBrainz Album Type",
+}
+
+// Tag names of the Picard descriptions and of the tag names themselves, in
+// lower case.
+var picardNames = map[string]string{}
+
+func init() {
+	for name, desc := range picardDescriptions {
+		picardNames[strings.ToLower(desc)] = name
+		picardNames[name] = name
+	}
+}
+
+// userDescription returns the description of the user-defined tag 'name'.
+func userDescription(name string) string {
+	if desc, ok := picardDescriptions[userTagName(name)]; ok {
+		return desc
+	}
+	return name
+}
+
+// userTagName returns the tag name of the user-defined tag described by 'desc'.
+// The case of unknown descriptions is preserved.
+func userTagName(desc string) string {
+	if name, ok := picardNames[strings.ToLower(desc)]; ok {
+		return name
+	}
+	return desc
+}
+
+// CanonicalTags returns 'tags' where the Picard descriptions, e.g. "musicbrainz
+// album id" as reported by FFmpeg, are replaced by their tag names. Tag names
+// have precedence.
+func CanonicalTags(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		name := userTagName(k)
+		if name != k {
+			if _, ok := tags[name]; ok {
+				continue
+			}
+		}
+		result[name] = v
+	}
+	return result
+}
+
+// pairTotals returns 'tags' where 'tracktotal' and 'disctotal' are merged into
+// 'track' and 'disc' as "N/M", like ID3v2 and MP4 store them.
+func pairTotals(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	for name, total := range map[string]string{"track": "tracktotal", "disc": "disctotal"} {
+		if result[name] == "" || result[total] == "" {
+			continue
+		}
+		if !strings.Contains(result[name], "/") {
+			result[name] += "/" + result[total]
+		}
+		delete(result, total)
+	}
+	return result
+}
+
+// reverse returns the inverse mapping of 'm'.
+func reverse(m map[string]string) map[string]string {
+	r := make(map[string]string, len(m))
+	for k, v := range m {
+		r[v] = k
+	}
+	return r
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, n uint32) {
+	b[0] = byte(n>>21) & 0x7f
+	b[1] = byte(n>>14) & 0x7f
+	b[2] = byte(n>>7) & 0x7f
+	b[3] = byte(n) & 0x7f
+}
@@ -0,0 +1,533 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package tagwriter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var audio = bytes.Repeat([]byte{0xFF, 0xFB, 0x90, 0x00}, 512)
+
+var sampleTags = map[string]string{
+	"album":        "Album",
+	"album_artist": "Various",
+	"artist":       "Artist é ✓",
+	"comment":      "Comment",
+	"date":         "2018",
+	"disc":         "1/2",
+	"genre":        "Rock",
+	"title":        "Title",
+	"track":        "3/12",
+	"custom":       "Value",
+}
+
+func sampleFLAC() []byte {
+	buf := []byte("fLaC")
+	buf = append(buf, flacStreamInfo, 0, 0, 34)
+	buf = append(buf, make([]byte, 34)...)
+	c := vorbisComment{vendor: "test", comments: []string{"TITLE=Old", "METADATA_BLOCK_PICTURE=cGljdHVyZQ=="}}
+	comment := c.bytes()
+	buf = append(buf, 0x80|flacVorbisComment, 0, byte(len(comment)>>8), byte(len(comment)))
+	buf = append(buf, comment...)
+	return append(buf, audio...)
+}
+
+func sampleID3() []byte {
+	t := &id3Tag{version: 3}
+	t.frames = append(t.frames, newID3TextFrame(3, "title", "Old"))
+	t.frames = append(t.frames, id3Frame{id: "APIC", data: []byte("\x00image/png\x00\x03\x00picture")})
+	buf := append(t.bytes(16), audio...)
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	return append(buf, v1...)
+}
+
+func sampleOgg() []byte {
+	id := append(append([]byte{}, vorbisIDPrefix...), make([]byte, 23)...)
+	c := vorbisComment{vendor: "test", comments: []string{"TITLE=Old"}}
+	comment := append(append(append([]byte{}, vorbisCommentPrefix...), c.bytes()...), 1)
+	setup := append(append([]byte{}, "\x05vorbis"...), bytes.Repeat([]byte{0x42}, 600)...)
+
+	pages := paginate([][]byte{id}, 1234, 0)
+	pages[0].headerType = oggBOS
+	pages = append(pages, paginate([][]byte{comment, setup}, 1234, 1)...)
+	next := uint32(len(pages))
+	pages = append(pages, oggPage{serial: 1234, sequence: next, granule: 4096, headerType: 0x04, segments: []byte{byte(len(audio) % 255)}, data: audio[:len(audio)%255]})
+
+	var buf []byte
+	for _, p := range pages {
+		buf = append(buf, p.bytes()...)
+	}
+	return buf
+}
+
+// sampleMP4 returns an MP4 file where 'moov' comes before 'mdat', so that
+// growing it requires to shift the chunk offsets.
+func sampleMP4() []byte {
+	ftyp := mp4Atom{typ: "ftyp", payload: []byte("M4A \x00\x00\x00\x00M4A mp42isom")}
+	stco := func(offset uint32) mp4Atom {
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[4:], 1)
+		binary.BigEndian.PutUint32(payload[8:], offset)
+		return mp4Atom{typ: "stco", payload: payload}
+	}
+	moov := func(offset uint32) mp4Atom {
+		stbl := mp4Atom{typ: "stbl", payload: stco(offset).bytes()}
+		minf := mp4Atom{typ: "minf", payload: stbl.bytes()}
+		mdia := mp4Atom{typ: "mdia", payload: minf.bytes()}
+		trak := mp4Atom{typ: "trak", payload: mdia.bytes()}
+		covr := mp4Atom{typ: "covr", payload: mp4Data(14, []byte("picture")).bytes()}
+		ilst := mp4Atom{typ: "ilst", payload: append(newMP4Item("title", "Old").bytes(), covr.bytes()...)}
+		meta := mp4Atom{typ: "meta", payload: append([]byte{0, 0, 0, 0}, ilst.bytes()...)}
+		udta := mp4Atom{typ: "udta", payload: meta.bytes()}
+		return mp4Atom{typ: "moov", payload: append(trak.bytes(), udta.bytes()...)}
+	}
+	size := len(ftyp.bytes()) + len(moov(0).bytes())
+	buf := append(ftyp.bytes(), moov(uint32(size+8)).bytes()...)
+	return append(buf, mp4Atom{typ: "mdat", payload: audio}.bytes()...)
+}
+
+func writeSample(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	samples := []struct {
+		name    string
+		content []byte
+		// Some content that must be preserved.
+		keep []byte
+	}{
+		{"sample.flac", sampleFLAC(), []byte("METADATA_BLOCK_PICTURE=cGljdHVyZQ==")},
+		{"sample.mp3", sampleID3(), []byte("APIC")},
+		{"sample.ogg", sampleOgg(), bytes.Repeat([]byte{0x42}, 600)},
+		{"sample.m4a", sampleMP4(), []byte("covr")},
+	}
+
+	for _, s := range samples {
+		path := writeSample(t, dir, s.name, s.content)
+		if !Supported(path) {
+			t.Errorf("%v: not supported", s.name)
+			continue
+		}
+
+		tags, err := Read(path)
+		if err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		if tags["title"] != "Old" {
+			t.Errorf("%v: got title %q, want %q", s.name, tags["title"], "Old")
+		}
+
+		// Write twice to check both the growing and the in-place cases.
+		for i := 0; i < 2; i++ {
+			if err := Write(path, sampleTags); err != nil {
+				t.Errorf("%v: %v", s.name, err)
+				continue
+			}
+			got, err := Read(path)
+			if err != nil {
+				t.Errorf("%v: %v", s.name, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, sampleTags) {
+				t.Errorf("%v: got %v, want %v", s.name, got, sampleTags)
+			}
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(content, s.keep) {
+			t.Errorf("%v: lost non-textual metadata", s.name)
+		}
+		if strings.HasSuffix(s.name, ".mp3") && bytes.HasSuffix(content, s.content[len(s.content)-128:]) {
+			t.Errorf("%v: ID3v1 tag was not removed", s.name)
+		}
+	}
+}
+
+func TestSupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oggFLAC := paginate([][]byte{[]byte("\x7fFLAC\x01\x00\x00\x01fLaC")}, 1234, 0)[0]
+	oggFLAC.headerType = oggBOS
+	samples := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"sample.ogg", sampleOgg(), true},
+		{"flac.ogg", oggFLAC.bytes(), false},
+		{"text.txt", []byte("text"), false},
+	}
+	for _, s := range samples {
+		if got := Supported(writeSample(t, dir, s.name, s.content)); got != s.want {
+			t.Errorf("%v: got %v, want %v", s.name, got, s.want)
+		}
+	}
+}
+
+func TestMP4ChunkOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeSample(t, dir, "sample.m4a", sampleMP4())
+	if err := Write(path, sampleTags); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := openMP4(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdat, ok := findMP4Box(m.top, "mdat")
+	if !ok {
+		t.Fatal("mdat not found")
+	}
+
+	// moov.trak.mdia.minf.stbl.stco
+	atoms := m.atoms
+	for _, typ := range []string{"trak", "mdia", "minf", "stbl", "stco"} {
+		a, ok := childOf(atoms, typ)
+		if !ok {
+			t.Fatalf("%v not found", typ)
+		}
+		if typ == "stco" {
+			offset := int64(binary.BigEndian.Uint32(a.payload[8:]))
+			if offset != mdat.offset+mdat.header {
+				t.Errorf("got chunk offset %v, want %v", offset, mdat.offset+mdat.header)
+			}
+			break
+		}
+		atoms, err = parseMP4Atoms(a.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, len(audio))
+	if _, err := f.ReadAt(buf, mdat.offset+mdat.header); err != nil || !bytes.Equal(buf, audio) {
+		t.Error("audio data was altered")
+	}
+}
+
+func TestOggPagination(t *testing.T) {
+	packet := bytes.Repeat([]byte{1}, 255*300)
+	pages := paginate([][]byte{packet}, 1, 0)
+	if len(pages) != 2 {
+		t.Fatalf("got %v pages, want 2", len(pages))
+	}
+	if pages[0].granule != ^uint64(0) || pages[1].granule != 0 {
+		t.Error("wrong granule positions")
+	}
+	if pages[1].headerType&oggContinued == 0 {
+		t.Error("continued packet not flagged")
+	}
+	// A packet whose size is a multiple of 255 ends with an empty segment.
+	if last := pages[1].segments[len(pages[1].segments)-1]; last != 0 {
+		t.Errorf("got last segment %v, want 0", last)
+	}
+}
+
+func TestSetPictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	picture := Picture{Type: PictureFrontCover, MIME: "image/png", Data: bytes.Repeat([]byte("new picture"), 100)}
+	samples := []struct {
+		name    string
+		content []byte
+		// The former picture that must be removed.
+		old []byte
+		// The new picture, as encoded in the file.
+		new []byte
+	}{
+		{"sample.flac", sampleFLAC(), []byte("cGljdHVyZQ=="), picture.flacBytes()},
+		{"sample.mp3", sampleID3(), []byte("\x03\x00picture"), picture.Data},
+		{"sample.ogg", sampleOgg(), nil, []byte("METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(picture.flacBytes()))},
+		{"sample.m4a", sampleMP4(), mp4Data(14, []byte("picture")).bytes(), mp4Data(mp4DataPNG, picture.Data).bytes()},
+	}
+
+	for _, s := range samples {
+		path := writeSample(t, dir, s.name, s.content)
+		if err := SetPictures(path, []Picture{picture}); err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.old != nil && bytes.Contains(content, s.old) {
+			t.Errorf("%v: former picture was not removed", s.name)
+		}
+		if !bytes.Contains(content, s.new) {
+			t.Errorf("%v: picture was not embedded", s.name)
+		}
+		tags, err := Read(path)
+		if err != nil || tags["title"] != "Old" {
+			t.Errorf("%v: tags were altered: %v, %v", s.name, tags, err)
+		}
+	}
+}
+
+func TestID3FrameFlags(t *testing.T) {
+	for _, version := range []byte{3, 4} {
+		compressed := newID3TextFrame(version, "album", "Compressed")
+		compressed.flags[1] = 0x80
+		if version == 4 {
+			compressed.flags[1] = 0x08
+		}
+		tag := &id3Tag{version: version, frames: []id3Frame{newID3TextFrame(version, "title", "Old"), compressed}}
+		tag.set(map[string]string{"title": "New"})
+
+		got := tag.tags()
+		want := map[string]string{"title": "New"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("v2.%v: got %v, want %v", version, got, want)
+		}
+		if len(tag.frames) != 2 {
+			t.Errorf("v2.%v: compressed frame was dropped", version)
+		}
+	}
+}
+
+func TestRewriteLeftover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeSample(t, dir, "sample.mp3", sampleID3())
+	// Leftover of a crashed rewrite.
+	writeSample(t, dir, ".sample.mp3.tagwriter", nil)
+	tags := map[string]string{"title": strings.Repeat("Long title ", 100)}
+	if err := Write(path, tags); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Read(path); err != nil || !reflect.DeepEqual(got, tags) {
+		t.Errorf("Got %v (%v), want %v", got, err, tags)
+	}
+}
+
+func TestPicardTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tags := map[string]string{
+		// As reported by FFmpeg for files tagged by Picard.
+		"musicbrainz album id": "album",
+		"musicbrainz_artistid": "artist",
+		"musicbrainz_trackid":  "recording",
+		"isrc":                 "GBAAA0000001",
+		"My Tag":               "value",
+	}
+	want := map[string]string{
+		"musicbrainz_albumid":  "album",
+		"musicbrainz_artistid": "artist",
+		"musicbrainz_trackid":  "recording",
+		"isrc":                 "GBAAA0000001",
+		"My Tag":               "value",
+	}
+	samples := []struct {
+		name    string
+		content []byte
+		native  [][]byte
+	}{
+		{"sample.mp3", sampleID3(), [][]byte{[]byte("MusicBrainz Album Id"), []byte("UFID"), []byte("http://musicbrainz.org\x00recording"), []byte("TSRC")}},
+		{"sample.m4a", sampleMP4(), [][]byte{[]byte("MusicBrainz Album Id"), []byte("MusicBrainz Track Id"), []byte("ISRC")}},
+	}
+	for _, s := range samples {
+		path := writeSample(t, dir, s.name, s.content)
+		if err := Write(path, tags); err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range s.native {
+			if !bytes.Contains(content, n) {
+				t.Errorf("%v: missing %q", s.name, n)
+			}
+		}
+		got, err := Read(path)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v (%v), want %v", s.name, got, err, want)
+		}
+	}
+}
+
+func TestID3TextFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, version := range []byte{3, 4} {
+		tag := &id3Tag{version: version}
+		for _, f := range [][2]string{{"TIT2", "Title"}, {"TKEY", "Am"}, {"TMED", "CD"}, {"TOPE", "Original"}} {
+			tag.frames = append(tag.frames, id3Frame{id: f[0], data: append([]byte{id3EncodingLatin1}, f[1]...)})
+		}
+		path := writeSample(t, dir, "sample.mp3", append(tag.bytes(16), audio...))
+
+		tags, err := Read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Write(path, tags); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"TKEY", "TMED", "TOPE"} {
+			if !bytes.Contains(content, []byte(id)) {
+				t.Errorf("v2.%v: missing %v frame", version, id)
+			}
+		}
+		if bytes.Contains(content, []byte("TXXX")) {
+			t.Errorf("v2.%v: text frames were written as TXXX", version)
+		}
+		if got, err := Read(path); err != nil || !reflect.DeepEqual(got, tags) {
+			t.Errorf("v2.%v: got %v (%v), want %v", version, got, err, tags)
+		}
+	}
+}
+
+func TestDatesAndTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tags := map[string]string{
+		"bpm":          "120",
+		"date":         "2018-05-07",
+		"disc":         "1",
+		"disctotal":    "2",
+		"label":        "Label",
+		"originaldate": "1999-01-02",
+		"track":        "3",
+		"tracktotal":   "12",
+	}
+	samples := []struct {
+		name    string
+		content []byte
+		want    map[string]string
+		native  [][]byte
+	}{
+		{"sample.mp3", sampleID3(), map[string]string{
+			"bpm": "120", "date": "2018-05-07", "disc": "1/2", "publisher": "Label", "originaldate": "1999", "track": "3/12",
+		}, [][]byte{[]byte("TYER"), []byte("TDAT"), []byte("TORY"), []byte("TPUB"), []byte("TBPM")}},
+		{"sample.m4a", sampleMP4(), map[string]string{
+			"bpm": "120", "date": "2018-05-07", "disc": "1/2", "label": "Label", "originaldate": "1999-01-02", "track": "3/12",
+		}, nil},
+	}
+	for _, s := range samples {
+		path := writeSample(t, dir, s.name, s.content)
+		if err := Write(path, tags); err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range s.native {
+			if !bytes.Contains(content, n) {
+				t.Errorf("%v: missing %q", s.name, n)
+			}
+		}
+		if bytes.Contains(content, []byte("2018-05-07")) && strings.HasSuffix(s.name, ".mp3") {
+			t.Errorf("%v: full date written to TYER", s.name)
+		}
+		got, err := Read(path)
+		if err != nil || !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%v: got %v (%v), want %v", s.name, got, err, s.want)
+		}
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tags := map[string]string{"title": strings.Repeat("Long title ", 1000)}
+	for _, s := range []struct {
+		name    string
+		content []byte
+	}{
+		{"sample.flac", sampleFLAC()},
+		{"sample.mp3", sampleID3()},
+		{"sample.m4a", sampleMP4()},
+	} {
+		path := writeSample(t, dir, s.name, s.content)
+		hardlink, symlink := path+".hard", path+".sym"
+		if err := os.Link(path, hardlink); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(path, symlink); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Write(symlink, tags); err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		if st, err := os.Lstat(symlink); err != nil || st.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%v: symbolic link was replaced", s.name)
+		}
+		if got, err := Read(hardlink); err != nil || !reflect.DeepEqual(got, tags) {
+			t.Errorf("%v: got %v (%v) through the hard link, want %v", s.name, got, err, tags)
+		}
+	}
+}
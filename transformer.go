@@ -5,51 +5,131 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
-	"github.com/wtolson/go-taglib"
+	"github.com/ambrevar/demlo/tagwriter"
 	"github.com/yookoala/realpath"
 )
 
+// FFmpeg output formats of ID3v2 and MP4 files.
+var picardFormats = map[string]bool{
+	"ipod": true,
+	"mp3":  true,
+	"mp4":  true,
+}
+
 var visitedDstCovers = struct {
 	v map[dstCoverKey]bool
 	sync.RWMutex
 }{v: map[dstCoverKey]bool{}}
 
+// writtenFiles holds the real paths of the output files written in watch mode
+// with their modification times.
+var writtenFiles = struct {
+	v map[string]time.Time
+	sync.Mutex
+}{v: map[string]time.Time{}}
+
+// recordWritten records that the file at 'path' was written, in watch mode.
+func recordWritten(path string) {
+	if !options.Watch {
+		return
+	}
+	rpath, err := realpath.Realpath(path)
+	if err != nil {
+		return
+	}
+	st, err := os.Stat(rpath)
+	if err != nil {
+		return
+	}
+	writtenFiles.Lock()
+	writtenFiles.v[rpath] = st.ModTime()
+	writtenFiles.Unlock()
+}
+
+// wroteFile reports whether the file at 'path' was written by the transformer
+// and not modified since.
+func wroteFile(path string) bool {
+	rpath, err := realpath.Realpath(path)
+	if err != nil {
+		return false
+	}
+	st, err := os.Stat(rpath)
+	if err != nil {
+		return false
+	}
+	writtenFiles.Lock()
+	defer writtenFiles.Unlock()
+	modTime, ok := writtenFiles.v[rpath]
+	return ok && modTime.Equal(st.ModTime())
+}
+
 // transformer applies the changes resulting from the script run.
 // If the audio stream needs to be transcoded, it calls FFmpeg to apply all the changes.
-// Otherwise, it copies / renames the file and changes metadata with TagLib if necessary.
+// Otherwise, it copies / renames the file and changes metadata in place if necessary.
+// When the context is canceled, the transformation of the current track is
+// aborted and its partial output removed.
 type transformer struct{}
 
 func (t *transformer) Init() {}
 
 func (t *transformer) Close() {}
 
-func (t *transformer) Run(fr *FileRecord) error {
+func (t *transformer) Run(ctx context.Context, fr *FileRecord) error {
 	input := &fr.input
 
+	// Whether all tracks were transformed.
+	completed := true
+
 	for track := 0; track < input.trackCount; track++ {
 		output := &fr.output[track]
 
+		if ctx.Err() != nil {
+			fr.warning.Print("Aborted")
+			return ctx.Err()
+		}
+
 		if fr.status[track] == statusFail {
+			completed = false
+			continue
+		}
+
+		if len(input.cuesheet.Files) > 0 && !input.cuesheet.Files[input.cuesheetFile][track].IsAudio() {
+			fr.info.Printf("Skip data track %v", track+1)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventSkipped, Track: track + 1}, nil)
 			continue
 		}
 
 		err := os.MkdirAll(filepath.Dir(output.Path), 0777)
 		if err != nil {
 			fr.error.Print(err)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+			completed = false
 			continue
 		}
 
+		// The output file created by this run, if any. It is removed if the
+		// transformation fails.
+		created := ""
+		// The overwritten output moved to the trash, if any. It is moved back if
+		// the transformation fails.
+		backup := ""
+
 		// Create file if necessary.
-		if fr.status[track] == statusExist {
+		exists := fr.status[track] == statusExist
+		if exists {
 			// If output.Path == input.path && output.Removesource, we process
 			// in-place.
 			if output.Write == existWriteSkip && (output.Path != input.path || !output.Removesource) {
@@ -57,29 +137,51 @@ func (t *transformer) Run(fr *FileRecord) error {
 					// If the user has explicitly requested WriteSkip and
 					// Removesource, it's probably because the exisintg files
 					// have priority over the input files.
-					fr.info.Printf("Remove source %q", input.path)
-					err := os.Remove(input.path)
+					trashed, err := trashFile(input.path, options.Trash)
 					if err != nil {
 						fr.error.Println(err)
+						emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1}, err)
 						return err
 					}
+					fr.info.Printf("Move source %q to %q", input.path, trashed)
+					journal.Record(fr, JournalEntry{Action: journalMove, Src: input.path, Dst: trashed})
+					emitEvent(fr, Event{Stage: stageTransformer, Type: eventSourceRemoved, Track: track + 1}, nil)
 				}
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventSkipped, Track: track + 1, Status: fr.status[track].String(), Output: output.Path}, nil)
 				continue
 			} else if output.Write == existWriteSuffix && (!output.Removesource || output.Path != input.path) {
 				output.Path, err = mkTemp(output.Path)
 				if err != nil {
 					fr.error.Print(err)
+					emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+					completed = false
 					continue
 				}
+				created = output.Path
+				journal.Record(fr, JournalEntry{Action: journalCreate, Src: input.path, Dst: output.Path})
 			} else if output.Write == existWriteOver && !output.Removesource && output.Path == input.path {
 				continue
+			} else if output.Write == existWriteOver && output.Path != input.path {
+				backup, err = trashFile(output.Path, options.Trash)
+				if err != nil {
+					fr.error.Print(err)
+					emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+					completed = false
+					continue
+				}
+				fr.info.Printf("Move overwritten %q to %q", output.Path, backup)
+				journal.Record(fr, JournalEntry{Action: journalMove, Src: output.Path, Dst: backup})
+				// The output is created below like a new file.
+				exists = false
 			}
+		}
 
-		} else {
+		if !exists {
 			// 'output.Path' does not exist.
 			st, err := os.Stat(input.path)
 			if err != nil {
 				fr.error.Print(err)
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1}, err)
 				// This error will probably happen for the remaining files of the loop.
 				// Let's return now.
 				return err
@@ -91,14 +193,18 @@ func (t *transformer) Run(fr *FileRecord) error {
 				// another file with the same path was created between existence check and
 				// creation.
 				fr.error.Print(err)
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+				completed = false
 				continue
 			}
 			f.Close()
+			created = output.Path
+			journal.Record(fr, JournalEntry{Action: journalCreate, Src: input.path, Dst: output.Path})
 		}
 
 		// If encoding changed, use FFmpeg. Otherwise, copy/rename the file to
 		// speed up the process. If tags have changed but not the encoding, we use
-		// taglib to set them.
+		// the tag writer to set them in place.
 		var encodingChanged = false
 
 		if input.trackCount > 1 {
@@ -116,50 +222,6 @@ func (t *transformer) Run(fr *FileRecord) error {
 			encodingChanged = true
 		}
 
-		// TODO: TagLib does not support arbitrary tags from its C interface.
-		// It can tag inplace which offers a significant speedup. The
-		// 'taglibSupported' is a workaround used to check whether FFmpeg should be
-		// used or not to ensure correct results.
-		var taglibFormats = map[string]bool{
-			"album":   true,
-			"artist":  true,
-			"comment": true,
-			"genre":   true,
-			"title":   true,
-			// 'date' and 'track' are handled separately because TagLib only supports
-			// integers for those tags.
-		}
-		var taglibSupported = true
-		for k, v := range input.tags {
-			if k != "encoder" && output.Tags[k] != v {
-				if k == "date" || k == "track" {
-					if _, err := strconv.Atoi(v); err != nil {
-						taglibSupported = false
-						break
-					}
-				} else if !taglibFormats[k] {
-					taglibSupported = false
-					break
-				}
-			}
-		}
-
-		if taglibSupported {
-			for k, v := range output.Tags {
-				if k != "encoder" && input.tags[k] != v {
-					if k == "date" || k == "track" {
-						if _, err := strconv.Atoi(v); err != nil {
-							taglibSupported = false
-							break
-						}
-					} else if !taglibFormats[k] {
-						taglibSupported = false
-						break
-					}
-				}
-			}
-		}
-
 		// Copy embeddedCovers, externalCovers and onlineCover.
 		// We must process covers now because the input file can be removed after audio processing.
 		for stream, cover := range output.EmbeddedCovers {
@@ -170,6 +232,7 @@ func (t *transformer) Run(fr *FileRecord) error {
 			inputPath := filepath.Join(filepath.Dir(input.path), file)
 			inputSource, err := os.Open(inputPath)
 			if err != nil {
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1}, err)
 				return err
 			}
 			transferCovers(fr, cover, "external '"+file+"'", inputSource, input.externalCovers[file].checksum)
@@ -180,22 +243,78 @@ func (t *transformer) Run(fr *FileRecord) error {
 			transferCovers(fr, output.OnlineCover, "online", inputSource, input.onlineCover.checksum)
 		}
 
-		// TODO: Add to condition: `|| output.format == "taglib-unsupported-format"`.
-		if encodingChanged || !taglibSupported {
-			err = transformStream(fr, track)
+		// Load the covers to embed before the source can be removed.
+		pictures := loadEmbedCovers(fr, track)
+
+		eventType := eventTranscoded
+		if encodingChanged || !tagwriter.Supported(input.path) {
+			err = transformStream(ctx, fr, track)
 		} else {
-			err = transformMetadata(fr, track)
+			eventType = eventTagged
+			err = transformMetadata(fr, track, &created)
 		}
 		if err != nil {
 			fr.error.Print(err)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+			completed = false
+			if created != "" {
+				fr.info.Printf("Remove partial output %q", created)
+				if err := os.Remove(created); err != nil && !os.IsNotExist(err) {
+					fr.error.Print(err)
+				} else if backup != "" {
+					fr.info.Printf("Move %q back to %q", backup, output.Path)
+					if err := os.Rename(backup, output.Path); err != nil {
+						fr.error.Print(err)
+					} else {
+						journal.Record(fr, JournalEntry{Action: journalMove, Src: backup, Dst: output.Path})
+					}
+				}
+			}
 			continue
 		}
+		recordWritten(output.Path)
+		emitEvent(fr, Event{Stage: stageTransformer, Type: eventType, Track: track + 1, Output: output.Path}, nil)
+
+		if options.AcoustIDSubmit && fr.unidentified {
+			err = submitFingerprint(fr, track)
+			if err != nil {
+				fr.warning.Print("AcoustID submission error: ", err)
+			}
+		}
+
+		if output.LRC != "" {
+			err = writeLyrics(fr, track)
+			if err != nil {
+				fr.error.Print("Cannot write lyrics: ", err)
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+				completed = false
+			} else {
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventLyricsWritten, Track: track + 1, Output: output.Path}, nil)
+			}
+		}
+
+		if len(pictures) > 0 {
+			fr.info.Printf("Embed %v cover(s) in %q", len(pictures), output.Path)
+			err = tagwriter.SetPictures(output.Path, pictures)
+			if err != nil {
+				fr.error.Print("Cannot embed covers: ", err)
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Track: track + 1, Output: output.Path}, err)
+				completed = false
+				continue
+			}
+			recordWritten(output.Path)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventCoverWritten, Track: track + 1, Output: output.Path}, nil)
+		}
 	}
 
+	if completed && ctx.Err() == nil {
+		checkpoint.Record(fr)
+	}
 	return nil
 }
 
-func transformStream(fr *FileRecord, track int) error {
+// transformStream kills FFmpeg if 'ctx' is canceled.
+func transformStream(ctx context.Context, fr *FileRecord, track int) error {
 	input := &fr.input
 	output := &fr.output[track]
 
@@ -226,7 +345,7 @@ func transformStream(fr *FileRecord, track int) error {
 	// Get cuesheet splitting parameters.
 	if len(input.cuesheet.Files) > 0 {
 		d, _ := strconv.ParseFloat(fr.Streams[input.audioIndex].Duration, 64)
-		start, duration := ffmpegSplitTimes(input.cuesheet, input.cuesheetFile, track, d)
+		start, duration := ffmpegSplitTimes(input.cuesheet, input.cuesheetFile, track, d, options.Gaps)
 		ffmpegParameters = append(ffmpegParameters, "-ss", start, "-t", duration)
 	}
 
@@ -270,44 +389,98 @@ func transformStream(fr *FileRecord, track int) error {
 			fr.error.Print(err)
 			return err
 		}
+		journal.Record(fr, JournalEntry{Action: journalCreate, Src: input.path, Dst: dst})
 	}
 	ffmpegParameters = append(ffmpegParameters, dst)
 
 	fr.debug.Printf("FFmpeg parameters: track #%v %q", track, ffmpegParameters)
 
-	cmd := exec.Command("ffmpeg", ffmpegParameters...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", ffmpegParameters...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
+	detachProcess(cmd)
 
 	err := cmd.Run()
 	if err != nil {
 		fr.error.Printf(stderr.String())
+		if dst != output.Path {
+			os.Remove(dst)
+		}
 		return err
 	}
 
+	// FFmpeg cannot store the identifiers under the names used by Picard in
+	// ID3v2 and MP4: the tags are written again as in place.
+	if picardFormats[output.Format] && tagwriter.Supported(dst) {
+		err = tagwriter.Write(dst, output.Tags)
+		if err != nil {
+			fr.error.Print(err)
+			if dst != output.Path {
+				os.Remove(dst)
+			}
+			return err
+		}
+	}
+
 	if input.path == output.Path {
+		// The original is kept in the trash.
+		trashed, err := trashFile(input.path, options.Trash)
+		if err != nil {
+			fr.error.Print(err)
+			os.Remove(dst)
+			return err
+		}
+		journal.Record(fr, JournalEntry{Action: journalMove, Src: input.path, Dst: trashed})
 		fr.debug.Printf("Rename %q to %q to transform inplace", dst, input.path)
 		err = os.Rename(dst, input.path)
 		if err != nil {
 			fr.error.Print(err)
 			return err
 		}
+		journal.Record(fr, JournalEntry{Action: journalMove, Src: dst, Dst: input.path})
 	} else if output.Removesource {
-		fr.info.Printf("Remove source %q", input.path)
-		err := os.Remove(input.path)
+		trashed, err := trashFile(input.path, options.Trash)
 		if err != nil {
 			fr.error.Println(err)
 			return err
 		}
+		fr.info.Printf("Move source %q to %q", input.path, trashed)
+		journal.Record(fr, JournalEntry{Action: journalMove, Src: input.path, Dst: trashed})
+		emitEvent(fr, Event{Stage: stageTransformer, Type: eventSourceRemoved, Track: track + 1}, nil)
 	}
 
 	return nil
 }
 
-func transformMetadata(fr *FileRecord, track int) error {
+// transformMetadata resets '*created' once the source has been moved to the
+// output: the output is then the only copy and must be kept on failure.
+func transformMetadata(fr *FileRecord, track int, created *string) error {
 	input := &fr.input
 	output := &fr.output[track]
 
+	var tagsChanged = false
+
+	for k, v := range input.tags {
+		if k != "encoder" && output.Tags[k] != v {
+			tagsChanged = true
+			break
+		}
+	}
+	if !tagsChanged {
+		for k, v := range output.Tags {
+			if k != "encoder" && input.tags[k] != v {
+				tagsChanged = true
+				break
+			}
+		}
+	}
+
+	// The former tags are only journaled if they are changed.
+	var formerTags map[string]string
+	if tagsChanged {
+		formerTags = input.tags
+	}
+
 	var err error
 
 	if input.path != output.Path {
@@ -315,6 +488,11 @@ func transformMetadata(fr *FileRecord, track int) error {
 		if output.Removesource {
 			fr.debug.Printf("Rename %q to %q", input.path, output.Path)
 			err = os.Rename(input.path, output.Path)
+			if err == nil {
+				*created = ""
+				journal.Record(fr, JournalEntry{Action: journalMove, Src: input.path, Dst: output.Path, Tags: formerTags})
+				emitEvent(fr, Event{Stage: stageTransformer, Type: eventSourceRemoved, Track: track + 1}, nil)
+			}
 		}
 		if err != nil || !output.Removesource {
 			// If renaming failed, it might be because of a cross-device
@@ -330,68 +508,22 @@ func transformMetadata(fr *FileRecord, track int) error {
 				err = os.Remove(input.path)
 				if err != nil {
 					fr.error.Println(err)
+				} else {
+					*created = ""
+					journal.Record(fr, JournalEntry{Action: journalMove, Src: input.path, Dst: output.Path, Tags: formerTags})
+					emitEvent(fr, Event{Stage: stageTransformer, Type: eventSourceRemoved, Track: track + 1}, nil)
 				}
 			}
 		}
 	}
 
-	var tagsChanged = false
-
-	for k, v := range input.tags {
-		if k != "encoder" && output.Tags[k] != v {
-			tagsChanged = true
-			break
-		}
-	}
-	if !tagsChanged {
-		for k, v := range output.Tags {
-			if k != "encoder" && input.tags[k] != v {
-				tagsChanged = true
-				break
-			}
-		}
-	}
-
 	if tagsChanged {
-		fr.debug.Print("Set tags with TagLib")
-
-		f, err := taglib.Read(output.Path)
-		if err != nil {
-			fr.error.Print(err)
-			return err
-		}
-		defer f.Close()
-
-		if output.Tags["album"] != "" {
-			f.SetAlbum(output.Tags["album"])
-		}
-		if output.Tags["artist"] != "" {
-			f.SetArtist(output.Tags["artist"])
-		}
-		if output.Tags["comment"] != "" {
-			f.SetComment(output.Tags["comment"])
-		}
-		if output.Tags["genre"] != "" {
-			f.SetGenre(output.Tags["genre"])
-		}
-		if output.Tags["title"] != "" {
-			f.SetTitle(output.Tags["title"])
-		}
-		if output.Tags["track"] != "" {
-			t, _ := strconv.Atoi(output.Tags["track"])
-			// There is no need to check for errors as the caller has already.
-			f.SetTrack(t)
-		}
-		if output.Tags["date"] != "" {
-			t, _ := strconv.Atoi(output.Tags["date"])
-			// There is no need to check for errors as the caller has already.
-			f.SetYear(t)
+		fr.debug.Print("Set tags in place")
+		if input.path == output.Path {
+			journal.Record(fr, JournalEntry{Action: journalTags, Dst: output.Path, Tags: input.tags})
 		}
 
-		err = f.Save()
-		if err != nil {
-			fr.error.Print(err)
-		}
+		return tagwriter.Write(output.Path, output.Tags)
 	}
 	return nil
 }
@@ -496,6 +628,77 @@ func makeCoverDst(fr *FileRecord, dst string, inputPath string, checksum string)
 	return dst, nil
 }
 
+// loadEmbedCovers returns the pictures to embed in the output of 'track'.
+// Covers that cannot be loaded are skipped with a warning.
+func loadEmbedCovers(fr *FileRecord, track int) []tagwriter.Picture {
+	input := &fr.input
+	var pictures []tagwriter.Picture
+
+	for _, cover := range fr.output[track].EmbedCovers {
+		var data []byte
+		var err error
+		switch cover.Source {
+		case "external":
+			data, err = ioutil.ReadFile(filepath.Join(filepath.Dir(input.path), cover.Name))
+		case "online":
+			data = fr.onlineCoverCache
+		case "embedded":
+			if cover.Index < 1 || cover.Index > len(fr.embeddedCoverCache) {
+				err = fmt.Errorf("no embedded cover at index %v", cover.Index)
+			} else {
+				data = fr.embeddedCoverCache[cover.Index-1]
+			}
+		default:
+			err = fmt.Errorf("unknown cover source %q", cover.Source)
+		}
+		if err == nil && len(data) == 0 {
+			err = fmt.Errorf("%v cover is empty", cover.Source)
+		}
+
+		// Like 'transferCovers', copy unless both parameters and format are set.
+		if err == nil && len(cover.Parameters) != 0 && cover.Format != "" {
+			cmdArray := []string{"-nostdin", "-v", "error", "-i", "-", "-an", "-sn"}
+			cmdArray = append(cmdArray, cover.Parameters...)
+			cmdArray = append(cmdArray, "-f", cover.Format, "-")
+			fr.debug.Printf("FFmpeg parameters: %q", cmdArray)
+
+			cmd := exec.Command("ffmpeg", cmdArray...)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			detachProcess(cmd)
+			cmd.Stdin = bytes.NewReader(data)
+			data, err = cmd.Output()
+			if err != nil {
+				err = fmt.Errorf("%v: %s", err, stderr.String())
+			}
+		}
+
+		var config image.Config
+		var format string
+		if err == nil {
+			config, format, err = image.DecodeConfig(bytes.NewReader(data))
+		}
+		if err != nil {
+			fr.warning.Printf("Cannot embed %v cover: %v", cover.Source, err)
+			continue
+		}
+
+		p := tagwriter.Picture{
+			Type:   tagwriter.PictureFrontCover,
+			MIME:   "image/" + format,
+			Width:  config.Width,
+			Height: config.Height,
+			Data:   data,
+		}
+		if cover.Type == "back" {
+			p.Type = tagwriter.PictureBackCover
+		}
+		pictures = append(pictures, p)
+	}
+
+	return pictures
+}
+
 func transferCovers(fr *FileRecord, cover outputCover, coverName string, inputSource io.Reader, checksum string) {
 	if cover.Path == "" {
 		return
@@ -505,6 +708,7 @@ func transferCovers(fr *FileRecord, cover outputCover, coverName string, inputSo
 		coverNewPath, err := makeCoverDst(fr, cover.Path, fr.input.path, checksum)
 		if err != nil {
 			fr.error.Print(err)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Output: cover.Path}, err)
 			return
 		}
 		if coverNewPath == "" {
@@ -519,16 +723,20 @@ func transferCovers(fr *FileRecord, cover outputCover, coverName string, inputSo
 		}
 
 		fr.info.Printf("Cover %v -> %s", coverName, coverNewPath)
+		journal.Record(fr, JournalEntry{Action: journalCreate, Dst: coverNewPath})
 		if _, err = io.Copy(fd, inputSource); err != nil {
 			fr.warning.Println(err)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Output: coverNewPath}, err)
 			return
 		}
 		fd.Close()
+		emitEvent(fr, Event{Stage: stageTransformer, Type: eventCoverWritten, Output: coverNewPath}, nil)
 
 	} else {
 		coverNewPath, err := makeCoverDst(fr, cover.Path, fr.input.path, checksum)
 		if err != nil {
 			fr.error.Print(err)
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Output: cover.Path}, err)
 			return
 		}
 		if coverNewPath == "" {
@@ -541,17 +749,21 @@ func transferCovers(fr *FileRecord, cover outputCover, coverName string, inputSo
 		cmdArray = append(cmdArray, "-f", cover.Format, coverNewPath)
 
 		fr.info.Printf("Cover %v -> %s", coverName, coverNewPath)
+		journal.Record(fr, JournalEntry{Action: journalCreate, Dst: coverNewPath})
 		fr.debug.Printf("FFmpeg parameters: %q", cmdArray)
 
 		cmd := exec.Command("ffmpeg", cmdArray...)
 		var stderr bytes.Buffer
 		cmd.Stderr = &stderr
+		detachProcess(cmd)
 		cmd.Stdin = inputSource
 
 		_, err = cmd.Output()
 		if err != nil {
 			fr.warning.Printf(stderr.String())
+			emitEvent(fr, Event{Stage: stageTransformer, Type: eventFailed, Output: coverNewPath}, err)
 			return
 		}
+		emitEvent(fr, Event{Stage: stageTransformer, Type: eventCoverWritten, Output: coverNewPath}, nil)
 	}
 }
@@ -4,27 +4,36 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/yookoala/realpath"
 )
 
-var errInputFile = errors.New("cannot process input file")
+var (
+	errInputFile     = errors.New("cannot process input file")
+	errDuplicateFile = errors.New("duplicate file")
+	errResumedFile   = errors.New("file processed by the resumed run")
+)
 
 // walker feeds the output channel with files.
-// Duplicates are discarded.
+// Duplicates are discarded. A file is a duplicate if it has the same real path
+// and the same modification time as a previous file: in watch mode, a file
+// written again at the same path must be processed again.
 type walker struct {
-	visited map[string]bool
+	visited map[string]time.Time
 }
 
 func (w *walker) Init() {
-	w.visited = map[string]bool{}
+	w.visited = map[string]time.Time{}
 }
 
 func (w *walker) Close() {}
 
-func (w *walker) Run(fr *FileRecord) error {
+func (w *walker) Run(ctx context.Context, fr *FileRecord) error {
 	if !options.Extensions[strings.ToLower(Ext(fr.input.path))] {
 		fr.debug.Printf("Unknown extension '%v'", Ext(fr.input.path))
 		return errInputFile
@@ -32,13 +41,33 @@ func (w *walker) Run(fr *FileRecord) error {
 	rpath, err := realpath.Realpath(fr.input.path)
 	if err != nil {
 		fr.error.Print("Cannot get real path:", err)
+		emitEvent(fr, Event{Stage: stageWalker, Type: eventFailed}, err)
 		return errInputFile
 	}
-	if w.visited[rpath] {
+	st, err := os.Stat(rpath)
+	if err != nil {
+		fr.error.Print(err)
+		emitEvent(fr, Event{Stage: stageWalker, Type: eventFailed}, err)
+		return errInputFile
+	}
+	if modTime, ok := w.visited[rpath]; ok && modTime.Equal(st.ModTime()) {
 		fr.debug.Print("Duplicate file")
+		emitEvent(fr, Event{Stage: stageWalker, Type: eventSkipped}, errDuplicateFile)
+		return errInputFile
+	}
+
+	if !selection.Selected(fr.input.path, st) {
+		fr.debug.Print("Not selected")
+		return errInputFile
+	}
+
+	if checkpoint.Done(fr.input.path) {
+		fr.debug.Print("Processed by the resumed run")
+		emitEvent(fr, Event{Stage: stageWalker, Type: eventSkipped}, errResumedFile)
 		return errInputFile
 	}
 
-	w.visited[rpath] = true
+	w.visited[rpath] = st.ModTime()
+	emitEvent(fr, Event{Stage: stageWalker, Type: eventDiscovered}, nil)
 	return nil
 }
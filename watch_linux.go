@@ -0,0 +1,124 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	watchDirMask  = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY
+	watchReadSize = 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)
+)
+
+// Watch calls 'visit' on the regular files that are created in or moved to the
+// 'roots' folders and their subfolders. A file is only visited once no event
+// has been reported on it for the 'settle' duration, so that partially written
+// files are ignored. New subfolders are watched as well.
+// Watch never returns unless an error occurs.
+func Watch(roots []string, settle time.Duration, visit func(path string)) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	defer syscall.Close(fd)
+
+	// Files for which events were reported, and when the last one was.
+	pending := struct {
+		v map[string]time.Time
+		sync.Mutex
+	}{v: map[string]time.Time{}}
+
+	// Watch descriptors to folder paths.
+	folders := map[int]string{}
+	addFolder := func(root string, visitFiles bool) {
+		_ = RealPathWalk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				wd, err := syscall.InotifyAddWatch(fd, path, watchDirMask)
+				if err != nil {
+					warning.Printf("cannot watch %v: %v", path, os.NewSyscallError("inotify_add_watch", err))
+					return nil
+				}
+				folders[wd] = path
+			} else if visitFiles && info.Mode().IsRegular() {
+				pending.Lock()
+				pending.v[path] = time.Now()
+				pending.Unlock()
+			}
+			return nil
+		})
+	}
+	for _, root := range roots {
+		addFolder(root, false)
+	}
+
+	go func() {
+		ticker := time.NewTicker(settle / 2)
+		for range ticker.C {
+			var settled []string
+			pending.Lock()
+			for path, last := range pending.v {
+				if time.Since(last) >= settle {
+					settled = append(settled, path)
+					delete(pending.v, path)
+				}
+			}
+			pending.Unlock()
+			for _, path := range settled {
+				if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() {
+					visit(path)
+				}
+			}
+		}
+	}()
+
+	var buf [watchReadSize]byte
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			folder, ok := folders[int(event.Wd)]
+			if !ok || event.Len == 0 {
+				continue
+			}
+			path := filepath.Join(folder, string(bytes.TrimRight(nameBytes, "\x00")))
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// Files may have landed before the watch was set up.
+					addFolder(path, true)
+				}
+				continue
+			}
+
+			pending.Lock()
+			_, known := pending.v[path]
+			// A modification only delays files that are already pending: it
+			// should not trigger the processing of a file that was already visited.
+			if known || event.Mask&syscall.IN_MODIFY == 0 {
+				pending.v[path] = time.Now()
+			}
+			pending.Unlock()
+		}
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright © 2013-2018 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Watch is only supported on Linux.
+func Watch(roots []string, settle time.Duration, visit func(path string)) error {
+	return errors.New("watch mode is not supported on this platform")
+}